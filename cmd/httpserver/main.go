@@ -1,32 +1,143 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
+	"flag"
 	"fmt"
+	"httpfromtcp/internal/cookies"
+	"httpfromtcp/internal/form"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/negotiate"
+	"httpfromtcp/internal/proxy"
+	"httpfromtcp/internal/ratelimit"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
-	"io"
+	"httpfromtcp/internal/session"
+	"httpfromtcp/internal/sse"
+	"httpfromtcp/internal/trace"
+	"httpfromtcp/internal/websocket"
 	"log"
-	"net/http"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
+// restartTimeout bounds how long a restarted process may take to start serving
+const restartTimeout = 30 * time.Second
+
+// drainTimeout bounds how long requests in progress may take to finish on the way out
+const drainTimeout = 30 * time.Second
+
+// maxConns and maxConnsPerIP bound how many connections are handled at once
+const (
+	maxConns      = 1024
+	maxConnsPerIP = 64
+)
+
+// httpbinTimeout bounds how long httpbin may take to start answering before
+// the client gets a 504; the body then streams for as long as it takes, so
+// /httpbin/stream and /httpbin/drip keep working
+const httpbinTimeout = 30 * time.Second
+
+// maxDecodedBodySize caps how large a compressed request body may grow once decoded
+const maxDecodedBodySize = 10 << 20
+
+// httpbinProxy forwards /httpbin/* requests to httpbin.org
+var httpbinProxy = mustNewProxy("https://httpbin.org", "/httpbin", httpbinTimeout)
+
+// mustNewProxy creates a reverse proxy that strips prefix before forwarding
+// to upstream and waits up to responseTimeout for its response headers
+func mustNewProxy(upstream, prefix string, responseTimeout time.Duration) *proxy.ReverseProxy {
+	p, err := proxy.New(upstream)
+	if err != nil {
+		log.Fatalf("Error creating proxy: %v", err)
+	}
+	p.StripPrefix = prefix
+	p.ResponseTimeout = responseTimeout
+	return p
+}
+
+// forwardProxy serves CONNECT and absolute-form requests for other hosts when
+// enabled with -forward-proxy, but never into our own network
+var forwardProxy = newForwardProxy()
+
+func newForwardProxy() *proxy.ForwardProxy {
+	p := proxy.NewForwardProxy()
+	p.Deny = append([]string{"localhost"}, proxy.SpecialPurposeNetworks...)
+	return p
+}
+
+// limitProxying keeps each client to a steady rate of proxied requests, with room for bursts
+var limitProxying = ratelimit.Middleware(
+	&ratelimit.TokenBucket{Limit: 60, Period: time.Minute, Store: ratelimit.NewMemoryStore()},
+	ratelimit.ByClientIP,
+)
+
+// The proxies as served, behind the rate limit. forwardProxyHandler stays nil
+// unless forward proxying is enabled.
+var (
+	forwardProxyHandler server.Handler
+	httpbinProxyHandler = limitProxying(httpbinProxy.Handle)
+)
+
+// sessions keeps visitor sessions in memory, evicting expired ones every
+// minute and, past session.DefaultMaxSessions, the ones closest to expiring
+var sessions = &session.Manager{
+	Store:  session.NewMemoryStore(time.Minute),
+	Cookie: cookies.Cookie{SameSite: cookies.SameSiteLax},
+}
+
+// visitsHandler counts each visitor's requests in their session
+var visitsHandler = sessions.Middleware(handleVisits)
+
+// uploadHandler parses submitted forms, allowing uploads of up to 32 MiB
+var uploadHandler = form.Middleware(form.Limits{MaxTotalSize: 32 << 20})(handleUpload)
+
 // myHandler handles HTTP requests with HTML responses
 func myHandler(w *response.Writer, req *request.Request) {
 	var statusCode response.StatusCode
 	var htmlContent string
 
+	// Absolute-form requests naming us are served like any other, the rest
+	// are addressed to a proxy
+	if target, ok := localTarget(req); ok {
+		req.RequestLine.RequestTarget = target
+	} else if proxy.IsForwardProxyRequest(req) {
+		if forwardProxyHandler == nil {
+			w.WriteError(response.StatusForbidden, nil)
+			return
+		}
+		forwardProxyHandler(w, req)
+		return
+	}
+
 	// Check if this is a proxy request to httpbin
 	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handleHttpbinProxy(w, req)
+		httpbinProxyHandler(w, req)
+		return
+	}
+
+	// Check if this is a WebSocket echo request
+	if req.RequestLine.RequestTarget == "/ws" {
+		handleWebSocketEcho(w, req)
+		return
+	}
+
+	// Check if this is a request for the clock event stream
+	if req.RequestLine.RequestTarget == "/events" {
+		handleClockEvents(w, req)
 		return
 	}
 
@@ -36,6 +147,24 @@ func myHandler(w *response.Writer, req *request.Request) {
 		return
 	}
 
+	// Check if this is a request for the session visit counter
+	if req.RequestLine.RequestTarget == "/visits" {
+		visitsHandler(w, req)
+		return
+	}
+
+	// Check if this is a form submission
+	if req.RequestLine.RequestTarget == "/upload" {
+		uploadHandler(w, req)
+		return
+	}
+
+	// Check if this is a request for the negotiated greeting
+	if req.RequestLine.RequestTarget == "/hello" {
+		handleHello(w, req)
+		return
+	}
+
 	switch req.RequestLine.RequestTarget {
 	case "/yourproblem":
 		statusCode = response.StatusBadRequest
@@ -88,93 +217,69 @@ func myHandler(w *response.Writer, req *request.Request) {
 	w.WriteBody([]byte(htmlContent))
 }
 
-// handleHttpbinProxy proxies requests to httpbin.org with chunked responses
-func handleHttpbinProxy(w *response.Writer, req *request.Request) {
-	// Extract the path after /httpbin/
-	httpbinPath := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	if httpbinPath == "" {
-		httpbinPath = "/"
-	}
+// helloNegotiator offers the greeting as JSON, HTML or plain text, in English or French
+var helloNegotiator = &negotiate.Negotiator{
+	Types:     []string{"application/json", "text/html", "text/plain"},
+	Languages: []string{"en", "fr"},
+	Default:   negotiate.Result{Language: "en"},
+}
 
-	// Make request to httpbin.org
-	proxyURL := "https://httpbin.org" + httpbinPath
-	fmt.Printf("Proxying to: %s\n", proxyURL)
+// greetings holds the greeting in each language helloNegotiator offers
+var greetings = map[string]string{"en": "Hello", "fr": "Bonjour"}
 
-	resp, err := http.Get(proxyURL)
-	if err != nil {
-		// Error making request
-		w.WriteStatusLine(response.StatusInternalServerError)
-		responseHeaders := headers.NewHeaders()
-		errorMsg := "Failed to proxy request"
-		responseHeaders.Override("Content-Length", strconv.Itoa(len(errorMsg)))
-		responseHeaders.Override("Connection", "close")
-		responseHeaders.Override("Content-Type", "text/plain")
-		w.WriteHeaders(responseHeaders)
-		w.WriteBody([]byte(errorMsg))
+// handleHello greets the client in the format and language it prefers
+func handleHello(w *response.Writer, req *request.Request) {
+	result, ok := helloNegotiator.Apply(w, req)
+	if !ok {
 		return
 	}
-	defer resp.Body.Close()
 
-	// Write status line (convert from http.Response status code)
-	statusCode := response.StatusCode(resp.StatusCode)
-	w.WriteStatusLine(statusCode)
-
-	// Create headers for chunked response with trailers
-	responseHeaders := headers.NewHeaders()
-	responseHeaders.Override("Transfer-Encoding", "chunked")
-	responseHeaders.Override("Connection", "close")
-	responseHeaders.Override("Trailer", "X-Content-SHA256, X-Content-Length")
-
-	// Copy content type from original response
-	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
-		responseHeaders.Override("Content-Type", contentType)
+	greeting := greetings[result.Language]
+	var body string
+	switch result.Type {
+	case "application/json":
+		body = fmt.Sprintf("{\"greeting\":%q}\n", greeting)
+	case "text/html":
+		body = fmt.Sprintf("<html><body><h1>%s!</h1></body></html>\n", greeting)
+	default:
+		body = greeting + "!\n"
 	}
 
-	// Write headers
-	w.WriteHeaders(responseHeaders)
-
-	// Track the full response body for hashing
-	var fullBody []byte
-
-	// Stream the response in chunks
-	buffer := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			fmt.Printf("Read %d bytes from httpbin.org\n", n)
-			chunk := buffer[:n]
+	h := headers.NewHeaders()
+	h.Override("Content-Type", result.Type+"; charset=utf-8")
+	h.Override("Content-Language", result.Language)
+	w.WriteResponse(response.StatusOK, h, []byte(body))
+}
 
-			// Add to full body for hash calculation
-			fullBody = append(fullBody, chunk...)
+// handleVisits tells the visitor how many times they have been here
+func handleVisits(w *response.Writer, req *request.Request) {
+	s := session.FromRequest(req)
+	visits, _ := strconv.Atoi(s.Get("visits"))
+	visits++
+	s.Set("visits", strconv.Itoa(visits))
+	w.WriteResponse(response.StatusOK, nil, []byte(fmt.Sprintf("Visits this session: %d\n", visits)))
+}
 
-			// Write chunk to client
-			w.WriteChunkedBody(chunk)
-		}
+// handleUpload lists the fields and files of a submitted form
+func handleUpload(w *response.Writer, req *request.Request) {
+	f := form.FromRequest(req)
+	if f == nil {
+		w.WriteError(response.StatusUnsupportedMediaType, nil)
+		return
+	}
 
-		if err == io.EOF {
-			break
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(f.Values)) {
+		for _, value := range f.Values[name] {
+			fmt.Fprintf(&b, "field %s: %q\n", name, value)
 		}
-		if err != nil {
-			fmt.Printf("Error reading from httpbin.org: %v\n", err)
-			break
+	}
+	for _, name := range slices.Sorted(maps.Keys(f.Files)) {
+		for _, file := range f.Files[name] {
+			fmt.Fprintf(&b, "file %s: %q, %d bytes\n", name, file.Filename, file.Size)
 		}
 	}
-
-	// Signal end of chunked response
-	w.WriteChunkedBodyDone()
-
-	// Calculate SHA256 hash of the full body
-	hash := sha256.Sum256(fullBody)
-	hashHex := fmt.Sprintf("%x", hash)
-
-	// Write trailers
-	trailers := headers.NewHeaders()
-	trailers.Override("X-Content-SHA256", hashHex)
-	trailers.Override("X-Content-Length", strconv.Itoa(len(fullBody)))
-
-	w.WriteTrailers(trailers)
-
-	fmt.Printf("Sent response with %d bytes, SHA256: %s\n", len(fullBody), hashHex)
+	w.WriteResponse(response.StatusOK, nil, []byte(b.String()))
 }
 
 // handleVideo serves the video file
@@ -208,20 +313,238 @@ func handleVideo(w *response.Writer, req *request.Request) {
 
 	// Write video data
 	w.WriteBody(videoData)
+}
+
+// echoUpgrader accepts WebSocket connections for /ws
+var echoUpgrader = &websocket.Upgrader{EnableCompression: true}
+
+// handleWebSocketEcho sends every WebSocket message straight back to the client
+func handleWebSocketEcho(w *response.Writer, req *request.Request) {
+	conn, err := echoUpgrader.Upgrade(w, req)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
 
-	fmt.Printf("Served video file: %d bytes\n", len(videoData))
+// handleClockEvents streams the server time once a second as server-sent
+// events. A reconnecting client picks up the count where it left off.
+func handleClockEvents(w *response.Writer, req *request.Request) {
+	stream, err := sse.Start(w, req, sse.DefaultHeartbeatInterval)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	tick, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			tick++
+			event := sse.Event{ID: strconv.Itoa(tick), Event: "tick", Data: now.Format(time.RFC3339)}
+			if stream.Send(event) != nil {
+				return
+			}
+		case <-stream.Done():
+			return
+		}
+	}
+}
+
+// ownAuthorities holds the host:port pairs clients reach this server by, set
+// once the listeners are open
+var ownAuthorities map[string]bool
+
+// localAuthorities lists the host:port pairs the TCP listeners answer on.
+// Listeners on every interface answer on each interface's addresses, and
+// loopback ones on localhost too.
+func localAuthorities(listeners []net.Listener) map[string]bool {
+	authorities := map[string]bool{}
+	for _, listener := range listeners {
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		port := strconv.Itoa(addr.Port)
+		ips := []net.IP{addr.IP}
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			ips = nil
+			if ifaceAddrs, err := net.InterfaceAddrs(); err == nil {
+				for _, ifaceAddr := range ifaceAddrs {
+					if ipNet, ok := ifaceAddr.(*net.IPNet); ok {
+						ips = append(ips, ipNet.IP)
+					}
+				}
+			}
+		}
+		for _, ip := range ips {
+			authorities[net.JoinHostPort(ip.String(), port)] = true
+			if ip.IsLoopback() {
+				authorities[net.JoinHostPort("localhost", port)] = true
+			}
+		}
+	}
+	return authorities
+}
+
+// localTarget returns the origin-form target of an absolute-form request
+// naming this server, which must be served as if sent in origin form
+// (RFC 9112 section 3.2.2)
+func localTarget(req *request.Request) (string, bool) {
+	target := req.RequestLine.RequestTarget
+	if req.RequestLine.Method == "CONNECT" || !strings.HasPrefix(target, "http://") {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	if !ownAuthorities[net.JoinHostPort(strings.ToLower(u.Hostname()), port)] {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
+
+// routes are the targets myHandler serves pages of its own for
+var routes = []string{"/ws", "/events", "/video", "/visits", "/upload", "/hello", "/yourproblem", "/myproblem"}
+
+// routeLabel names the route myHandler picks for req in the metrics, so the
+// number of labels stays fixed however many paths clients make up
+func routeLabel(req *request.Request) string {
+	target, local := localTarget(req)
+	if !local {
+		target = req.RequestLine.RequestTarget
+	}
+	switch {
+	case !local && proxy.IsForwardProxyRequest(req):
+		return "proxy"
+	case strings.HasPrefix(target, "/httpbin/"):
+		return "/httpbin/*"
+	case slices.Contains(routes, target):
+		return target
+	}
+	return "/*"
+}
+
+// newLogger creates the logger for access logs and everything else, writing to stdout
+func newLogger(format string) (*slog.Logger, error) {
+	switch format {
+	case "common":
+		return slog.New(server.NewCLFHandler(os.Stdout, false)), nil
+	case "combined":
+		return slog.New(server.NewCLFHandler(os.Stdout, true)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
 }
 
 func main() {
-	server, err := server.Serve(port, myHandler)
+	addr := flag.String("addr", fmt.Sprintf(":%d", port), "address to listen on: host:port, tcp4:host:port, tcp6:host:port or unix:/path")
+	logFormat := flag.String("log-format", "combined", "access log format: common, combined or json")
+	traceFile := flag.String("trace-file", "", "file to append spans to as JSON lines, or empty to trace nothing")
+	metricsPath := flag.String("metrics-path", "/metrics", "path serving Prometheus metrics, or empty to serve none")
+	forward := flag.Bool("forward-proxy", false, "serve CONNECT and absolute-form requests for other hosts; set FORWARD_PROXY_AUTH=user:password to require credentials")
+	flag.Parse()
+
+	if *forward {
+		if auth := os.Getenv("FORWARD_PROXY_AUTH"); auth != "" {
+			username, password, _ := strings.Cut(auth, ":")
+			forwardProxy.Credentials = map[string]string{username: password}
+		}
+		forwardProxyHandler = limitProxying(forwardProxy.Handle)
+	}
+
+	logger, err := newLogger(*logFormat)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		log.Fatalf("Error setting up logging: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	// Route the log package through the same handler
+	slog.SetDefault(logger)
+
+	registry := metrics.NewRegistry()
+	// Request IDs from clients are taken at their word, so they can tie our logs to theirs
+	middleware := []server.Middleware{server.RequestID(true), server.AccessLog(logger)}
+	if *metricsPath != "" {
+		// Scrapes are logged but not counted in the metrics they read
+		middleware = append(middleware, metrics.Expose(registry, *metricsPath))
+	}
+	httpMetrics := metrics.NewHTTPMetrics(registry)
+	httpMetrics.Route = routeLabel
+	middleware = append(middleware, httpMetrics.Middleware)
+	if *traceFile != "" {
+		exporter, err := trace.NewFileExporter(*traceFile)
+		if err != nil {
+			log.Fatalf("Error opening trace file: %v", err)
+		}
+		defer exporter.Close()
+		tracer := &trace.Tracer{Exporter: exporter, ErrorLog: logger, Route: routeLabel}
+		middleware = append(middleware, tracer.Middleware)
+	}
+	middleware = append(middleware, server.DecompressRequests(maxDecodedBodySize))
+
+	srv := &server.Server{
+		Addr:      *addr,
+		Handler:   server.Chain(myHandler, middleware...),
+		ErrorLog:  logger,
+		KeepAlive: true,
+		// Bodies are read in full before handlers run; /upload needs 32 MiB
+		MaxBodySize: 32 << 20,
+		// Over the limit, let connections queue in the backlog rather than fail
+		MaxConns:      maxConns,
+		OverLimit:     server.LimitPause,
+		MaxConnsPerIP: maxConnsPerIP,
+	}
+	metrics.RegisterServer(registry, srv)
+
+	// Sockets passed by systemd socket activation take the place of Addr
+	listeners, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatalf("Error using inherited sockets: %v", err)
+	}
+	if len(listeners) == 0 {
+		listener, err := server.Listen(srv.Addr)
+		if err != nil {
+			log.Fatalf("Error starting server: %v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	ownAuthorities = localAuthorities(listeners)
+	for _, listener := range listeners {
+		go srv.Serve(listener)
+		log.Println("Server listening on", listener.Addr())
+	}
+	notifyReady()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, restartSignals...)...)
+	for sig := range sigChan {
+		if slices.Contains(restartSignals, sig) && !restart(listeners) {
+			continue
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error draining requests: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// restartSignals is empty where sockets can't be handed to another process
+var restartSignals []os.Signal
+
+func restart(listeners []net.Listener) bool {
+	return false
+}
+
+func notifyReady() {}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"httpfromtcp/internal/server"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// restartSignals ask the server to hand its sockets to a fresh copy of itself
+var restartSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
+
+// restart starts a new process on the same sockets and reports whether it took over
+func restart(listeners []net.Listener) bool {
+	process, err := server.Restart(listeners, restartTimeout)
+	if err != nil {
+		log.Printf("Restart failed, still serving: %v", err)
+		return false
+	}
+	log.Printf("Process %d took over, draining requests in progress", process.Pid)
+	return true
+}
+
+// notifyReady tells the process that started us with restart that we are serving
+func notifyReady() {
+	if err := server.Ready(); err != nil {
+		log.Printf("Error notifying parent: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Defaults used by New
+const (
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultTimeout      = 30 * time.Second
+	DefaultMaxRedirects = 10
+)
+
+const userAgent = "httpfromtcp"
+
+// ErrTooManyRedirects is returned when a request is redirected more than MaxRedirects times
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Client sends HTTP/1.1 requests over a fresh connection per request
+type Client struct {
+	// Timeout bounds the whole exchange, including following redirects and
+	// reading the body. Zero means no limit.
+	Timeout time.Duration
+	// DialTimeout bounds opening each connection
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for the response headers after the
+	// request has been sent. Zero means no limit beyond Timeout.
+	ResponseHeaderTimeout time.Duration
+	// MaxRedirects is how many redirects are followed. Zero disables following,
+	// so the redirect response itself is returned.
+	MaxRedirects int
+	// TLSConfig is used for https URLs, ServerName is filled in from the URL
+	TLSConfig *tls.Config
+	// Dial, if set, opens the TCP connections instead of net.DialTimeout
+	Dial DialFunc
+}
+
+// Response is a response being read from a connection. Close must be called
+// once the body is no longer needed.
+type Response struct {
+	*response.Response
+	// URL is where the response came from, after following any redirects
+	URL *url.URL
+
+	conn net.Conn
+	// stop stops the request's context from closing conn
+	stop func() bool
+}
+
+// Close closes the connection the response is read from
+func (r *Response) Close() error {
+	if r.stop != nil {
+		r.stop()
+	}
+	return r.conn.Close()
+}
+
+// New creates a client with the default timeouts that follows redirects
+func New() *Client {
+	return &Client{
+		Timeout:      DefaultTimeout,
+		DialTimeout:  DefaultDialTimeout,
+		MaxRedirects: DefaultMaxRedirects,
+	}
+}
+
+// NewRequest builds a request for an absolute http or https URL
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	target, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	requestHeaders := headers.NewHeaders()
+	requestHeaders.Override("Host", target.Host)
+	requestHeaders.Override("User-Agent", userAgent)
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target.String(),
+			HttpVersion:   "1.1",
+		},
+		Headers: requestHeaders,
+		Body:    body,
+	}, nil
+}
+
+// Get fetches a URL
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends a request and returns the response, following redirects. The
+// request target must be an absolute URL; it's sent in origin-form. Once the
+// request's context ends the connection is closed, cutting the exchange and
+// any body still being read short.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	target, err := parseURL(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := c.roundTrip(req, target, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		next, ok := redirectRequest(req, resp)
+		if !ok || c.MaxRedirects == 0 {
+			return resp, nil
+		}
+		resp.Close()
+		if redirects >= c.MaxRedirects {
+			return nil, fmt.Errorf("%w: stopped after %d", ErrTooManyRedirects, c.MaxRedirects)
+		}
+
+		location, err := target.Parse(resp.Headers.Get("Location"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect location: %w", err)
+		}
+		if location.Scheme != "http" && location.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported redirect scheme: %s", location.Scheme)
+		}
+		if location.Host != target.Host {
+			// Don't hand our credentials to a different host
+			next.Headers.Delete("Authorization")
+			next.Headers.Delete("Cookie")
+		}
+		next.Headers.Override("Host", location.Host)
+		next.RequestLine.RequestTarget = location.String()
+		req, target = next, location
+	}
+}
+
+// roundTrip performs a single request/response exchange on a new connection
+func (c *Client) roundTrip(req *request.Request, target *url.URL, deadline time.Time) (*Response, error) {
+	ctx := req.Context()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := dialURL(target, c.DialTimeout, c.TLSConfig, c.Dial)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fail := func(err error) (*Response, error) {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	headerDeadline := deadline
+	if c.ResponseHeaderTimeout > 0 {
+		if d := time.Now().Add(c.ResponseHeaderTimeout); headerDeadline.IsZero() || d.Before(headerDeadline) {
+			headerDeadline = d
+		}
+	}
+	conn.SetDeadline(headerDeadline)
+
+	if err := wireRequest(req, target).Write(conn); err != nil {
+		return fail(err)
+	}
+	resp, err := response.ResponseFromReader(conn, req.RequestLine.Method)
+	if err != nil {
+		return fail(err)
+	}
+	// Once the headers are in only the overall deadline applies to the body
+	conn.SetDeadline(deadline)
+
+	return &Response{Response: resp, URL: target, conn: conn, stop: stop}, nil
+}
+
+// wireRequest is the request as sent: origin-form target, Host filled in,
+// the body framed by Content-Length and the connection closed afterwards
+func wireRequest(req *request.Request, target *url.URL) *request.Request {
+	wireHeaders := headers.NewHeaders()
+	for key, value := range req.Headers {
+		wireHeaders.Override(key, value)
+	}
+	if wireHeaders.Get("Host") == "" {
+		wireHeaders.Override("Host", target.Host)
+	}
+	wireHeaders.Override("Connection", "close")
+	wireHeaders.Delete("Transfer-Encoding")
+	if len(req.Body) > 0 || wireHeaders.Get("Content-Length") != "" {
+		wireHeaders.Override("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        req.RequestLine.Method,
+			RequestTarget: target.RequestURI(),
+			HttpVersion:   "1.1",
+		},
+		Headers: wireHeaders,
+		Body:    req.Body,
+	}
+}
+
+// redirectRequest returns the request to send next if resp is a redirect we follow
+func redirectRequest(req *request.Request, resp *Response) (*request.Request, bool) {
+	if resp.Headers.Get("Location") == "" {
+		return nil, false
+	}
+
+	next := &request.Request{
+		RequestLine: req.RequestLine,
+		Headers:     headers.NewHeaders(),
+		Body:        req.Body,
+	}
+	for key, value := range req.Headers {
+		next.Headers.Override(key, value)
+	}
+
+	switch resp.StatusLine.StatusCode {
+	case 301, 302, 303:
+		// Browsers turn these into a GET without a body, except that 301 and
+		// 302 only do so for POST (RFC 9110 section 15.4)
+		method := req.RequestLine.Method
+		if (resp.StatusLine.StatusCode == 303 && method != "HEAD") || method == "POST" {
+			next.RequestLine.Method = "GET"
+			next.Body = nil
+			next.Headers.Delete("Content-Length")
+			next.Headers.Delete("Content-Type")
+		}
+	case 307, 308:
+		// Method and body are kept as they are
+	default:
+		return nil, false
+	}
+	return next.WithContext(req.Context()), true
+}
+
+// DialFunc opens a plain TCP connection to addr ("host:port")
+type DialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// Dial connects to the host of an http or https URL, performing the TLS
+// handshake for https
+func Dial(target *url.URL, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	return dialURL(target, timeout, tlsConfig, nil)
+}
+
+// dialURL is Dial with an optional custom DialFunc for the TCP connection
+func dialURL(target *url.URL, timeout time.Duration, tlsConfig *tls.Config, dial DialFunc) (net.Conn, error) {
+	host := target.Hostname()
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if dial == nil {
+		dial = func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
+	}
+	conn, err := dial(addr, timeout)
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func parseURL(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme: %q", target.Scheme)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", rawURL)
+	}
+	return target, nil
+}
+
+// ReadBody reads the whole response body and closes the response
+func (r *Response) ReadBody() ([]byte, error) {
+	defer r.Close()
+	return io.ReadAll(r.Body)
+}
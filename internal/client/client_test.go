@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientDo(t *testing.T) {
+	// Test: Content-Length response
+	addr, received := startServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	})
+	resp, err := New().Get("http://" + addr + "/greeting?lang=en")
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	req := <-received
+	assert.Equal(t, "/greeting?lang=en", req.RequestLine.RequestTarget)
+	assert.Equal(t, addr, req.Headers.Get("Host"))
+	assert.Equal(t, "close", req.Headers.Get("Connection"))
+
+	// Test: Request body is sent with a Content-Length
+	addr, received = startServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 204 No Content\r\n\r\n"
+	})
+	req, err = NewRequest("POST", "http://"+addr+"/items", []byte(`{"id":1}`))
+	require.NoError(t, err)
+	req.Headers.Override("Content-Type", "application/json")
+	resp, err = New().Do(req)
+	require.NoError(t, err)
+	resp.Close()
+	sent := <-received
+	assert.Equal(t, "POST", sent.RequestLine.Method)
+	assert.Equal(t, `{"id":1}`, string(sent.Body))
+	assert.Equal(t, "application/json", sent.Headers.Get("Content-Type"))
+
+	// Test: Chunked response with trailers
+	addr, _ = startServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Done: yes\r\n\r\n"
+	})
+	resp, err = New().Get("http://" + addr + "/")
+	require.NoError(t, err)
+	body, err = resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	assert.Equal(t, "yes", resp.Trailers.Get("X-Done"))
+
+	// Test: Response read until close
+	addr, _ = startServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 200 OK\r\n\r\neverything"
+	})
+	resp, err = New().Get("http://" + addr + "/")
+	require.NoError(t, err)
+	body, err = resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "everything", string(body))
+
+	// Test: Unsupported scheme
+	_, err = New().Get("ftp://example.com/")
+	require.Error(t, err)
+}
+
+func TestClientRedirects(t *testing.T) {
+	// Test: 302 after POST becomes a GET without a body
+	addr, received := startServer(t, func(req *request.Request) string {
+		if req.RequestLine.RequestTarget == "/old" {
+			return "HTTP/1.1 302 Found\r\nLocation: /new\r\nContent-Length: 0\r\n\r\n"
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone"
+	})
+	req, err := NewRequest("POST", "http://"+addr+"/old", []byte("data"))
+	require.NoError(t, err)
+	resp, err := New().Do(req)
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(body))
+	assert.Equal(t, "http://"+addr+"/new", resp.URL.String())
+	<-received
+	second := <-received
+	assert.Equal(t, "GET", second.RequestLine.Method)
+	assert.Empty(t, second.Body)
+
+	// Test: 307 keeps the method and body
+	addr, received = startServer(t, func(req *request.Request) string {
+		if req.RequestLine.RequestTarget == "/old" {
+			return "HTTP/1.1 307 Temporary Redirect\r\nLocation: /new\r\nContent-Length: 0\r\n\r\n"
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	})
+	req, err = NewRequest("PUT", "http://"+addr+"/old", []byte("data"))
+	require.NoError(t, err)
+	resp, err = New().Do(req)
+	require.NoError(t, err)
+	resp.Close()
+	<-received
+	second = <-received
+	assert.Equal(t, "PUT", second.RequestLine.Method)
+	assert.Equal(t, "data", string(second.Body))
+
+	// Test: Redirect loops give up
+	addr, _ = startServer(t, func(req *request.Request) string {
+		return "HTTP/1.1 301 Moved Permanently\r\nLocation: /loop\r\nContent-Length: 0\r\n\r\n"
+	})
+	c := New()
+	c.MaxRedirects = 3
+	_, err = c.Get("http://" + addr + "/loop")
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: Redirects aren't followed when disabled
+	c.MaxRedirects = 0
+	resp, err = c.Get("http://" + addr + "/loop")
+	require.NoError(t, err)
+	resp.Close()
+	assert.Equal(t, 301, int(resp.StatusLine.StatusCode))
+}
+
+func TestClientTimeouts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request.RequestFromReader(conn)
+				// Send the headers, then stall before the body
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n"))
+				time.Sleep(time.Second)
+			}(conn)
+		}
+	}()
+	url := "http://" + listener.Addr().String() + "/"
+
+	// Test: Overall timeout covers reading the body
+	c := &Client{Timeout: 50 * time.Millisecond}
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	_, err = resp.ReadBody()
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded), "got %v", err)
+
+	// Test: Response header timeout doesn't apply once headers arrive
+	c = &Client{ResponseHeaderTimeout: 50 * time.Millisecond}
+	resp, err = c.Get(url)
+	require.NoError(t, err)
+	resp.Close()
+
+	// Test: Ending the request's context cuts the body short
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	resp, err = (&Client{}).Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer resp.Close()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = resp.ReadBody()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// Test: A request whose context already ended isn't sent
+	_, err = (&Client{}).Do(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// startServer runs a server that answers each request with respond and
+// reports every request it receives
+func startServer(t *testing.T, respond func(*request.Request) string) (string, <-chan *request.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan *request.Request, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			req, err := request.RequestFromReader(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			received <- req
+			fmt.Fprint(conn, respond(req))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), received
+}
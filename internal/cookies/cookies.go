@@ -0,0 +1,231 @@
+// Package cookies reads the cookies a client sends in its Cookie header and
+// builds the Set-Cookie headers that create, update and remove them, keeping
+// to the syntax of RFC 6265.
+package cookies
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoCookie is returned by Get when the request has no such cookie
+	ErrNoCookie = errors.New("cookie not present")
+	// ErrInvalidName, ErrInvalidValue and ErrInvalidAttribute are wrapped by
+	// the errors for cookies that can't be sent
+	ErrInvalidName      = errors.New("invalid cookie name")
+	ErrInvalidValue     = errors.New("invalid cookie value")
+	ErrInvalidAttribute = errors.New("invalid cookie attribute")
+)
+
+// SameSite controls whether a cookie is sent with cross-site requests
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out, so the browser's default applies
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	// SameSiteNone sends the cookie with every request, and needs Secure
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+// minExpires is the earliest Expires that RFC 6265 dates can express
+var minExpires = time.Date(1601, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Cookie is a cookie as sent in a Cookie header, which only carries Name and
+// Value, or in a Set-Cookie header with its attributes
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path   string
+	Domain string
+	// Expires is left out when zero
+	Expires time.Time
+	// MaxAge is in seconds. Zero leaves it out and a negative value sends
+	// Max-Age=0, which tells the browser to delete the cookie at once.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parse parses the value of a Cookie header into its cookies, in the order
+// sent. Pairs that aren't valid are skipped.
+func Parse(value string) []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !headers.ValidToken(name) {
+			continue
+		}
+		val, ok = unquote(val)
+		if !ok {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: val})
+	}
+	return cookies
+}
+
+// FromRequest returns the cookies sent with req
+func FromRequest(req *request.Request) []*Cookie {
+	return Parse(req.Headers.Get("Cookie"))
+}
+
+// Get returns the first cookie called name sent with req
+func Get(req *request.Request, name string) (*Cookie, error) {
+	for _, c := range FromRequest(req) {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
+
+// Set adds a Set-Cookie header for c to h, which may already hold others.
+// Cookies that Validate rejects aren't added.
+func Set(h headers.Headers, c *Cookie) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	h.Set("Set-Cookie", c.String())
+	return nil
+}
+
+// Validate checks that c can be sent in a Set-Cookie header: its name is a
+// token, its value and attributes keep to RFC 6265, and the attributes
+// browsers insist on go together are all there
+func (c *Cookie) Validate() error {
+	if !headers.ValidToken(c.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if _, ok := unquote(c.Value); !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidValue, c.Value)
+	}
+	if !validPath(c.Path) {
+		return fmt.Errorf("%w: path %q", ErrInvalidAttribute, c.Path)
+	}
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("%w: domain %q", ErrInvalidAttribute, c.Domain)
+	}
+	if !c.Expires.IsZero() && c.Expires.Before(minExpires) {
+		return fmt.Errorf("%w: expires %v is before 1601", ErrInvalidAttribute, c.Expires)
+	}
+	if c.SameSite < SameSiteDefault || c.SameSite > SameSiteNone {
+		return fmt.Errorf("%w: unknown SameSite %d", ErrInvalidAttribute, c.SameSite)
+	}
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None and Partitioned need Secure", ErrInvalidAttribute)
+	}
+	// Cookie prefixes promise the browser how the cookie was set
+	// (RFC 6265bis section 4.1.3)
+	if strings.HasPrefix(c.Name, "__Secure-") && !c.Secure {
+		return fmt.Errorf("%w: %s needs Secure", ErrInvalidAttribute, c.Name)
+	}
+	if strings.HasPrefix(c.Name, "__Host-") && (!c.Secure || c.Path != "/" || c.Domain != "") {
+		return fmt.Errorf("%w: %s needs Secure, Path=/ and no Domain", ErrInvalidAttribute, c.Name)
+	}
+	return nil
+}
+
+// String formats c as a Set-Cookie value. It doesn't validate c.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + headers.FormatTime(c.Expires))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// unquote strips the double quotes a cookie value may be wrapped in,
+// reporting whether what's left is made of cookie-octets
+func unquote(value string) (string, bool) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		// cookie-octet leaves out controls, space, DQUOTE, comma, semicolon
+		// and backslash
+		c := value[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// validPath reports whether path has no controls or semicolons
+func validPath(path string) bool {
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < ' ' || c == 0x7f || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// validDomain reports whether domain is a host name, with an optional
+// leading dot that browsers ignore
+func validDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package cookies
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Pairs are split on semicolons, keeping their order and quotes stripped
+	cookies := Parse(`session=abc123; theme="dark";lang=en`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, &Cookie{Name: "session", Value: "abc123"}, cookies[0])
+	assert.Equal(t, &Cookie{Name: "theme", Value: "dark"}, cookies[1])
+	assert.Equal(t, &Cookie{Name: "lang", Value: "en"}, cookies[2])
+
+	// Test: Empty values are allowed
+	cookies = Parse("empty=")
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "", cookies[0].Value)
+
+	// Test: Invalid pairs are skipped
+	cookies = Parse(`noequals; bad name=1; ok=1; bad=a b; quote=a"b; =x`)
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "ok", cookies[0].Name)
+
+	assert.Empty(t, Parse(""))
+}
+
+func TestGet(t *testing.T) {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Set("Cookie", "a=1; b=2; a=3")
+
+	// Test: The first cookie with the name is returned
+	c, err := Get(req, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", c.Value)
+	assert.Len(t, FromRequest(req), 3)
+
+	// Test: Missing cookies give ErrNoCookie
+	_, err = Get(req, "missing")
+	require.ErrorIs(t, err, ErrNoCookie)
+}
+
+func TestString(t *testing.T) {
+	// Test: Every attribute is formatted
+	c := &Cookie{
+		Name:        "id",
+		Value:       "a3fWa",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2030, time.October, 21, 7, 28, 0, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	assert.Equal(t, "id=a3fWa; Path=/; Domain=example.com; Expires=Mon, 21 Oct 2030 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+	require.NoError(t, c.Validate())
+
+	// Test: Negative MaxAge deletes the cookie and unset attributes are left out
+	c = &Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax}
+	assert.Equal(t, "id=; Max-Age=0; SameSite=Lax", c.String())
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		cookie Cookie
+		err    error
+	}{
+		{Cookie{Name: "ok", Value: "v", Path: "/a b", Domain: "sub.example-1.com"}, nil},
+		{Cookie{Name: "ok", Value: `"quoted"`}, nil},
+		// Test: Names must be tokens
+		{Cookie{Name: ""}, ErrInvalidName},
+		{Cookie{Name: "a=b"}, ErrInvalidName},
+		{Cookie{Name: "a b"}, ErrInvalidName},
+		// Test: Values must be cookie-octets
+		{Cookie{Name: "a", Value: "has space"}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: "x;y"}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: "x,y"}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: `back\slash`}, ErrInvalidValue},
+		{Cookie{Name: "a", Value: "é"}, ErrInvalidValue},
+		// Test: Attributes can't break out of the header
+		{Cookie{Name: "a", Path: "/;Secure"}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Path: "/\r\n"}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Domain: "exa mple.com"}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Domain: "-bad.com"}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Domain: "a..com"}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Expires: time.Date(1600, time.January, 1, 0, 0, 0, 0, time.UTC)}, ErrInvalidAttribute},
+		{Cookie{Name: "a", SameSite: SameSite(7)}, ErrInvalidAttribute},
+		// Test: Attributes browsers require together
+		{Cookie{Name: "a", SameSite: SameSiteNone}, ErrInvalidAttribute},
+		{Cookie{Name: "a", Partitioned: true}, ErrInvalidAttribute},
+		{Cookie{Name: "__Secure-a"}, ErrInvalidAttribute},
+		{Cookie{Name: "__Secure-a", Secure: true}, nil},
+		{Cookie{Name: "__Host-a", Secure: true}, ErrInvalidAttribute},
+		{Cookie{Name: "__Host-a", Secure: true, Path: "/", Domain: "example.com"}, ErrInvalidAttribute},
+		{Cookie{Name: "__Host-a", Secure: true, Path: "/"}, nil},
+	}
+	for _, tc := range cases {
+		err := tc.cookie.Validate()
+		if tc.err == nil {
+			assert.NoError(t, err, tc.cookie.String())
+		} else {
+			assert.ErrorIs(t, err, tc.err, tc.cookie.String())
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	// Test: Each cookie gets its own Set-Cookie line
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	require.NoError(t, Set(w.Header(), &Cookie{Name: "from", Value: "middleware"}))
+	h := headers.NewHeaders()
+	require.NoError(t, Set(h, &Cookie{Name: "a", Value: "1", HttpOnly: true}))
+	require.NoError(t, Set(h, &Cookie{Name: "b", Value: "2"}))
+	require.NoError(t, w.WriteResponse(response.StatusOK, h, nil))
+	assert.Equal(t, 3, strings.Count(out.String(), "set-cookie: "))
+	assert.Contains(t, out.String(), "set-cookie: from=middleware\r\n")
+	assert.Contains(t, out.String(), "set-cookie: a=1; HttpOnly\r\n")
+	assert.Contains(t, out.String(), "set-cookie: b=2\r\n")
+
+	// Test: Invalid cookies aren't added
+	require.ErrorIs(t, Set(h, &Cookie{Name: "bad name"}), ErrInvalidName)
+	assert.Len(t, h.Lines("Set-Cookie"), 2)
+}
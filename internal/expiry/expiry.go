@@ -0,0 +1,100 @@
+// Package expiry keeps keys ordered by when they expire, so in-memory
+// stores can find their expired entries, or the ones closest to expiring,
+// without scanning them all
+package expiry
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Queue orders keys by expiry time. Adding, moving and removing a key take
+// logarithmic time. The zero value is an empty queue. It isn't safe for
+// concurrent use; stores guard it with their own lock.
+type Queue[K comparable] struct {
+	h expiryHeap[K]
+}
+
+type item[K comparable] struct {
+	key     K
+	expires time.Time
+}
+
+// Set adds key to the queue, or moves it if it is already there
+func (q *Queue[K]) Set(key K, expires time.Time) {
+	if i, ok := q.h.index[key]; ok {
+		q.h.items[i].expires = expires
+		heap.Fix(&q.h, i)
+		return
+	}
+	if q.h.index == nil {
+		q.h.index = make(map[K]int)
+	}
+	heap.Push(&q.h, item[K]{key: key, expires: expires})
+}
+
+// Remove takes key out of the queue if it is there
+func (q *Queue[K]) Remove(key K) {
+	if i, ok := q.h.index[key]; ok {
+		heap.Remove(&q.h, i)
+	}
+}
+
+// Len returns how many keys the queue holds
+func (q *Queue[K]) Len() int {
+	return len(q.h.items)
+}
+
+// Peek returns the key that expires first, without removing it
+func (q *Queue[K]) Peek() (key K, expires time.Time, ok bool) {
+	if len(q.h.items) == 0 {
+		return key, expires, false
+	}
+	return q.h.items[0].key, q.h.items[0].expires, true
+}
+
+// Pop removes and returns the key that expires first
+func (q *Queue[K]) Pop() (key K, ok bool) {
+	if len(q.h.items) == 0 {
+		return key, false
+	}
+	return heap.Pop(&q.h).(item[K]).key, true
+}
+
+// PopExpired removes and returns the first key if it expired by now, that
+// is if its expiry isn't after now
+func (q *Queue[K]) PopExpired(now time.Time) (key K, ok bool) {
+	if _, expires, ok := q.Peek(); !ok || expires.After(now) {
+		return key, false
+	}
+	return q.Pop()
+}
+
+// expiryHeap implements heap.Interface, keeping index up to date so keys
+// can be found to be moved or removed
+type expiryHeap[K comparable] struct {
+	items []item[K]
+	index map[K]int
+}
+
+func (h *expiryHeap[K]) Len() int           { return len(h.items) }
+func (h *expiryHeap[K]) Less(i, j int) bool { return h.items[i].expires.Before(h.items[j].expires) }
+
+func (h *expiryHeap[K]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].key] = i
+	h.index[h.items[j].key] = j
+}
+
+func (h *expiryHeap[K]) Push(x any) {
+	it := x.(item[K])
+	h.index[it.key] = len(h.items)
+	h.items = append(h.items, it)
+}
+
+func (h *expiryHeap[K]) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, last.key)
+	return last
+}
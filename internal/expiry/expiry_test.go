@@ -0,0 +1,46 @@
+package expiry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	now := time.Now()
+	var q Queue[string]
+
+	// Test: Keys come out in order of expiry
+	q.Set("b", now.Add(2*time.Minute))
+	q.Set("a", now.Add(time.Minute))
+	q.Set("c", now.Add(3*time.Minute))
+	key, expires, ok := q.Peek()
+	assert.True(t, ok)
+	assert.Equal(t, "a", key)
+	assert.Equal(t, now.Add(time.Minute), expires)
+
+	// Test: Setting a key again moves it
+	q.Set("a", now.Add(4*time.Minute))
+	assert.Equal(t, 3, q.Len())
+	key, _ = q.Pop()
+	assert.Equal(t, "b", key)
+
+	// Test: Removed keys are gone, and removing a missing key does nothing
+	q.Remove("c")
+	q.Remove("missing")
+	key, _ = q.Pop()
+	assert.Equal(t, "a", key)
+	_, ok = q.Pop()
+	assert.False(t, ok)
+
+	// Test: PopExpired only returns keys whose time has come
+	q.Set("old", now.Add(-time.Second))
+	q.Set("new", now.Add(time.Hour))
+	key, ok = q.PopExpired(now)
+	assert.True(t, ok)
+	assert.Equal(t, "old", key)
+	_, ok = q.PopExpired(now)
+	assert.False(t, ok)
+	assert.Equal(t, 1, q.Len())
+}
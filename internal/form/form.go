@@ -0,0 +1,245 @@
+// Package form decodes HTML form submissions sent as
+// application/x-www-form-urlencoded or multipart/form-data (RFC 7578),
+// within limits that keep clients from exhausting memory or disk.
+package form
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Defaults for the Limits left at zero
+const (
+	DefaultMaxParts     = 1000
+	DefaultMaxFieldSize = 1 << 20
+	DefaultMaxTotalSize = 32 << 20
+	DefaultMaxMemory    = 10 << 20
+)
+
+var (
+	// ErrUnsupportedType is returned by Parse for bodies that aren't forms
+	ErrUnsupportedType = errors.New("not a form content type")
+	// ErrMalformed is wrapped by the errors for bodies that don't parse
+	ErrMalformed = errors.New("malformed form")
+	// ErrTooManyParts, ErrFieldTooLarge and ErrTooLarge are returned when a
+	// form goes over its Limits
+	ErrTooManyParts  = errors.New("too many form fields")
+	ErrFieldTooLarge = errors.New("form field too large")
+	ErrTooLarge      = errors.New("form too large")
+)
+
+// Limits bounds what a form may hold. Fields left at zero take the
+// defaults above.
+type Limits struct {
+	// MaxParts bounds how many fields and files a form may have
+	MaxParts int
+	// MaxFieldSize bounds the size of each field's value; files aren't
+	// fields and are only bounded by MaxTotalSize
+	MaxFieldSize int64
+	// MaxTotalSize bounds the size of the whole body. Parse checks it
+	// before decoding, but the server has already read the body in full by
+	// then; server.Server.MaxBodySize is what refuses large bodies, by their
+	// Content-Length, before reading them.
+	MaxTotalSize int64
+	// MaxMemory is how many bytes of uploaded files ParseMultipart keeps in
+	// memory; files beyond it are written to temporary files instead. It
+	// bounds the form's copy of the files, not the request body they came in.
+	MaxMemory int64
+	// TempDir is where temporary files go, os.TempDir() when empty
+	TempDir string
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxParts <= 0 {
+		l.MaxParts = DefaultMaxParts
+	}
+	if l.MaxFieldSize <= 0 {
+		l.MaxFieldSize = DefaultMaxFieldSize
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultMaxTotalSize
+	}
+	if l.MaxMemory <= 0 {
+		l.MaxMemory = DefaultMaxMemory
+	}
+	return l
+}
+
+// Form holds the fields and files of a submitted form, in the order sent
+type Form struct {
+	Values map[string][]string
+	Files  map[string][]*File
+}
+
+func newForm() *Form {
+	return &Form{Values: map[string][]string{}, Files: map[string][]*File{}}
+}
+
+// Value returns the first value of the field called name, or ""
+func (f *Form) Value(name string) string {
+	if values := f.Values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// File returns the first file uploaded as name, or nil
+func (f *Form) File(name string) *File {
+	if files := f.Files[name]; len(files) > 0 {
+		return files[0]
+	}
+	return nil
+}
+
+// RemoveAll deletes the temporary files holding the form's uploads
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.Files {
+		for _, file := range files {
+			if file.path != "" {
+				if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// File is an uploaded file, held in memory or, if large, in a temporary file
+type File struct {
+	// Filename is the name the client gave the file, without any directories
+	Filename string
+	// Header holds the part's headers, such as Content-Type
+	Header headers.Headers
+	Size   int64
+
+	content []byte
+	// path is the temporary file holding the content when it isn't in memory
+	path string
+}
+
+// fileReader reads a file held in memory
+type fileReader struct {
+	*bytes.Reader
+}
+
+func (fileReader) Close() error { return nil }
+
+// Open returns the file's content. It must be closed after use.
+func (f *File) Open() (io.ReadCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return fileReader{bytes.NewReader(f.content)}, nil
+}
+
+// Parse decodes the form in req's body according to its Content-Type.
+// Bodies over limits.MaxTotalSize fail with ErrTooLarge before being decoded.
+func Parse(req *request.Request, limits Limits) (*Form, error) {
+	if int64(len(req.Body)) > limits.withDefaults().MaxTotalSize {
+		return nil, ErrTooLarge
+	}
+	m, err := req.Headers.MediaType("Content-Type")
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	switch m.Type + "/" + m.Subtype {
+	case "application/x-www-form-urlencoded":
+		return ParseURLEncoded(req.Body, limits)
+	case "multipart/form-data":
+		boundary, ok := m.Params["boundary"]
+		if !ok {
+			return nil, fmt.Errorf("%w: no boundary in Content-Type", ErrMalformed)
+		}
+		return ParseMultipart(bytes.NewReader(req.Body), boundary, limits)
+	}
+	return nil, ErrUnsupportedType
+}
+
+// ParseURLEncoded decodes an application/x-www-form-urlencoded body of
+// name=value pairs joined by &
+func ParseURLEncoded(body []byte, limits Limits) (*Form, error) {
+	limits = limits.withDefaults()
+	if int64(len(body)) > limits.MaxTotalSize {
+		return nil, ErrTooLarge
+	}
+	f := newForm()
+	parts := 0
+	for _, pair := range strings.Split(string(body), "&") {
+		if pair == "" {
+			continue
+		}
+		if parts++; parts > limits.MaxParts {
+			return nil, ErrTooManyParts
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		if int64(len(value)) > limits.MaxFieldSize {
+			return nil, fmt.Errorf("%w: %q", ErrFieldTooLarge, name)
+		}
+		f.Values[name] = append(f.Values[name], value)
+	}
+	return f, nil
+}
+
+// formKey is the context key the parsed form is stored under
+type formKey struct{}
+
+// FromRequest returns the form Middleware parsed from req, or nil if the
+// request didn't carry one
+func FromRequest(req *request.Request) *Form {
+	f, _ := req.Value(formKey{}).(*Form)
+	return f
+}
+
+// Middleware returns middleware that parses the form in the body of
+// requests sent as application/x-www-form-urlencoded or
+// multipart/form-data, for handlers to get with FromRequest. Forms that
+// don't parse are answered with 400 Bad Request, or 413 Content Too Large
+// when over the limits. Temporary files are removed once the handler returns.
+func Middleware(limits Limits) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			f, err := Parse(req, limits)
+			switch {
+			case errors.Is(err, ErrUnsupportedType):
+				next(w, req)
+				return
+			case err != nil:
+				w.WriteError(StatusFor(err), nil)
+				return
+			}
+			defer f.RemoveAll()
+			next(w, req.WithValue(formKey{}, f))
+		}
+	}
+}
+
+// StatusFor returns the status to answer a request whose form failed to
+// parse with err
+func StatusFor(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, ErrUnsupportedType):
+		return response.StatusUnsupportedMediaType
+	case errors.Is(err, ErrTooLarge), errors.Is(err, ErrFieldTooLarge), errors.Is(err, ErrTooManyParts):
+		return response.StatusRequestEntityTooLarge
+	}
+	return response.StatusBadRequest
+}
@@ -0,0 +1,213 @@
+package form
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(contentType, body string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders(), Body: []byte(body)}
+	if contentType != "" {
+		req.Headers.Override("Content-Type", contentType)
+	}
+	return req
+}
+
+// multipartBody builds a multipart/form-data body from parts given as
+// their headers and content
+func multipartBody(boundary string, parts ...[2]string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString("--" + boundary + "\r\n" + part[0] + "\r\n\r\n" + part[1] + "\r\n")
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.String()
+}
+
+func readFile(t *testing.T, file *File) string {
+	t.Helper()
+	r, err := file.Open()
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestParseURLEncoded(t *testing.T) {
+	// Test: Pairs are decoded, repeated names keep every value
+	f, err := Parse(newRequest("application/x-www-form-urlencoded", "name=Ada+Lovelace&tag=a&tag=b%26c&empty=&flag&&caf%C3%A9=%E2%9C%93"), Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "Ada Lovelace", f.Value("name"))
+	assert.Equal(t, []string{"a", "b&c"}, f.Values["tag"])
+	assert.Equal(t, []string{""}, f.Values["empty"])
+	assert.Equal(t, []string{""}, f.Values["flag"])
+	assert.Equal(t, "✓", f.Value("café"))
+	assert.Empty(t, f.Value("missing"))
+
+	// Test: Bad escapes are malformed
+	_, err = ParseURLEncoded([]byte("a=%zz"), Limits{})
+	require.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Limits are enforced
+	_, err = ParseURLEncoded([]byte("a=1&b=2&c=3"), Limits{MaxParts: 2})
+	require.ErrorIs(t, err, ErrTooManyParts)
+	_, err = ParseURLEncoded([]byte("a=12345"), Limits{MaxFieldSize: 4})
+	require.ErrorIs(t, err, ErrFieldTooLarge)
+	_, err = ParseURLEncoded([]byte("a=12345"), Limits{MaxTotalSize: 4})
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	// Test: Other content types aren't forms
+	_, err = Parse(newRequest("application/json", "{}"), Limits{})
+	require.ErrorIs(t, err, ErrUnsupportedType)
+	_, err = Parse(newRequest("", "a=1"), Limits{})
+	require.ErrorIs(t, err, ErrUnsupportedType)
+}
+
+func TestParseMultipart(t *testing.T) {
+	body := "preamble to ignore\r\n" + multipartBody("XyZ",
+		[2]string{`Content-Disposition: form-data; name="title"`, "Hello\r\nworld"},
+		[2]string{`Content-Disposition: form-data; name="upload"; filename="C:\\Users\\ada\\notes.txt"` + "\r\nContent-Type: text/plain", "file --XyZ contents"},
+		[2]string{`Content-Disposition: form-data; name="title"`, ""},
+	)
+
+	// Test: Fields and files are separated, with the boundary from Content-Type
+	f, err := Parse(newRequest(`multipart/form-data; boundary="XyZ"`, body), Limits{})
+	require.NoError(t, err)
+	defer f.RemoveAll()
+	assert.Equal(t, []string{"Hello\r\nworld", ""}, f.Values["title"])
+	file := f.File("upload")
+	require.NotNil(t, file)
+	assert.Equal(t, "notes.txt", file.Filename)
+	assert.Equal(t, "text/plain", file.Header.Get("Content-Type"))
+	assert.Equal(t, int64(19), file.Size)
+	assert.Equal(t, "file --XyZ contents", readFile(t, file))
+	assert.Empty(t, file.path)
+
+	// Test: Bodies arriving a byte at a time parse the same
+	f, err = ParseMultipart(iotest.OneByteReader(strings.NewReader(body)), "XyZ", Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "file --XyZ contents", readFile(t, f.File("upload")))
+
+	// Test: An empty form is just the closing boundary
+	f, err = ParseMultipart(strings.NewReader("--XyZ--"), "XyZ", Limits{})
+	require.NoError(t, err)
+	assert.Empty(t, f.Values)
+	assert.Empty(t, f.Files)
+}
+
+func TestParseMultipartSpillsToDisk(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("0123456789", 20000)
+	body := multipartBody("b",
+		[2]string{`Content-Disposition: form-data; name="small"; filename="small.bin"`, "tiny"},
+		[2]string{`Content-Disposition: form-data; name="big"; filename="big.bin"`, big},
+	)
+
+	// Test: Files beyond the memory budget go to temporary files
+	f, err := ParseMultipart(strings.NewReader(body), "b", Limits{MaxMemory: 1024, TempDir: dir})
+	require.NoError(t, err)
+	assert.Empty(t, f.File("small").path)
+	big2 := f.File("big")
+	require.NotEmpty(t, big2.path)
+	assert.Equal(t, int64(len(big)), big2.Size)
+	assert.Equal(t, big, readFile(t, big2))
+
+	// Test: RemoveAll deletes them
+	require.NoError(t, f.RemoveAll())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Temporary files are removed when parsing fails later on
+	truncated := strings.TrimSuffix(body, "--b--\r\n")
+	_, err = ParseMultipart(strings.NewReader(truncated), "b", Limits{MaxMemory: 1024, TempDir: dir})
+	require.ErrorIs(t, err, ErrMalformed)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestParseMultipartErrors(t *testing.T) {
+	field := [2]string{`Content-Disposition: form-data; name="f"`, "value"}
+
+	cases := []struct {
+		name     string
+		body     string
+		boundary string
+		limits   Limits
+		err      error
+	}{
+		{"no closing boundary", "--b\r\n" + field[0] + "\r\n\r\nvalue", "b", Limits{}, ErrMalformed},
+		{"no boundary at all", "just text", "b", Limits{}, ErrMalformed},
+		{"bad boundary", multipartBody("b", field), "", Limits{}, ErrMalformed},
+		{"unnamed part", multipartBody("b", [2]string{"Content-Disposition: form-data", "x"}), "b", Limits{}, ErrMalformed},
+		{"no disposition", multipartBody("b", [2]string{"Content-Type: text/plain", "x"}), "b", Limits{}, ErrMalformed},
+		{"bad header", multipartBody("b", [2]string{"no colon here", "x"}), "b", Limits{}, ErrMalformed},
+		{"too many parts", multipartBody("b", field, field, field), "b", Limits{MaxParts: 2}, ErrTooManyParts},
+		{"field too large", multipartBody("b", field), "b", Limits{MaxFieldSize: 4}, ErrFieldTooLarge},
+		{"body too large", multipartBody("b", field), "b", Limits{MaxTotalSize: 20}, ErrTooLarge},
+	}
+	for _, tc := range cases {
+		_, err := ParseMultipart(strings.NewReader(tc.body), tc.boundary, tc.limits)
+		assert.ErrorIs(t, err, tc.err, tc.name)
+	}
+
+	// Test: A boundary is required in Content-Type
+	_, err := Parse(newRequest("multipart/form-data", multipartBody("b", field)), Limits{})
+	require.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Parse refuses bodies over MaxTotalSize before decoding them
+	_, err = Parse(newRequest("multipart/form-data; boundary=b", multipartBody("b", field)), Limits{MaxTotalSize: 20})
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	// Test: Headers too large for the buffer are refused
+	huge := multipartBody("b", [2]string{"X-Big: " + strings.Repeat("a", readBufferSize), "x"})
+	_, err = ParseMultipart(strings.NewReader(huge), "b", Limits{})
+	require.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestMiddleware(t *testing.T) {
+	var got *Form
+	handler := Middleware(Limits{MaxFieldSize: 8})(func(w *response.Writer, req *request.Request) {
+		got = FromRequest(req)
+		w.WriteResponse(response.StatusOK, nil, nil)
+	})
+	serve := func(req *request.Request) (response.StatusCode, string) {
+		var out bytes.Buffer
+		w := response.NewWriter(&out)
+		got = nil
+		handler(w, req)
+		return w.Status(), out.String()
+	}
+
+	// Test: Forms are parsed for the handler
+	status, _ := serve(newRequest("application/x-www-form-urlencoded", "q=go"))
+	assert.Equal(t, response.StatusOK, status)
+	require.NotNil(t, got)
+	assert.Equal(t, "go", got.Value("q"))
+
+	// Test: Other bodies pass through without a form
+	status, _ = serve(newRequest("application/json", "{}"))
+	assert.Equal(t, response.StatusOK, status)
+	assert.Nil(t, got)
+
+	// Test: Bad forms are answered without calling the handler
+	status, out := serve(newRequest("application/x-www-form-urlencoded", "q=%zz"))
+	assert.Equal(t, response.StatusBadRequest, status)
+	assert.Contains(t, out, "400 Bad Request")
+	assert.Nil(t, got)
+	status, _ = serve(newRequest("application/x-www-form-urlencoded", "q=far too long"))
+	assert.Equal(t, response.StatusRequestEntityTooLarge, status)
+	assert.Nil(t, got)
+}
@@ -0,0 +1,270 @@
+package form
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxPartHeaderSize bounds the headers of each part
+const maxPartHeaderSize = 16 << 10
+
+// readBufferSize is how much of the body is looked at at once when
+// searching for the next boundary
+const readBufferSize = 64 << 10
+
+// multipartParser reads the parts of a multipart body one by one
+type multipartParser struct {
+	r *bufio.Reader
+	// delimiter ends each part: CRLF, two dashes and the boundary
+	delimiter []byte
+	limits    Limits
+	// memory is how many more bytes of files may be kept in memory
+	memory int64
+}
+
+// ParseMultipart decodes a multipart/form-data body whose parts are
+// separated by boundary, reading it from r as it arrives. Files are kept in
+// memory up to limits.MaxMemory in all and written to temporary files after
+// that; call RemoveAll on the form once done with them.
+func ParseMultipart(r io.Reader, boundary string, limits Limits) (*Form, error) {
+	limits = limits.withDefaults()
+	if !validBoundary(boundary) {
+		return nil, fmt.Errorf("%w: invalid boundary %q", ErrMalformed, boundary)
+	}
+	// The first boundary needn't follow a line break, so one is made up to
+	// let it be found like the others
+	body := io.MultiReader(strings.NewReader("\r\n"), &limitedReader{r: r, n: limits.MaxTotalSize})
+	p := &multipartParser{
+		r:         bufio.NewReaderSize(body, readBufferSize),
+		delimiter: []byte("\r\n--" + boundary),
+		limits:    limits,
+		memory:    limits.MaxMemory,
+	}
+
+	f := newForm()
+	// Anything before the first boundary is a preamble to be ignored
+	final, err := p.readUntilDelimiter(func([]byte) error { return nil })
+	for parts := 0; err == nil && !final; parts++ {
+		if parts == limits.MaxParts {
+			err = ErrTooManyParts
+			break
+		}
+		final, err = p.readPart(f)
+	}
+	if err != nil {
+		f.RemoveAll()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readPart reads the next part into f, reporting whether it was the last
+func (p *multipartParser) readPart(f *Form) (bool, error) {
+	h, err := p.readHeaders()
+	if err != nil {
+		return false, err
+	}
+	typ, params, err := headers.ParseDisposition(h.Get("Content-Disposition"))
+	name, named := params["name"]
+	if err != nil || typ != "form-data" || !named {
+		return false, fmt.Errorf("%w: part without a form-data Content-Disposition naming it", ErrMalformed)
+	}
+
+	filename, isFile := params["filename"]
+	if !isFile {
+		var value []byte
+		final, err := p.readUntilDelimiter(func(b []byte) error {
+			if int64(len(value)+len(b)) > p.limits.MaxFieldSize {
+				return fmt.Errorf("%w: %q", ErrFieldTooLarge, name)
+			}
+			value = append(value, b...)
+			return nil
+		})
+		if err == nil {
+			f.Values[name] = append(f.Values[name], string(value))
+		}
+		return final, err
+	}
+
+	// Browsers used to send whole paths, which mustn't be trusted
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	file := &File{Filename: filename, Header: h}
+	// The file is added straight away so RemoveAll finds it should
+	// reading it fail
+	f.Files[name] = append(f.Files[name], file)
+
+	var tmp *os.File
+	final, err := p.readUntilDelimiter(func(b []byte) error {
+		file.Size += int64(len(b))
+		if tmp == nil && int64(len(file.content)+len(b)) <= p.memory {
+			file.content = append(file.content, b...)
+			return nil
+		}
+		if tmp == nil {
+			var err error
+			if tmp, err = os.CreateTemp(p.limits.TempDir, "form-*"); err != nil {
+				return err
+			}
+			file.path = tmp.Name()
+			if _, err := tmp.Write(file.content); err != nil {
+				return err
+			}
+			file.content = nil
+		}
+		_, err := tmp.Write(b)
+		return err
+	})
+	if tmp != nil {
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		p.memory -= int64(len(file.content))
+	}
+	return final, err
+}
+
+// readHeaders reads the headers that start a part
+func (p *multipartParser) readHeaders() (headers.Headers, error) {
+	var block []byte
+	for {
+		line, err := p.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("%w: part headers too large", ErrMalformed)
+		}
+		if err != nil {
+			return nil, p.fail(err)
+		}
+		block = append(block, line...)
+		if len(block) > maxPartHeaderSize {
+			return nil, fmt.Errorf("%w: part headers too large", ErrMalformed)
+		}
+		if len(line) == 2 && line[0] == '\r' {
+			break
+		}
+	}
+
+	h := headers.NewHeaders()
+	for {
+		n, done, err := h.Parse(block)
+		if err != nil || (n == 0 && !done) {
+			return nil, fmt.Errorf("%w: bad part header", ErrMalformed)
+		}
+		if done {
+			return h, nil
+		}
+		block = block[n:]
+	}
+}
+
+// readUntilDelimiter passes sink everything up to the next delimiter, in
+// pieces it must copy if it keeps them, then reads past the delimiter. It
+// reports whether that was the closing delimiter, after which no parts
+// follow.
+func (p *multipartParser) readUntilDelimiter(sink func([]byte) error) (bool, error) {
+	for {
+		buf, err := p.r.Peek(readBufferSize)
+		if i := bytes.Index(buf, p.delimiter); i >= 0 {
+			if err := sink(buf[:i]); err != nil {
+				return false, err
+			}
+			p.r.Discard(i + len(p.delimiter))
+			return p.afterDelimiter()
+		}
+		if err != nil {
+			return false, p.fail(err)
+		}
+		// The end of the buffer may hold the start of the delimiter, so it
+		// is kept back until more has been read
+		safe := len(buf) - len(p.delimiter) + 1
+		if err := sink(buf[:safe]); err != nil {
+			return false, err
+		}
+		p.r.Discard(safe)
+	}
+}
+
+// afterDelimiter reads the rest of a delimiter line: two dashes for the
+// closing one, or else optional padding and a line break
+func (p *multipartParser) afterDelimiter() (bool, error) {
+	next, err := p.r.Peek(2)
+	if err != nil {
+		return false, p.fail(err)
+	}
+	if string(next) == "--" {
+		return true, nil
+	}
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return false, p.fail(err)
+		}
+		switch c {
+		case ' ', '\t':
+			continue
+		case '\r':
+			if c, err = p.r.ReadByte(); err == nil && c == '\n' {
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("%w: bad boundary line", ErrMalformed)
+	}
+}
+
+// fail turns the body ending early into ErrMalformed
+func (p *multipartParser) fail(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: body ends before the closing boundary", ErrMalformed)
+	}
+	return err
+}
+
+// limitedReader reads from r until n bytes have been read, then fails with
+// ErrTooLarge if there is more
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// validBoundary reports whether boundary is 1 to 70 of the characters
+// RFC 2046 section 5.1.1 allows, not ending in a space
+func validBoundary(boundary string) bool {
+	if boundary == "" || len(boundary) > 70 || boundary[len(boundary)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(boundary); i++ {
+		c := boundary[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte(`'()+_,-./:=? `, c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -28,6 +28,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("malformed header line: %s", data[:idx])
+	}
 	key := strings.ToLower(string(parts[0]))
 
 	if key != strings.TrimRight(key, " ") {
@@ -43,18 +46,39 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	return idx + 2, false, nil
 }
 
+// Set adds a header value, appending it to any existing value. Repeated
+// Set-Cookie values can't be comma-joined (RFC 6265 section 3), so they are
+// kept on separate lines; Lines gives them back one by one.
 func (h Headers) Set(key, value string) {
 	key = strings.ToLower(key)
 	v, ok := h[key]
 	if ok {
+		separator := ", "
+		if key == "set-cookie" {
+			separator = "\n"
+		}
 		value = strings.Join([]string{
 			v,
 			value,
-		}, ", ")
+		}, separator)
 	}
 	h[key] = value
 }
 
+// Lines returns the values to send as separate field lines for the header
+// called key: each Set-Cookie on its own, any other header as one value
+func (h Headers) Lines(key string) []string {
+	key = strings.ToLower(key)
+	value, ok := h[key]
+	if !ok {
+		return nil
+	}
+	if key == "set-cookie" {
+		return strings.Split(value, "\n")
+	}
+	return []string{value}
+}
+
 // Get returns the value for the given key, case-insensitive
 func (h Headers) Get(key string) string {
 	return h[strings.ToLower(key)]
@@ -65,6 +89,28 @@ func (h Headers) Override(key, value string) {
 	h[strings.ToLower(key)] = value
 }
 
+// Delete removes the header with the given key, case-insensitive
+func (h Headers) Delete(key string) {
+	delete(h, strings.ToLower(key))
+}
+
+// ValidToken reports whether s is a token (RFC 9110 section 5.6.2), the
+// syntax of header names and many header values
+func ValidToken(s string) bool {
+	return s != "" && validTokens([]byte(s))
+}
+
+// HasToken reports whether the comma-separated header value lists token,
+// ignoring case, as in Connection: keep-alive, Upgrade
+func HasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
 
 // validTokens checks if the data contains only valid tokens
@@ -74,7 +120,7 @@ func validTokens(data []byte) bool {
 		if (c < 'A' || c > 'Z') &&
 			(c < 'a' || c > 'z') &&
 			(c < '0' || c > '9') &&
-			c != '-' {
+			bytes.IndexByte(tokenChars, c) < 0 {
 			return false
 		}
 	}
@@ -1,7 +1,9 @@
 package headers
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -64,4 +66,164 @@ func TestHeadersParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Missing colon
+	headers = NewHeaders()
+	data = []byte("Host localhost\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHasToken(t *testing.T) {
+	// Test: Tokens are found in any case, but not inside other elements
+	assert.True(t, HasToken("keep-alive, Upgrade", "upgrade"))
+	assert.False(t, HasToken("keep-alive, upgrades", "upgrade"))
+	assert.False(t, HasToken("", "close"))
+}
+
+func TestHeadersSetCookie(t *testing.T) {
+	// Test: Repeated Set-Cookie lines aren't comma-joined, since their
+	// Expires dates hold commas
+	h := NewHeaders()
+	data := []byte("Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nSet-Cookie: b=2\r\nVary: Accept\r\nVary: Origin\r\n\r\n")
+	for {
+		n, done, err := h.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, h.Lines("Set-Cookie"))
+
+	// Test: Other headers are combined into one line
+	assert.Equal(t, []string{"Accept, Origin"}, h.Lines("Vary"))
+	assert.Nil(t, h.Lines("Missing"))
+
+	// Test: ValidToken rejects empty strings and separators
+	assert.True(t, ValidToken("session_id"))
+	assert.False(t, ValidToken(""))
+	assert.False(t, ValidToken("a=b"))
+}
+
+func TestHeadersTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: IMF-fixdate and the obsolete forms all parse
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		got, err := ParseTime(value)
+		require.NoError(t, err, value)
+		assert.True(t, want.Equal(got), value)
+	}
+
+	// Test: Times are formatted as IMF-fixdate in GMT
+	headers := NewHeaders()
+	headers.SetTime("Last-Modified", want.In(time.FixedZone("CET", 3600)))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", headers.Get("last-modified"))
+	got, err := headers.Time("Last-Modified")
+	require.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	// Test: Missing and invalid dates are told apart
+	_, err = headers.Time("Date")
+	assert.ErrorIs(t, err, ErrMissing)
+	_, err = ParseTime("yesterday")
+	assert.ErrorIs(t, err, ErrInvalidDate)
+}
+
+func TestHeadersInt(t *testing.T) {
+	// Test: Non-negative integers up to the int64 limit parse
+	n, err := ParseNonNegativeInt("9223372036854775807")
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), n)
+
+	// Test: Signs, spaces, other characters and overflow are rejected
+	for _, value := range []string{"", "-1", "+1", " 1", "1e3", "0x10", "9223372036854775808", "99999999999999999999"} {
+		_, err := ParseNonNegativeInt(value)
+		assert.ErrorIs(t, err, ErrInvalidNumber, value)
+	}
+
+	// Test: Repeated Content-Length values must agree
+	headers := NewHeaders()
+	headers.Set("Content-Length", "5")
+	headers.Set("Content-Length", "5")
+	n, err = headers.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	headers.Set("Content-Length", "6")
+	_, err = headers.ContentLength()
+	assert.ErrorIs(t, err, ErrInvalidNumber)
+	_, err = NewHeaders().ContentLength()
+	assert.ErrorIs(t, err, ErrMissing)
+
+	headers.Override("Max-Forwards", " 10 ")
+	n, err = headers.Int("max-forwards")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+}
+
+func TestSplitList(t *testing.T) {
+	// Test: Elements are trimmed and empty ones dropped
+	assert.Equal(t, []string{"gzip", "br"}, SplitList(" gzip ,, br ,"))
+	assert.Empty(t, SplitList(""))
+
+	// Test: Commas inside quoted strings, even after escaped quotes, don't split
+	assert.Equal(t, []string{`a`, `"b, c"`, `d="x\", y"`, `e`}, SplitList(`a, "b, c", d="x\", y", e`))
+
+	headers := NewHeaders()
+	headers.Set("Accept", "text/html")
+	headers.Set("Accept", "application/json;q=0.9")
+	assert.Equal(t, []string{"text/html", "application/json;q=0.9"}, headers.List("Accept"))
+}
+
+func TestMediaType(t *testing.T) {
+	// Test: Type, subtype and parameter names are lowercased, quoted values unquoted
+	m, err := ParseMediaType(`Multipart/Form-Data; Boundary="a b;c"; charset=UTF-8`)
+	require.NoError(t, err)
+	assert.Equal(t, "multipart", m.Type)
+	assert.Equal(t, "form-data", m.Subtype)
+	assert.Equal(t, map[string]string{"boundary": "a b;c", "charset": "UTF-8"}, m.Params)
+
+	// Test: Formatting quotes values that aren't tokens
+	assert.Equal(t, `multipart/form-data; boundary="a b;c"; charset=UTF-8`, m.String())
+	m, err = ParseMediaType("application/vnd.api+json")
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.api+json", m.String())
+
+	headers := NewHeaders()
+	headers.Override("Content-Type", `text/plain;charset="utf\"8"`)
+	m, err = headers.MediaType("Content-Type")
+	require.NoError(t, err)
+	assert.Equal(t, `utf"8`, m.Params["charset"])
+
+	// Test: Malformed media types are rejected
+	for _, value := range []string{"", "text", "text/", "/plain", "text/plain; charset", `text/plain; charset="open`, "text/plain; a=b c", "te xt/plain"} {
+		_, err := ParseMediaType(value)
+		assert.ErrorIs(t, err, ErrInvalidMediaType, value)
+	}
+}
+
+func TestDisposition(t *testing.T) {
+	// Test: Types are lowercased and quoted parameters unquoted
+	typ, params, err := ParseDisposition(`Form-Data; name="upload"; filename="a; b.txt"`)
+	require.NoError(t, err)
+	assert.Equal(t, "form-data", typ)
+	assert.Equal(t, map[string]string{"name": "upload", "filename": "a; b.txt"}, params)
+
+	typ, params, err = ParseDisposition("attachment")
+	require.NoError(t, err)
+	assert.Equal(t, "attachment", typ)
+	assert.Empty(t, params)
+
+	// Test: Malformed dispositions are rejected
+	for _, value := range []string{"", "form data", `form-data; name="open`, "form-data; name"} {
+		_, _, err := ParseDisposition(value)
+		assert.ErrorIs(t, err, ErrInvalidDisposition, value)
+	}
 }
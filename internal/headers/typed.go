@@ -0,0 +1,284 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate layout of HTTP dates (RFC 9110 section 5.6.7)
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Obsolete date layouts that recipients must still accept
+const (
+	rfc850Format  = "Monday, 02-Jan-06 15:04:05 GMT"
+	asctimeFormat = "Mon Jan _2 15:04:05 2006"
+)
+
+var (
+	// ErrMissing is returned by the typed accessors for absent headers
+	ErrMissing = errors.New("header not present")
+	// ErrInvalidDate, ErrInvalidNumber and ErrInvalidMediaType are wrapped
+	// by the errors for values that don't parse
+	ErrInvalidDate      = errors.New("invalid HTTP date")
+	ErrInvalidNumber    = errors.New("invalid non-negative integer")
+	ErrInvalidMediaType = errors.New("invalid media type")
+	// ErrInvalidDisposition is wrapped by ParseDisposition's errors
+	ErrInvalidDisposition = errors.New("invalid content disposition")
+)
+
+// FormatTime formats t as an IMF-fixdate in GMT
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseTime parses an HTTP date in IMF-fixdate or one of the obsolete RFC 850
+// and asctime forms. All of them are in GMT.
+func ParseTime(value string) (time.Time, error) {
+	for _, layout := range []string{TimeFormat, rfc850Format, asctimeFormat} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidDate, value)
+}
+
+// Time returns the date in the header called key, such as Date or
+// If-Modified-Since
+func (h Headers) Time(key string) (time.Time, error) {
+	value, ok := h[strings.ToLower(key)]
+	if !ok {
+		return time.Time{}, ErrMissing
+	}
+	return ParseTime(strings.TrimSpace(value))
+}
+
+// SetTime sets the header called key to t as an IMF-fixdate
+func (h Headers) SetTime(key string, t time.Time) {
+	h.Override(key, FormatTime(t))
+}
+
+// ParseNonNegativeInt parses a string of ASCII digits, without sign or
+// spaces, rejecting values beyond what an int64 holds
+func ParseNonNegativeInt(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("%w: empty", ErrInvalidNumber)
+	}
+	var n int64
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidNumber, value)
+		}
+		digit := int64(c - '0')
+		if n > (math.MaxInt64-digit)/10 {
+			return 0, fmt.Errorf("%w: %q overflows", ErrInvalidNumber, value)
+		}
+		n = n*10 + digit
+	}
+	return n, nil
+}
+
+// Int returns the non-negative integer in the header called key, such as
+// Max-Forwards or Age
+func (h Headers) Int(key string) (int64, error) {
+	value, ok := h[strings.ToLower(key)]
+	if !ok {
+		return 0, ErrMissing
+	}
+	return ParseNonNegativeInt(strings.TrimSpace(value))
+}
+
+// ContentLength returns the Content-Length. A header sent more than once is
+// accepted if every value is the same, as RFC 9110 section 8.6 allows.
+func (h Headers) ContentLength() (int64, error) {
+	if _, ok := h["content-length"]; !ok {
+		return 0, ErrMissing
+	}
+	values := h.List("Content-Length")
+	if len(values) == 0 {
+		return 0, fmt.Errorf("%w: empty", ErrInvalidNumber)
+	}
+	for _, value := range values[1:] {
+		if value != values[0] {
+			return 0, fmt.Errorf("%w: conflicting values %q", ErrInvalidNumber, h.Get("Content-Length"))
+		}
+	}
+	return ParseNonNegativeInt(values[0])
+}
+
+// SplitList splits a comma-separated header value into its elements,
+// trimming spaces around them and dropping empty ones. Commas inside quoted
+// strings don't split, so `a, "b, c"` gives `a` and `"b, c"`.
+func SplitList(value string) []string {
+	var elements []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuotes && c == '\\':
+			i++ // the escaped character can't end the quoted string
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ',' && !inQuotes:
+			elements = appendElement(elements, value[start:i])
+			start = i + 1
+		}
+	}
+	return appendElement(elements, value[start:])
+}
+
+func appendElement(elements []string, element string) []string {
+	if element = strings.Trim(element, " \t"); element != "" {
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// List returns the elements of the comma-separated header called key
+func (h Headers) List(key string) []string {
+	return SplitList(h.Get(key))
+}
+
+// MediaType is a parsed media type such as text/html; charset=utf-8. Type,
+// Subtype and parameter names are lowercase.
+type MediaType struct {
+	Type    string
+	Subtype string
+	Params  map[string]string
+}
+
+// ParseMediaType parses a media type with its parameters, whose values may
+// be tokens or quoted strings
+func ParseMediaType(value string) (MediaType, error) {
+	invalid := func() (MediaType, error) {
+		return MediaType{}, fmt.Errorf("%w: %q", ErrInvalidMediaType, value)
+	}
+
+	essence, rest, _ := strings.Cut(value, ";")
+	typ, subtype, ok := strings.Cut(strings.TrimSpace(essence), "/")
+	if !ok || !validTokens([]byte(typ)) || !validTokens([]byte(subtype)) || typ == "" || subtype == "" {
+		return invalid()
+	}
+	params, ok := parseParams(rest)
+	if !ok {
+		return invalid()
+	}
+	return MediaType{Type: strings.ToLower(typ), Subtype: strings.ToLower(subtype), Params: params}, nil
+}
+
+// ParseDisposition parses a Content-Disposition value such as
+// form-data; name="file"; filename="a.txt" into its lowercase type and its
+// parameters
+func ParseDisposition(value string) (string, map[string]string, error) {
+	typ, rest, _ := strings.Cut(value, ";")
+	typ = strings.TrimSpace(typ)
+	params, ok := parseParams(rest)
+	if !ValidToken(typ) || !ok {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidDisposition, value)
+	}
+	return strings.ToLower(typ), params, nil
+}
+
+// parseParams parses the ;-separated name=value parameters that follow a
+// media type or disposition type, whose values may be tokens or quoted
+// strings. Names are lowercased.
+func parseParams(rest string) (map[string]string, bool) {
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return params, true
+		}
+		name, after, ok := strings.Cut(rest, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || !validTokens([]byte(name)) {
+			return nil, false
+		}
+		var paramValue string
+		if strings.HasPrefix(after, `"`) {
+			var n int
+			paramValue, n, ok = unquote(after)
+			if !ok {
+				return nil, false
+			}
+			after = after[n:]
+		} else {
+			paramValue, after, _ = strings.Cut(after, ";")
+			after = ";" + after
+			paramValue = strings.TrimRight(paramValue, " \t")
+			if paramValue == "" || !validTokens([]byte(paramValue)) {
+				return nil, false
+			}
+		}
+		params[strings.ToLower(name)] = paramValue
+
+		// Only whitespace may sit between a value and the next semicolon
+		after = strings.TrimLeft(after, " \t")
+		if after != "" && after != ";" && !strings.HasPrefix(after, ";") {
+			return nil, false
+		}
+		rest = strings.TrimPrefix(after, ";")
+	}
+}
+
+// unquote reads the quoted string s starts with, returning its content and
+// how many bytes it took
+func unquote(s string) (string, int, bool) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, false
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, false
+}
+
+// String formats the media type, quoting parameter values that aren't
+// tokens. Parameters are sorted by name so the result is stable.
+func (m MediaType) String() string {
+	var b strings.Builder
+	b.WriteString(m.Type + "/" + m.Subtype)
+	names := make([]string, 0, len(m.Params))
+	for name := range m.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := m.Params[name]
+		b.WriteString("; " + name + "=")
+		if value != "" && validTokens([]byte(value)) {
+			b.WriteString(value)
+			continue
+		}
+		b.WriteByte('"')
+		for i := 0; i < len(value); i++ {
+			if value[i] == '"' || value[i] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(value[i])
+		}
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// MediaType returns the media type in the header called key, usually
+// Content-Type
+func (h Headers) MediaType(key string) (MediaType, error) {
+	value, ok := h[strings.ToLower(key)]
+	if !ok {
+		return MediaType{}, ErrMissing
+	}
+	return ParseMediaType(value)
+}
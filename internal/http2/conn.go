@@ -0,0 +1,807 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// goAwayTimeout is how long a client that was sent GOAWAY has to close the
+// connection once its last stream is done
+const goAwayTimeout = time.Second
+
+var (
+	// errStreamReset is returned when writing to a stream the client reset
+	errStreamReset = errors.New("http2: stream reset")
+	// errConnClosed is returned when writing to a connection that has gone away
+	errConnClosed = errors.New("http2: connection closed")
+)
+
+// streamState follows the server's side of the stream lifecycle (RFC 9113 section 5.1)
+type streamState int
+
+const (
+	// stateOpen means the client is still sending the request
+	stateOpen streamState = iota
+	// stateHalfClosedRemote means the request is complete and we're responding
+	stateHalfClosedRemote
+	stateClosed
+)
+
+// stream is a single request/response exchange on a connection
+type stream struct {
+	id uint32
+
+	// Only touched by the read loop
+	fields     []HeaderField
+	body       []byte
+	tooLarge   bool
+	recvWindow int64
+
+	// Guarded by serverConn.mu
+	state      streamState
+	reset      bool
+	dispatched bool
+	sendWindow int64
+	// cancel ends the context of the stream's request
+	cancel context.CancelFunc
+}
+
+// serverConn is the server side of one HTTP/2 connection. A single goroutine
+// reads frames; each request runs its handler and writes its response from
+// goroutines of its own.
+type serverConn struct {
+	server     *Server
+	conn       net.Conn
+	reader     io.Reader
+	handler    Handler
+	remoteAddr string
+	tlsState   *tls.ConnectionState
+
+	maxConcurrentStreams uint32
+	maxHeaderListSize    uint32
+	maxRequestBodySize   int64
+
+	// ctx is the parent of every stream's context, canceled when the
+	// connection closes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Only touched by the read loop
+	decoder    *Decoder
+	recvWindow int64
+	// lastStreamID is only written by the read loop, under mu
+	lastStreamID uint32
+
+	// writeMu keeps frames, and the frames of one header block, from interleaving
+	writeMu sync.Mutex
+
+	mu                sync.Mutex
+	cond              *sync.Cond // signalled when send windows grow or streams end
+	streams           map[uint32]*stream
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	closed            bool
+	// goingAway is set once GOAWAY was sent for Shutdown; no new streams
+	// are accepted after it
+	goingAway bool
+}
+
+func newServerConn(ctx context.Context, s *Server, conn net.Conn, prefix []byte, handler Handler) *serverConn {
+	sc := &serverConn{
+		server:               s,
+		conn:                 conn,
+		reader:               bufio.NewReader(&prefixReader{prefix: bytes.NewReader(prefix), conn: conn}),
+		handler:              handler,
+		remoteAddr:           conn.RemoteAddr().String(),
+		maxConcurrentStreams: s.MaxConcurrentStreams,
+		maxHeaderListSize:    s.MaxHeaderListSize,
+		maxRequestBodySize:   s.MaxRequestBodySize,
+		decoder:              NewDecoder(DefaultHeaderTableSize),
+		recvWindow:           initialWindowSize,
+		streams:              make(map[uint32]*stream),
+		sendWindow:           initialWindowSize,
+		peerInitialWindow:    initialWindowSize,
+		peerMaxFrameSize:     minMaxFrameSize,
+	}
+	if sc.maxConcurrentStreams == 0 {
+		sc.maxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if sc.maxHeaderListSize == 0 {
+		sc.maxHeaderListSize = DefaultMaxHeaderListSize
+	}
+	if sc.maxRequestBodySize <= 0 {
+		sc.maxRequestBodySize = DefaultMaxRequestBodySize
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		sc.tlsState = &state
+	}
+	sc.decoder.MaxListSize = sc.maxHeaderListSize
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.ctx, sc.cancel = context.WithCancel(ctx)
+	return sc
+}
+
+// serve runs the connection until the client leaves or breaks the protocol.
+// upgraded, if set, is the HTTP/1.1 request that becomes stream 1.
+func (sc *serverConn) serve(upgraded *request.Request) {
+	defer sc.close()
+	// The connection ends with the server
+	stop := context.AfterFunc(sc.ctx, sc.close)
+	defer stop()
+	if !sc.server.track(sc) {
+		return
+	}
+	defer sc.server.untrack(sc)
+
+	// Our SETTINGS must be the first frame we send (RFC 9113 section 3.4)
+	settings := AppendSettings(nil,
+		Setting{ID: SettingMaxConcurrentStreams, Value: sc.maxConcurrentStreams},
+		Setting{ID: SettingMaxHeaderListSize, Value: sc.maxHeaderListSize},
+	)
+	if err := sc.writeFrame(&Frame{Type: FrameSettings, Payload: settings}); err != nil {
+		return
+	}
+
+	if upgraded != nil {
+		st := sc.openStream(1)
+		st.state = stateHalfClosedRemote
+		st.dispatched = true
+		sc.mu.Lock()
+		sc.lastStreamID = 1
+		sc.mu.Unlock()
+		go sc.runHandler(st, upgraded.WithContext(sc.streamContext(st)))
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.reader, preface); err != nil || string(preface) != ClientPreface {
+		return
+	}
+
+	err := sc.readLoop()
+	var connErr ConnectionError
+	if errors.As(err, &connErr) {
+		sc.goAway(connErr.Code)
+	}
+}
+
+// readLoop reads and processes frames until an error ends the connection
+func (sc *serverConn) readLoop() error {
+	first := true
+	for {
+		f, err := ReadFrame(sc.reader, minMaxFrameSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// The client preface continues with a SETTINGS frame
+		if first && (f.Type != FrameSettings || f.Has(FlagAck)) {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "expected SETTINGS after the preface"}
+		}
+		first = false
+
+		if err := sc.processFrame(f); err != nil {
+			var streamErr StreamError
+			if errors.As(err, &streamErr) {
+				sc.resetStream(streamErr.StreamID, streamErr.Code)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) processFrame(f *Frame) error {
+	switch f.Type {
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePing:
+		return sc.processPing(f)
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameData:
+		return sc.processData(f)
+	case FrameRSTStream:
+		return sc.processReset(f)
+	case FramePriority:
+		// Priority signals are deprecated (RFC 9113 section 5.3.2); only check the framing
+		if f.StreamID == 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeFrameSize, Reason: "PRIORITY must be 5 bytes"}
+		}
+		return nil
+	case FramePushPromise:
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "clients can't push"}
+	case FrameContinuation:
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "CONTINUATION without HEADERS"}
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "GOAWAY on a stream"}
+		}
+		// The client won't open new streams; it closes the connection when it's done
+		return nil
+	default:
+		// Unknown frame types are ignored (RFC 9113 section 4.1)
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(f *Frame) error {
+	if f.StreamID != 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "SETTINGS on a stream"}
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnectionError{Code: ErrCodeFrameSize, Reason: "SETTINGS ack with a payload"}
+		}
+		return nil
+	}
+	settings, err := ParseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+// applySettings records the client's settings. We never add to the client's
+// HPACK table, so SETTINGS_HEADER_TABLE_SIZE needs no action.
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			// The change applies to every open stream (RFC 9113 section 6.9.2)
+			delta := int64(s.Value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnectionError{Code: ErrCodeFlowControl, Reason: "window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Value)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(f *Frame) error {
+	if f.StreamID != 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "PING on a stream"}
+	}
+	if len(f.Payload) != 8 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "PING must be 8 bytes"}
+	}
+	if f.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(&Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+}
+
+func (sc *serverConn) processWindowUpdate(f *Frame) error {
+	if len(f.Payload) != 4 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "WINDOW_UPDATE must be 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & 0x7fffffff)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "zero window increment"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return ConnectionError{Code: ErrCodeFlowControl, Reason: "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if sc.isIdle(f.StreamID) {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE on an idle stream"}
+		}
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeProtocol, Reason: "zero window increment"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeFlowControl, Reason: "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *Frame) error {
+	if f.StreamID == 0 || f.StreamID%2 == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("invalid stream id %d", f.StreamID)}
+	}
+	block, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(block) < 5 {
+			return ConnectionError{Code: ErrCodeFrameSize, Reason: "HEADERS too short for priority"}
+		}
+		block = block[5:]
+	}
+	block, err = sc.readHeaderBlock(f, block)
+	if err != nil {
+		return err
+	}
+	// The block has to be decoded even if we refuse the stream, to keep the
+	// HPACK table in step with the client's
+	fields, err := sc.decoder.Decode(block)
+	tooLarge := errors.Is(err, ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		return ConnectionError{Code: ErrCodeCompression, Reason: err.Error()}
+	}
+	endStream := f.Has(FlagEndStream)
+
+	// The handler may be closing the stream, so its state is read under the lock
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	open := st != nil && st.state == stateOpen
+	sc.mu.Unlock()
+	if st != nil {
+		// A second HEADERS carries trailers and has to end the request
+		if tooLarge {
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeProtocol, Reason: "trailers too large"}
+		}
+		if !open {
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeStreamClosed, Reason: "HEADERS after the request ended"}
+		}
+		if !endStream {
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeProtocol, Reason: "trailers must end the stream"}
+		}
+		// request.Request has nowhere else to keep trailers, so they join the headers
+		st.fields = append(st.fields, fields...)
+		return sc.endRequest(st)
+	}
+
+	if f.StreamID <= sc.lastStreamID {
+		return ConnectionError{Code: ErrCodeStreamClosed, Reason: fmt.Sprintf("HEADERS on closed stream %d", f.StreamID)}
+	}
+
+	sc.mu.Lock()
+	goingAway := sc.goingAway
+	if !goingAway {
+		sc.lastStreamID = f.StreamID
+	}
+	active := len(sc.streams)
+	sc.mu.Unlock()
+	if goingAway {
+		// Streams after the GOAWAY aren't processed and the client may retry them elsewhere
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeRefusedStream, Reason: "connection is going away"}
+	}
+	if uint32(active) >= sc.maxConcurrentStreams {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeRefusedStream, Reason: "too many concurrent streams"}
+	}
+
+	st = sc.openStream(f.StreamID)
+	st.fields = fields
+	if tooLarge {
+		sc.respondWithError(st, response.StatusRequestHeaderFieldsTooLarge)
+	}
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+// readHeaderBlock collects the CONTINUATION frames that complete a header
+// block. Nothing else may arrive in between (RFC 9113 section 6.10).
+func (sc *serverConn) readHeaderBlock(f *Frame, block []byte) ([]byte, error) {
+	if f.Has(FlagEndHeaders) {
+		return block, nil
+	}
+	buf := append([]byte(nil), block...)
+	for {
+		next, err := ReadFrame(sc.reader, minMaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+		if next.Type != FrameContinuation || next.StreamID != f.StreamID {
+			return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "expected CONTINUATION"}
+		}
+		buf = append(buf, next.Payload...)
+		// Compressed headers can't be larger than the decoded limit
+		if len(buf) > int(sc.maxHeaderListSize) {
+			return nil, ConnectionError{Code: ErrCodeEnhanceYourCalm, Reason: "header block too large"}
+		}
+		if next.Has(FlagEndHeaders) {
+			return buf, nil
+		}
+	}
+}
+
+func (sc *serverConn) processData(f *Frame) error {
+	if f.StreamID == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "DATA on stream 0"}
+	}
+	// Flow control counts the whole payload, padding included
+	length := int64(len(f.Payload))
+	sc.recvWindow -= length
+	if sc.recvWindow < 0 {
+		return ConnectionError{Code: ErrCodeFlowControl, Reason: "connection window exceeded"}
+	}
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	// Hand the connection window straight back; MaxRequestBodySize bounds
+	// what we buffer, not flow control
+	if length > 0 {
+		sc.recvWindow += length
+		if err := sc.writeWindowUpdate(0, length); err != nil {
+			return err
+		}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.StreamID]
+	open := st != nil && st.state == stateOpen
+	sc.mu.Unlock()
+	if st == nil && sc.isIdle(f.StreamID) {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "DATA on an idle stream"}
+	}
+	if !open {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeStreamClosed, Reason: "DATA after the request ended"}
+	}
+	st.recvWindow -= length
+	if st.recvWindow < 0 {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeFlowControl, Reason: "stream window exceeded"}
+	}
+
+	if !st.tooLarge {
+		if int64(len(st.body)+len(data)) > sc.maxRequestBodySize {
+			// Answer now rather than buffering the rest; the remaining DATA is discarded
+			st.tooLarge = true
+			st.body = nil
+			sc.respondWithError(st, response.StatusRequestEntityTooLarge)
+		} else {
+			st.body = append(st.body, data...)
+		}
+	}
+	if f.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	if length > 0 {
+		st.recvWindow += length
+		return sc.writeWindowUpdate(f.StreamID, length)
+	}
+	return nil
+}
+
+func (sc *serverConn) processReset(f *Frame) error {
+	if f.StreamID == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "RST_STREAM on stream 0"}
+	}
+	if len(f.Payload) != 4 {
+		return ConnectionError{Code: ErrCodeFrameSize, Reason: "RST_STREAM must be 4 bytes"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.isIdle(f.StreamID) {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "RST_STREAM on an idle stream"}
+	}
+	if st := sc.streams[f.StreamID]; st != nil {
+		sc.closeStreamLocked(st, true)
+	}
+	return nil
+}
+
+// isIdle reports whether the client hasn't opened a stream yet
+func (sc *serverConn) isIdle(id uint32) bool {
+	return id%2 == 0 || id > sc.lastStreamID
+}
+
+// openStream registers a new stream with the initial windows
+func (sc *serverConn) openStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := &stream{
+		id:         id,
+		state:      stateOpen,
+		recvWindow: initialWindowSize,
+		sendWindow: sc.peerInitialWindow,
+	}
+	sc.streams[id] = st
+	return st
+}
+
+// endRequest marks the request complete and starts its handler
+func (sc *serverConn) endRequest(st *stream) error {
+	sc.mu.Lock()
+	if st.state == stateOpen {
+		st.state = stateHalfClosedRemote
+	}
+	dispatched := st.dispatched
+	st.dispatched = true
+	sc.mu.Unlock()
+	if dispatched {
+		return nil
+	}
+
+	req, err := buildRequest(st.fields, st.body, sc.remoteAddr)
+	if err != nil {
+		// Malformed requests are stream errors (RFC 9113 section 8.1.1)
+		return StreamError{StreamID: st.id, Code: ErrCodeProtocol, Reason: err.Error()}
+	}
+	req.TLS = sc.tlsState
+	go sc.runHandler(st, req.WithContext(sc.streamContext(st)))
+	return nil
+}
+
+// streamContext returns the context of a stream's request, canceled when
+// the stream closes or is reset, or the connection closes
+func (sc *serverConn) streamContext(st *stream) context.Context {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st.state == stateClosed {
+		cancel()
+	}
+	st.cancel = cancel
+	return ctx
+}
+
+// respondWithError answers a stream with an error status without waiting for
+// the rest of the request
+func (sc *serverConn) respondWithError(st *stream, statusCode response.StatusCode) {
+	sc.mu.Lock()
+	st.dispatched = true
+	sc.mu.Unlock()
+	req := &request.Request{RequestLine: request.RequestLine{Method: "GET"}}
+	go sc.respond(st, req, func(w *response.Writer, _ *request.Request) {
+		w.WriteError(statusCode, nil)
+	})
+}
+
+// runHandler runs the connection's handler for a stream and sends the response
+func (sc *serverConn) runHandler(st *stream, req *request.Request) {
+	sc.respond(st, req, sc.handler)
+}
+
+// respond runs handler and converts what it writes to HTTP/2. Handlers write
+// HTTP/1.1 through response.Writer; the response is parsed back out of a pipe
+// and re-framed as HEADERS and DATA.
+func (sc *serverConn) respond(st *stream, req *request.Request, handler Handler) {
+	pr, pw := io.Pipe()
+	go func() {
+		handler(response.NewWriter(pw), req)
+		pw.Close()
+	}()
+
+	err := sc.writeResponse(st, pr, req.RequestLine.Method)
+	// Fail the handler's remaining writes if we stopped reading early
+	pr.CloseWithError(errStreamReset)
+	if err != nil && !errors.Is(err, errStreamReset) && !errors.Is(err, errConnClosed) {
+		sc.resetStream(st.id, ErrCodeInternal)
+		return
+	}
+	sc.finishStream(st)
+}
+
+// writeResponse reads the handler's response from r and sends it on the stream
+func (sc *serverConn) writeResponse(st *stream, r io.Reader, method string) error {
+	resp, err := response.ResponseFromReader(r, method)
+	if err != nil {
+		return err
+	}
+	endStream := !response.BodyAllowed(method, resp.StatusLine.StatusCode) || resp.Headers.Get("Content-Length") == "0"
+	if err := sc.writeHeaders(st, responseFields(resp.StatusLine.StatusCode, resp.Headers), endStream); err != nil {
+		return err
+	}
+	if endStream {
+		return nil
+	}
+
+	buf := make([]byte, minMaxFrameSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if err := sc.writeData(st, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(resp.Trailers) > 0 {
+		return sc.writeHeaders(st, headerFields(resp.Trailers), true)
+	}
+	return sc.writeFrame(&Frame{Type: FrameData, Flags: FlagEndStream, StreamID: st.id})
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames if it
+// doesn't fit in one frame
+func (sc *serverConn) writeHeaders(st *stream, fields []HeaderField, endStream bool) error {
+	var block []byte
+	for _, field := range fields {
+		block = AppendHeaderField(block, field)
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.mu.Lock()
+	maxFrameSize := int(sc.peerMaxFrameSize)
+	closed, reset := sc.closed, st.reset
+	sc.mu.Unlock()
+	if closed {
+		return errConnClosed
+	}
+	if reset {
+		return errStreamReset
+	}
+
+	f := &Frame{Type: FrameHeaders, StreamID: st.id}
+	if endStream {
+		f.Flags |= FlagEndStream
+	}
+	for {
+		f.Payload = block[:min(len(block), maxFrameSize)]
+		block = block[len(f.Payload):]
+		if len(block) == 0 {
+			f.Flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(sc.conn, f); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		f = &Frame{Type: FrameContinuation, StreamID: st.id}
+	}
+}
+
+// writeData sends body bytes, waiting for the client to open its flow-control
+// windows as needed
+func (sc *serverConn) writeData(st *stream, data []byte) error {
+	for len(data) > 0 {
+		sc.mu.Lock()
+		for !sc.closed && !st.reset && (sc.sendWindow <= 0 || st.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if sc.closed {
+			sc.mu.Unlock()
+			return errConnClosed
+		}
+		if st.reset {
+			sc.mu.Unlock()
+			return errStreamReset
+		}
+		n := min(int64(len(data)), sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		if err := sc.writeFrame(&Frame{Type: FrameData, StreamID: st.id, Payload: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// finishStream forgets a stream once its response is complete
+func (sc *serverConn) finishStream(st *stream) {
+	sc.mu.Lock()
+	// We answered before the client finished sending, so tell it to stop (RFC 9113 section 8.1)
+	stillSending := st.state == stateOpen && !st.reset
+	sc.closeStreamLocked(st, false)
+	sc.mu.Unlock()
+	if stillSending {
+		sc.writeRSTStream(st.id, ErrCodeNo)
+	}
+}
+
+// resetStream ends a stream abnormally
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.closeStreamLocked(st, true)
+	}
+	sc.mu.Unlock()
+	sc.writeRSTStream(id, code)
+}
+
+// closeStreamLocked marks a stream closed. The caller must hold mu.
+func (sc *serverConn) closeStreamLocked(st *stream, reset bool) {
+	st.state = stateClosed
+	st.reset = st.reset || reset
+	if st.cancel != nil {
+		st.cancel()
+	}
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+}
+
+func (sc *serverConn) writeRSTStream(id uint32, code ErrCode) error {
+	return sc.writeFrame(&Frame{Type: FrameRSTStream, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, uint32(code))})
+}
+
+func (sc *serverConn) writeWindowUpdate(id uint32, increment int64) error {
+	return sc.writeFrame(&Frame{Type: FrameWindowUpdate, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, uint32(increment))})
+}
+
+// goAway tells the client we're closing the connection and why
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(&Frame{Type: FrameGoAway, Payload: payload})
+}
+
+// shutdown sends GOAWAY so the client opens no more streams, waits for the
+// streams already open to finish and then gives the client goAwayTimeout to
+// close the connection before it is closed for it
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	if sc.goingAway || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.mu.Unlock()
+	sc.goAway(ErrCodeNo)
+
+	sc.mu.Lock()
+	for len(sc.streams) > 0 && !sc.closed {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+	sc.conn.SetReadDeadline(time.Now().Add(goAwayTimeout))
+}
+
+func (sc *serverConn) writeFrame(f *Frame) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return WriteFrame(sc.conn, f)
+}
+
+// close shuts the connection, cancels the contexts of its requests and wakes
+// up anything waiting on flow control
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.cancel()
+	sc.conn.Close()
+}
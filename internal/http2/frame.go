@@ -0,0 +1,232 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what a client sends first on an HTTP/2 connection (RFC 9113 section 3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frameHeaderLen is the size of the fixed frame header
+const frameHeaderLen = 9
+
+// Frame size limits (RFC 9113 section 4.2)
+const (
+	minMaxFrameSize = 1 << 14
+	maxMaxFrameSize = 1<<24 - 1
+)
+
+// maxWindowSize is the largest a flow-control window may grow (RFC 9113 section 6.9.1)
+const maxWindowSize = 1<<31 - 1
+
+// FrameType identifies the kind of frame (RFC 9113 section 6)
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+// Flags are the frame header flags. Their meaning depends on the frame type.
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+// Frame is a single HTTP/2 frame
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+// Has reports whether the frame has flag set
+func (f *Frame) Has(flag Flags) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads the next frame, rejecting payloads larger than maxSize
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxSize {
+		return nil, ConnectionError{Code: ErrCodeFrameSize, Reason: fmt.Sprintf("frame of %d bytes exceeds %d", length, maxSize)}
+	}
+
+	f := &Frame{
+		Type:     FrameType(header[3]),
+		Flags:    Flags(header[4]),
+		StreamID: binary.BigEndian.Uint32(header[5:]) & 0x7fffffff,
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes a frame in a single Write call
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(f.Payload))
+	length := len(f.Payload)
+	buf[0], buf[1], buf[2] = byte(length>>16), byte(length>>8), byte(length)
+	buf[3] = byte(f.Type)
+	buf[4] = byte(f.Flags)
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&0x7fffffff)
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// unpad strips the padding from a DATA or HEADERS payload
+func unpad(f *Frame) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "missing pad length"}
+	}
+	padLength := int(f.Payload[0])
+	if padLength >= len(f.Payload) {
+		return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "padding exceeds payload"}
+	}
+	return f.Payload[1 : len(f.Payload)-padLength], nil
+}
+
+// ErrCode is an HTTP/2 error code carried by RST_STREAM and GOAWAY (RFC 9113 section 7)
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// ConnectionError ends the whole connection with a GOAWAY
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %s: %s", e.Code, e.Reason)
+}
+
+// StreamError ends a single stream with a RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+// SettingID identifies a SETTINGS parameter (RFC 9113 section 6.5.2)
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Setting is a single SETTINGS parameter
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// ParseSettings decodes a SETTINGS payload and validates the values
+func ParseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnectionError{Code: ErrCodeFrameSize, Reason: "SETTINGS payload is not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		s := Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		}
+		switch {
+		case s.ID == SettingEnablePush && s.Value > 1:
+			return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "ENABLE_PUSH must be 0 or 1"}
+		case s.ID == SettingInitialWindowSize && s.Value > maxWindowSize:
+			return nil, ConnectionError{Code: ErrCodeFlowControl, Reason: "INITIAL_WINDOW_SIZE too large"}
+		case s.ID == SettingMaxFrameSize && (s.Value < minMaxFrameSize || s.Value > maxMaxFrameSize):
+			return nil, ConnectionError{Code: ErrCodeProtocol, Reason: "MAX_FRAME_SIZE out of range"}
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// AppendSettings encodes settings as a SETTINGS payload
+func AppendSettings(dst []byte, settings ...Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
@@ -0,0 +1,349 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultHeaderTableSize is the initial size of the HPACK dynamic table (RFC 7541 section 4.2)
+const DefaultHeaderTableSize = 4096
+
+var (
+	// errCompression is wrapped by every header block decoding error
+	errCompression = errors.New("hpack: invalid header block")
+	// ErrHeaderListTooLarge is returned when a decoded block exceeds the decoder's MaxListSize
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+)
+
+// HeaderField is a single decoded header
+type HeaderField struct {
+	Name, Value string
+	// Sensitive fields are never added to a compression table (RFC 7541 section 7.1.3)
+	Sensitive bool
+}
+
+// size is the field's size as counted by the dynamic table (RFC 7541 section 4.1)
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// staticTable is RFC 7541 Appendix A; index 1 is staticTable[0]
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// Decoder decodes HPACK header blocks. It keeps the dynamic table between
+// blocks, so one Decoder serves one direction of one connection.
+type Decoder struct {
+	// MaxListSize, if set, bounds the decoded size of a header block. Indexed
+	// fields let a small block expand a lot, so this also bounds memory.
+	MaxListSize uint32
+
+	// dynamic holds the dynamic table, newest entry first
+	dynamic []HeaderField
+	size    uint32
+	maxSize uint32
+	// allowedMaxSize is the limit we advertised with SETTINGS_HEADER_TABLE_SIZE
+	allowedMaxSize uint32
+}
+
+// NewDecoder creates a decoder whose dynamic table may grow to maxTableSize
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{maxSize: maxTableSize, allowedMaxSize: maxTableSize}
+}
+
+// Decode decodes a complete header block. A block over MaxListSize is still
+// decoded in full, so the dynamic table stays in step with the encoder's, but
+// its fields are dropped and ErrHeaderListTooLarge is returned.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint64
+	emit := func(field HeaderField) {
+		listSize += uint64(field.size())
+		if d.MaxListSize == 0 || listSize <= uint64(d.MaxListSize) {
+			fields = append(fields, field)
+		}
+	}
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field (section 6.1)
+			var index uint64
+			index, block, err = decodeInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.at(index)
+			if err != nil {
+				return nil, err
+			}
+			emit(field)
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing (section 6.2.1)
+			var field HeaderField
+			field, block, err = d.decodeLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(field)
+			emit(field)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update (section 6.3), only allowed before any field
+			if listSize > 0 {
+				return nil, fmt.Errorf("%w: table size update after a header field", errCompression)
+			}
+			var size uint64
+			size, block, err = decodeInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d exceeds limit %d", errCompression, size, d.allowedMaxSize)
+			}
+			d.maxSize = uint32(size)
+			d.evict()
+		default:
+			// Literal without indexing (section 6.2.2) or never indexed (section 6.2.3)
+			var field HeaderField
+			field, block, err = d.decodeLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			field.Sensitive = b&0xf0 == 0x10
+			emit(field)
+		}
+	}
+	if d.MaxListSize > 0 && listSize > uint64(d.MaxListSize) {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// decodeLiteral decodes a literal field whose name index has an n-bit prefix
+func (d *Decoder) decodeLiteral(block []byte, n uint8) (HeaderField, []byte, error) {
+	index, block, err := decodeInt(block, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var field HeaderField
+	if index > 0 {
+		named, err := d.at(index)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		field.Name = named.Name
+	} else {
+		field.Name, block, err = decodeString(block)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+	field.Value, block, err = decodeString(block)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return field, block, nil
+}
+
+// at looks up an index in the combined static and dynamic table
+func (d *Decoder) at(index uint64) (HeaderField, error) {
+	if index == 0 {
+		return HeaderField{}, fmt.Errorf("%w: index 0", errCompression)
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	dynamicIndex := index - uint64(len(staticTable)) - 1
+	if dynamicIndex >= uint64(len(d.dynamic)) {
+		return HeaderField{}, fmt.Errorf("%w: index %d out of range", errCompression, index)
+	}
+	return d.dynamic[dynamicIndex], nil
+}
+
+// add inserts a field into the dynamic table, evicting old entries to make room
+func (d *Decoder) add(field HeaderField) {
+	field.Sensitive = false
+	if field.size() > d.maxSize {
+		// A field larger than the table empties it (section 4.4)
+		d.dynamic = nil
+		d.size = 0
+		return
+	}
+	d.dynamic = append([]HeaderField{field}, d.dynamic...)
+	d.size += field.size()
+	d.evict()
+}
+
+// evict drops the oldest entries until the table fits its maximum size
+func (d *Decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// AppendHeaderField appends the encoding of a field to dst. We never add
+// entries to the peer's dynamic table, which keeps the encoder stateless and
+// valid whatever table size the peer allows; fields found in the static table
+// are referenced from it and strings are Huffman-encoded when that's shorter.
+func AppendHeaderField(dst []byte, field HeaderField) []byte {
+	nameIndex := 0
+	for i, entry := range staticTable {
+		if entry.Name != field.Name {
+			continue
+		}
+		if entry.Value == field.Value && !field.Sensitive {
+			return appendInt(dst, 7, 0x80, uint64(i+1))
+		}
+		if nameIndex == 0 {
+			nameIndex = i + 1
+		}
+	}
+
+	var prefix byte
+	if field.Sensitive {
+		prefix = 0x10
+	}
+	dst = appendInt(dst, 4, prefix, uint64(nameIndex))
+	if nameIndex == 0 {
+		dst = appendString(dst, field.Name)
+	}
+	return appendString(dst, field.Value)
+}
+
+// decodeInt decodes an integer with an n-bit prefix (RFC 7541 section 5.1)
+func decodeInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+	}
+	prefixMax := uint64(1)<<n - 1
+	value := uint64(block[0]) & prefixMax
+	if value < prefixMax {
+		return value, block[1:], nil
+	}
+	shift := uint(0)
+	for i := 1; i < len(block); i++ {
+		b := block[i]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block[i+1:], nil
+		}
+		shift += 7
+		if shift >= 63 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", errCompression)
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", errCompression)
+}
+
+// appendInt encodes an integer with an n-bit prefix, OR-ing flags into the first byte
+func appendInt(dst []byte, n uint8, flags byte, value uint64) []byte {
+	prefixMax := uint64(1)<<n - 1
+	if value < prefixMax {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(prefixMax))
+	value -= prefixMax
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// decodeString decodes a string literal (RFC 7541 section 5.2)
+func decodeString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := decodeInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) {
+		return "", nil, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	raw, rest := block[:length], block[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errCompression, err)
+	}
+	return s, rest, nil
+}
+
+// appendString encodes a string literal, Huffman-encoded if that's shorter
+func appendString(dst []byte, s string) []byte {
+	if encodedLen := huffmanEncodedLen(s); encodedLen < len(s) {
+		dst = appendInt(dst, 7, 0x80, uint64(encodedLen))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 7, 0, uint64(len(s)))
+	return append(dst, s...)
+}
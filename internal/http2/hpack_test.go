@@ -0,0 +1,137 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHPACKIntegers(t *testing.T) {
+	// Test: Examples from RFC 7541 Appendix C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 5, 0, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 5, 0, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 8, 0, 42))
+
+	value, rest, err := decodeInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), value)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	// Test: Truncated and overflowing integers are rejected
+	_, _, err = decodeInt([]byte{0x1f, 0x9a}, 5)
+	require.ErrorIs(t, err, errCompression)
+	_, _, err = decodeInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	require.ErrorIs(t, err, errCompression)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Example from RFC 7541 Appendix C.4.1
+	encoded := appendHuffman(nil, "www.example.com")
+	assert.Equal(t, "f1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(encoded))
+	decoded, err := huffmanDecode(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", decoded)
+
+	// Test: Every byte value round-trips
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	decoded, err = huffmanDecode(appendHuffman(nil, all.String()))
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), decoded)
+
+	// Test: Padding longer than 7 bits or not made of ones is rejected
+	_, err = huffmanDecode(append(encoded, 0xff))
+	require.ErrorIs(t, err, errInvalidHuffman)
+	_, err = huffmanDecode([]byte{0x1e}) // "a" (00011) padded with zeros
+	require.ErrorIs(t, err, errInvalidHuffman)
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: Requests with Huffman coding from RFC 7541 Appendix C.4, which share a dynamic table
+	d := NewDecoder(DefaultHeaderTableSize)
+	fields := decodeHex(t, d, "828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+
+	fields = decodeHex(t, d, "828684be5886a8eb10649cbf")
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "cache-control", Value: "no-cache"},
+	}, fields)
+
+	fields = decodeHex(t, d, "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf")
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}, fields)
+	assert.Equal(t, uint32(164), d.size)
+
+	// Test: Responses from RFC 7541 Appendix C.5 evict entries from a 256 byte table
+	d = NewDecoder(256)
+	decodeHex(t, d, "4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d")
+	fields = decodeHex(t, d, "4803333037c1c0bf")
+	assert.Equal(t, HeaderField{Name: ":status", Value: "307"}, fields[0])
+	assert.Equal(t, HeaderField{Name: "location", Value: "https://www.example.com"}, fields[3])
+	assert.Len(t, d.dynamic, 4)
+	assert.Equal(t, uint32(222), d.size)
+
+	// Test: Never-indexed literals are marked sensitive
+	fields = decodeHex(t, NewDecoder(DefaultHeaderTableSize), "100870617373776f726406736563726574")
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, fields)
+
+	// Test: Out of range indexes and oversized table updates are rejected
+	_, err := NewDecoder(DefaultHeaderTableSize).Decode([]byte{0xff, 0x00})
+	require.ErrorIs(t, err, errCompression)
+	_, err = NewDecoder(100).Decode([]byte{0x3f, 0xe1, 0x1f})
+	require.ErrorIs(t, err, errCompression)
+
+	// Test: Header lists over the limit are reported without their fields
+	d = NewDecoder(DefaultHeaderTableSize)
+	d.MaxListSize = 50
+	_, err = d.Decode(AppendHeaderField(nil, HeaderField{Name: "x-big", Value: strings.Repeat("a", 40)}))
+	require.ErrorIs(t, err, ErrHeaderListTooLarge)
+}
+
+func TestAppendHeaderField(t *testing.T) {
+	// Test: Static table matches are indexed
+	assert.Equal(t, []byte{0x82}, AppendHeaderField(nil, HeaderField{Name: ":method", Value: "GET"}))
+
+	// Test: Encoded fields decode back, whatever their shape
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "x-custom", Value: strings.Repeat("v", 200)},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+	var block []byte
+	for _, field := range fields {
+		block = AppendHeaderField(block, field)
+	}
+	decoded, err := NewDecoder(DefaultHeaderTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+}
+
+func decodeHex(t *testing.T, d *Decoder, block string) []HeaderField {
+	t.Helper()
+	raw, err := hex.DecodeString(block)
+	require.NoError(t, err)
+	fields, err := d.Decode(raw)
+	require.NoError(t, err)
+	return fields
+}
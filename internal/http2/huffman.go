@@ -0,0 +1,98 @@
+package http2
+
+import "errors"
+
+// errInvalidHuffman is returned for Huffman strings with bad codes or padding
+var errInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+// huffmanNode is a node in the decoding tree. Leaves have symbol >= 0.
+type huffmanNode struct {
+	children [2]int32
+	symbol   int16
+}
+
+// huffmanTree is the decoding tree for the code; node 0 is the root
+var huffmanTree = buildHuffmanTree()
+
+func buildHuffmanTree() []huffmanNode {
+	tree := []huffmanNode{{symbol: -1}}
+	add := func(code uint32, length uint8, symbol int16) {
+		node := 0
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if tree[node].children[bit] == 0 {
+				tree = append(tree, huffmanNode{symbol: -1})
+				tree[node].children[bit] = int32(len(tree) - 1)
+			}
+			node = int(tree[node].children[bit])
+		}
+		tree[node].symbol = symbol
+	}
+	for symbol := range huffmanCodes {
+		add(huffmanCodes[symbol], huffmanCodeLen[symbol], int16(symbol))
+	}
+	add(huffmanEOS, huffmanEOSLen, 256)
+	return tree
+}
+
+// huffmanDecode decodes a Huffman-encoded string. Padding must be shorter
+// than a byte and made of the most significant bits of EOS (all ones).
+func huffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	node := 0
+	padBits := 0
+	padOnes := true
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			node = int(huffmanTree[node].children[bit])
+			if node == 0 {
+				return "", errInvalidHuffman
+			}
+			padBits++
+			padOnes = padOnes && bit == 1
+			if symbol := huffmanTree[node].symbol; symbol >= 0 {
+				if symbol == 256 {
+					return "", errInvalidHuffman
+				}
+				out = append(out, byte(symbol))
+				node = 0
+				padBits = 0
+				padOnes = true
+			}
+		}
+	}
+	if padBits > 7 || !padOnes {
+		return "", errInvalidHuffman
+	}
+	return string(out), nil
+}
+
+// huffmanEncodedLen returns how many bytes s takes once Huffman-encoded
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends the Huffman encoding of s to dst
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		length := int(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		// Pad with the high bits of EOS, which are all ones
+		dst = append(dst, byte(acc<<(8-bits))|byte(0xff>>bits))
+	}
+	return dst
+}
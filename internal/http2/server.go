@@ -0,0 +1,345 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Defaults used when a Server field is zero
+const (
+	DefaultMaxConcurrentStreams = 100
+	DefaultMaxHeaderListSize    = 1 << 20
+	DefaultMaxRequestBodySize   = 10 << 20
+)
+
+// initialWindowSize is the flow-control window every stream and the
+// connection start with (RFC 9113 section 6.9.2)
+const initialWindowSize = 65535
+
+// ErrBadUpgrade is returned by ServeUpgrade when the request isn't a valid h2c upgrade
+var ErrBadUpgrade = errors.New("http2: bad h2c upgrade request")
+
+// Server serves HTTP/2 over cleartext connections (h2c). Each stream is
+// handed to a handler of the same shape as server.Handler.
+type Server struct {
+	// MaxConcurrentStreams limits how many requests a client may have in
+	// flight on one connection
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize bounds the decoded size of a request's headers
+	MaxHeaderListSize uint32
+	// MaxRequestBodySize bounds request bodies; larger ones get a 413
+	MaxRequestBodySize int64
+
+	mu sync.Mutex
+	// conns holds the connections being served, for Shutdown
+	conns        map[*serverConn]bool
+	shuttingDown bool
+}
+
+// Handler has the same shape as server.Handler
+type Handler = func(w *response.Writer, req *request.Request)
+
+// DetectPreface reads from r just far enough to tell whether the client
+// opened with the HTTP/2 connection preface. It returns everything it read so
+// the caller can parse it as HTTP/1.1 instead, or hand it to ServeConn.
+func DetectPreface(r io.Reader) (read []byte, isHTTP2 bool, err error) {
+	buf := make([]byte, 0, len(ClientPreface))
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		compare := min(len(buf), len(ClientPreface))
+		if string(buf[:compare]) != ClientPreface[:compare] {
+			return buf, false, nil
+		}
+		if len(buf) == len(ClientPreface) {
+			return buf, true, nil
+		}
+		if err != nil {
+			return buf, false, err
+		}
+	}
+}
+
+// ServeConn serves an HTTP/2 connection whose first bytes, read while
+// detecting the preface, are in prefix. Requests get contexts derived from
+// ctx, and the connection is closed when ctx ends. It returns once the
+// connection is finished and closes it.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, prefix []byte, handler Handler) {
+	sc := newServerConn(ctx, s, conn, prefix, handler)
+	sc.serve(nil)
+}
+
+// Shutdown sends GOAWAY on every connection being served. Each one finishes
+// the streams it has, refusing new ones, and then closes. It doesn't wait
+// for that to happen.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shuttingDown = true
+	for sc := range s.conns {
+		go sc.shutdown()
+	}
+}
+
+// track registers a connection for Shutdown. It reports false if the server
+// is already shutting down, and the connection shouldn't be served.
+func (s *Server) track(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]bool)
+	}
+	s.conns[sc] = true
+	return true
+}
+
+func (s *Server) untrack(sc *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, sc)
+}
+
+// IsUpgradeRequest reports whether an HTTP/1.1 request asks to switch to h2c
+func IsUpgradeRequest(req *request.Request) bool {
+	return headers.HasToken(req.Headers.Get("Upgrade"), "h2c") &&
+		headers.HasToken(req.Headers.Get("Connection"), "upgrade") &&
+		req.Headers.Get("HTTP2-Settings") != ""
+}
+
+// ServeUpgrade switches an HTTP/1.1 connection to HTTP/2 (RFC 7540 section
+// 3.2). The request becomes stream 1 and its response is sent over HTTP/2.
+// Requests get contexts derived from req's, which also ends the connection.
+// It returns once the connection is finished. If the request isn't a valid
+// upgrade it answers 400 and returns an error wrapping ErrBadUpgrade.
+func (s *Server) ServeUpgrade(w *response.Writer, req *request.Request, handler Handler) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		w.WriteError(response.StatusBadRequest, nil)
+		return err
+	}
+
+	upgradeHeaders := headers.NewHeaders()
+	upgradeHeaders.Override("Connection", "Upgrade")
+	upgradeHeaders.Override("Upgrade", "h2c")
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(upgradeHeaders); err != nil {
+		return err
+	}
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return err
+	}
+
+	// The request was sent over HTTP/1.1; strip what only made sense there
+	upgraded := *req
+	upgraded.RequestLine.HttpVersion = "2"
+	upgraded.Headers = headers.NewHeaders()
+	for key, value := range req.Headers {
+		upgraded.Headers.Override(key, value)
+	}
+	for _, key := range []string{"Connection", "Upgrade", "HTTP2-Settings", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"} {
+		upgraded.Headers.Delete(key)
+	}
+
+	sc := newServerConn(req.Context(), s, conn, buffered, handler)
+	if err := sc.applySettings(settings); err != nil {
+		conn.Close()
+		return err
+	}
+	sc.serve(&upgraded)
+	return nil
+}
+
+// upgradeSettings decodes the HTTP2-Settings header of an upgrade request
+func upgradeSettings(req *request.Request) ([]Setting, error) {
+	value := strings.TrimSpace(req.Headers.Get("HTTP2-Settings"))
+	if !headers.HasToken(req.Headers.Get("Connection"), "HTTP2-Settings") || strings.Contains(value, ",") {
+		return nil, fmt.Errorf("%w: exactly one HTTP2-Settings header is required", ErrBadUpgrade)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: HTTP2-Settings: %v", ErrBadUpgrade, err)
+	}
+	settings, err := ParseSettings(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: HTTP2-Settings: %v", ErrBadUpgrade, err)
+	}
+	return settings, nil
+}
+
+// buildRequest turns a stream's decoded header fields into a request,
+// validating them as RFC 9113 section 8.3 requires
+func buildRequest(fields []HeaderField, body []byte, remoteAddr string) (*request.Request, error) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+		Body:        body,
+		RemoteAddr:  remoteAddr,
+	}
+
+	var scheme, authority string
+	var cookies []string
+	pseudoDone := false
+	seen := map[string]bool{}
+	for _, field := range fields {
+		if strings.HasPrefix(field.Name, ":") {
+			if pseudoDone {
+				return nil, errors.New("pseudo-header after regular header")
+			}
+			if seen[field.Name] {
+				return nil, fmt.Errorf("duplicate %s", field.Name)
+			}
+			seen[field.Name] = true
+			if !validPseudoValue(field.Value) {
+				return nil, fmt.Errorf("invalid %s %q", field.Name, field.Value)
+			}
+			switch field.Name {
+			case ":method":
+				req.RequestLine.Method = field.Value
+			case ":path":
+				req.RequestLine.RequestTarget = field.Value
+			case ":scheme":
+				scheme = field.Value
+			case ":authority":
+				authority = field.Value
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", field.Name)
+			}
+			continue
+		}
+		pseudoDone = true
+
+		if field.Name != strings.ToLower(field.Name) {
+			return nil, fmt.Errorf("uppercase header name %q", field.Name)
+		}
+		if !headers.ValidToken(field.Name) {
+			return nil, fmt.Errorf("invalid header name %q", field.Name)
+		}
+		if !validFieldValue(field.Value) {
+			return nil, fmt.Errorf("invalid value for header %q", field.Name)
+		}
+		if isConnectionSpecific(field.Name) {
+			return nil, fmt.Errorf("connection-specific header %q", field.Name)
+		}
+		if field.Name == "te" && field.Value != "trailers" {
+			return nil, errors.New(`te may only be "trailers"`)
+		}
+		if field.Name == "cookie" {
+			// Cookies may be split across fields (RFC 9113 section 8.2.3)
+			cookies = append(cookies, field.Value)
+			continue
+		}
+		req.Headers.Set(field.Name, field.Value)
+	}
+	if len(cookies) > 0 {
+		req.Headers.Override("cookie", strings.Join(cookies, "; "))
+	}
+
+	if req.RequestLine.Method == "" {
+		return nil, errors.New("missing :method")
+	}
+	if !headers.ValidToken(req.RequestLine.Method) {
+		return nil, fmt.Errorf("invalid :method %q", req.RequestLine.Method)
+	}
+	if req.RequestLine.Method == "CONNECT" {
+		if authority == "" || scheme != "" || req.RequestLine.RequestTarget != "" {
+			return nil, errors.New("CONNECT needs :authority and no :scheme or :path")
+		}
+		req.RequestLine.RequestTarget = authority
+	} else if scheme == "" || req.RequestLine.RequestTarget == "" {
+		return nil, errors.New("missing :scheme or :path")
+	}
+	if authority != "" {
+		req.Headers.Override("host", authority)
+	}
+
+	// Handlers and proxies downstream rely on Content-Length to frame the body
+	if declared := req.Headers.Get("content-length"); declared != "" {
+		if declared != fmt.Sprint(len(body)) {
+			return nil, errors.New("content-length doesn't match the body")
+		}
+	} else if len(body) > 0 {
+		req.Headers.Override("content-length", fmt.Sprint(len(body)))
+	}
+	return req, nil
+}
+
+// responseFields converts a parsed HTTP/1.1 response head into HTTP/2 fields
+func responseFields(statusCode response.StatusCode, h headers.Headers) []HeaderField {
+	fields := []HeaderField{{Name: ":status", Value: fmt.Sprint(int(statusCode))}}
+	return append(fields, headerFields(h)...)
+}
+
+// headerFields converts headers to HTTP/2 fields, dropping the ones that are
+// only meaningful to HTTP/1.1 connections
+func headerFields(h headers.Headers) []HeaderField {
+	var fields []HeaderField
+	for key := range h {
+		name := strings.ToLower(key)
+		if isConnectionSpecific(name) {
+			continue
+		}
+		for _, line := range h.Lines(key) {
+			fields = append(fields, HeaderField{Name: name, Value: line})
+		}
+	}
+	return fields
+}
+
+// validFieldValue reports whether a header value is free of NUL, CR and LF
+// and of surrounding whitespace (RFC 9113 section 8.2.1)
+func validFieldValue(value string) bool {
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return false
+	}
+	return value == strings.Trim(value, " \t")
+}
+
+// validPseudoValue reports whether a pseudo-header value has no whitespace or
+// control characters, which would change its meaning once written as an
+// HTTP/1.1 request line
+func validPseudoValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] <= ' ' || value[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isConnectionSpecific reports whether a header is forbidden in HTTP/2 (RFC 9113 section 8.2.2)
+func isConnectionSpecific(name string) bool {
+	switch name {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
+
+// prefixReader replays bytes read before the connection was handed over
+type prefixReader struct {
+	prefix *bytes.Reader
+	conn   io.Reader
+}
+
+func (r *prefixReader) Read(p []byte) (int, error) {
+	if r.prefix.Len() > 0 {
+		return r.prefix.Read(p)
+	}
+	return r.conn.Read(p)
+}
@@ -0,0 +1,481 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectPreface(t *testing.T) {
+	// Test: The HTTP/2 preface is recognised and handed back
+	read, isHTTP2, err := DetectPreface(strings.NewReader(ClientPreface + "frames"))
+	require.NoError(t, err)
+	assert.True(t, isHTTP2)
+	assert.Equal(t, ClientPreface, string(read))
+
+	// Test: HTTP/1.1 requests are detected after the first mismatch
+	read, isHTTP2, err = DetectPreface(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, isHTTP2)
+	assert.True(t, strings.HasPrefix("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", string(read)))
+
+	// Test: Short HTTP/1.1 requests don't wait for more bytes
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	go clientSide.Write([]byte("PUT"))
+	read, isHTTP2, err = DetectPreface(serverSide)
+	require.NoError(t, err)
+	assert.False(t, isHTTP2)
+	assert.Equal(t, "PU", string(read[:2]))
+	clientSide.Close()
+}
+
+func TestServeConn(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/echo":
+			extra := headers.NewHeaders()
+			extra.Override("X-Method", req.RequestLine.Method)
+			extra.Override("X-Version", req.RequestLine.HttpVersion)
+			extra.Override("X-Host", req.Headers.Get("Host"))
+			extra.Override("X-Cookie", req.Headers.Get("Cookie"))
+			w.WriteResponse(response.StatusOK, extra, req.Body)
+		case "/wait":
+			<-release
+			w.WriteResponse(response.StatusOK, nil, []byte("waited"))
+		case "/release":
+			close(release)
+			w.WriteResponse(response.StatusOK, nil, []byte("released"))
+		case "/trailers":
+			w.WriteStatusLine(response.StatusOK)
+			h := headers.NewHeaders()
+			h.Override("Transfer-Encoding", "chunked")
+			h.Override("Trailer", "X-Checksum")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("chunk one, "))
+			w.WriteChunkedBody([]byte("chunk two"))
+			w.WriteChunkedBodyDone()
+			trailers := headers.NewHeaders()
+			trailers.Override("X-Checksum", "abc")
+			w.WriteTrailers(trailers)
+		default:
+			w.WriteError(response.StatusBadRequest, nil)
+		}
+	}
+	c := dialH2(t, &Server{}, handler)
+
+	// Test: Requests are dispatched with their pseudo-headers mapped onto request.Request
+	c.writeHeaders(1, true, requestFields("GET", "/echo", HeaderField{Name: "cookie", Value: "a=1"}, HeaderField{Name: "cookie", Value: "b=2"})...)
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "GET", resp.headers["x-method"])
+	assert.Equal(t, "2", resp.headers["x-version"])
+	assert.Equal(t, "example.com", resp.headers["x-host"])
+	assert.Equal(t, "a=1; b=2", resp.headers["x-cookie"])
+	assert.Empty(t, resp.headers["connection"], "connection-specific headers must be dropped")
+
+	// Test: Request bodies arrive in DATA frames
+	c.writeHeaders(3, false, requestFields("POST", "/echo")...)
+	c.writeData(3, false, []byte("hello "))
+	c.writeData(3, true, []byte("world"))
+	resp = c.readResponse(3)
+	assert.Equal(t, "POST", resp.headers["x-method"])
+	assert.Equal(t, "hello world", resp.body)
+
+	// Test: Streams are multiplexed; a blocked stream doesn't hold up the next one
+	c.writeHeaders(5, true, requestFields("GET", "/wait")...)
+	c.writeHeaders(7, true, requestFields("GET", "/release")...)
+	responses := c.readResponses(5, 7)
+	assert.Equal(t, "waited", responses[5].body)
+	assert.Equal(t, "released", responses[7].body)
+
+	// Test: Chunked responses with trailers end with a trailing HEADERS frame
+	c.writeHeaders(9, true, requestFields("GET", "/trailers")...)
+	resp = c.readResponse(9)
+	assert.Equal(t, "chunk one, chunk two", resp.body)
+	assert.Equal(t, "abc", resp.trailers["x-checksum"])
+	assert.Empty(t, resp.headers["transfer-encoding"])
+
+	// Test: PINGs are answered
+	c.writeFrame(&Frame{Type: FramePing, Payload: []byte("12345678")})
+	f := c.readFrameOfType(FramePing)
+	assert.True(t, f.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+
+	// Test: Malformed requests are reset with PROTOCOL_ERROR
+	c.writeHeaders(11, true, HeaderField{Name: ":method", Value: "GET"}, HeaderField{Name: ":scheme", Value: "http"})
+	assert.Equal(t, ErrCodeProtocol, c.readReset(11))
+	c.writeHeaders(13, true, requestFields("GET", "/echo", HeaderField{Name: "connection", Value: "close"})...)
+	assert.Equal(t, ErrCodeProtocol, c.readReset(13))
+
+	// Test: Fields that could inject lines into an HTTP/1.1 request are malformed
+	c.writeHeaders(15, true, requestFields("GET", "/echo", HeaderField{Name: "x-a", Value: "1\r\nx-b: 2"})...)
+	assert.Equal(t, ErrCodeProtocol, c.readReset(15))
+	c.writeHeaders(17, true, requestFields("GET", "/echo HTTP/1.1\r\nx-b: 2\r\n\r\nGET /")...)
+	assert.Equal(t, ErrCodeProtocol, c.readReset(17))
+	c.writeHeaders(19, true, requestFields("GET", "/echo", HeaderField{Name: "x-a:b", Value: "1"})...)
+	assert.Equal(t, ErrCodeProtocol, c.readReset(19))
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte(strings.Repeat("x", 25)))
+	}
+
+	// Test: DATA never exceeds the client's window and resumes after WINDOW_UPDATE
+	c := dialH2(t, &Server{}, handler, Setting{ID: SettingInitialWindowSize, Value: 10})
+	c.writeHeaders(1, true, requestFields("GET", "/")...)
+	resp := c.readResponse(1)
+	assert.Equal(t, strings.Repeat("x", 25), resp.body)
+	for _, size := range resp.dataSizes {
+		assert.LessOrEqual(t, size, 10)
+	}
+
+	// Test: A SETTINGS change to the initial window applies to streams already open
+	c = dialH2(t, &Server{}, handler, Setting{ID: SettingInitialWindowSize, Value: 0})
+	c.autoWindowUpdate = false
+	c.writeHeaders(1, true, requestFields("GET", "/")...)
+	f := c.readFrameOfType(FrameHeaders)
+	assert.False(t, f.Has(FlagEndStream))
+	c.writeFrame(&Frame{Type: FrameSettings, Payload: AppendSettings(nil, Setting{ID: SettingInitialWindowSize, Value: 100})})
+	f = c.readFrameOfType(FrameData)
+	assert.Len(t, f.Payload, 25)
+}
+
+func TestServeConnLimits(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/wait" {
+			<-release
+		}
+		w.WriteResponse(response.StatusOK, nil, []byte("ok"))
+	}
+
+	// Test: Streams beyond MaxConcurrentStreams are refused
+	c := dialH2(t, &Server{MaxConcurrentStreams: 1}, handler)
+	c.writeHeaders(1, true, requestFields("GET", "/wait")...)
+	c.writeHeaders(3, true, requestFields("GET", "/")...)
+	assert.Equal(t, ErrCodeRefusedStream, c.readReset(3))
+
+	// Test: Oversized bodies are answered with 413 straight away
+	c = dialH2(t, &Server{MaxRequestBodySize: 4}, handler)
+	c.writeHeaders(1, false, requestFields("POST", "/")...)
+	c.writeData(1, false, []byte("too large"))
+	resp := c.readResponse(1)
+	assert.Equal(t, "413", resp.headers[":status"])
+	assert.Equal(t, ErrCodeNo, c.readReset(1))
+
+	// Test: Oversized header lists are answered with 431
+	c = dialH2(t, &Server{MaxHeaderListSize: 200}, handler)
+	c.writeHeaders(1, true, requestFields("GET", "/", HeaderField{Name: "x-big", Value: strings.Repeat("a", 300)})...)
+	resp = c.readResponse(1)
+	assert.Equal(t, "431", resp.headers[":status"])
+
+	// Test: Protocol violations end the connection with GOAWAY
+	c = dialH2(t, &Server{}, handler)
+	c.writeFrame(&Frame{Type: FrameData, StreamID: 0, Payload: []byte("x")})
+	f := c.readFrameOfType(FrameGoAway)
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+}
+
+func TestServeConnContexts(t *testing.T) {
+	started := make(chan struct{}, 1)
+	canceled := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/block":
+			started <- struct{}{}
+			<-req.Context().Done()
+			canceled <- struct{}{}
+		case "/slow":
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteResponse(response.StatusOK, nil, []byte("done"))
+	}
+	waitCanceled := func() {
+		t.Helper()
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request context wasn't canceled")
+		}
+	}
+
+	// Test: Resetting a stream cancels its request's context
+	srv := &Server{}
+	c := dialH2(t, srv, handler)
+	c.writeHeaders(1, true, requestFields("GET", "/block")...)
+	<-started
+	c.writeFrame(&Frame{Type: FrameRSTStream, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))})
+	waitCanceled()
+
+	// Test: Shutdown sends GOAWAY, refuses new streams, lets open ones
+	// finish and then closes the connection
+	c.writeHeaders(3, true, requestFields("GET", "/slow")...)
+	<-started
+	srv.Shutdown()
+	f := c.readFrameOfType(FrameGoAway)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(f.Payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+	c.writeHeaders(5, true, requestFields("GET", "/")...)
+	assert.Equal(t, ErrCodeRefusedStream, c.readReset(5))
+	close(release)
+	assert.Equal(t, "done", c.readResponse(3).body)
+	for {
+		if _, err := ReadFrame(c.reader, maxMaxFrameSize); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+	}
+
+	// Test: The connection closing cancels the requests still running
+	c = dialH2(t, &Server{}, handler)
+	c.writeHeaders(1, true, requestFields("GET", "/block")...)
+	<-started
+	c.conn.Close()
+	waitCanceled()
+}
+
+func TestServeUpgrade(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		reader := request.NewReader(conn)
+		req, err := reader.ReadRequest()
+		if err != nil || !IsUpgradeRequest(req) {
+			conn.Close()
+			return
+		}
+		w := response.NewHijackableWriter(conn, func() (net.Conn, []byte, error) {
+			return conn, reader.Buffered(), nil
+		})
+		(&Server{}).ServeUpgrade(w, req, func(w *response.Writer, req *request.Request) {
+			w.WriteResponse(response.StatusOK, nil, []byte(req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" over HTTP/"+req.RequestLine.HttpVersion))
+		})
+	}()
+
+	// Test: The upgrade is answered with 101 and the request's response comes on stream 1
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	settings := base64.RawURLEncoding.EncodeToString(AppendSettings(nil, Setting{ID: SettingInitialWindowSize, Value: 1000}))
+	fmt.Fprintf(conn, "GET /upgraded HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n", settings)
+
+	reader := bufio.NewReader(conn)
+	statusLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	c := &testClient{t: t, conn: conn, reader: reader, decoder: NewDecoder(DefaultHeaderTableSize), autoWindowUpdate: true}
+	c.writePreface()
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "GET /upgraded over HTTP/2", resp.body)
+
+	// Test: Upgrades without valid HTTP2-Settings are rejected
+	req := &request.Request{Headers: headers.NewHeaders()}
+	req.Headers.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Headers.Set("Upgrade", "h2c")
+	req.Headers.Set("HTTP2-Settings", "!!!")
+	var out strings.Builder
+	err = (&Server{}).ServeUpgrade(response.NewWriter(&out), req, nil)
+	require.ErrorIs(t, err, ErrBadUpgrade)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 400 Bad Request"))
+}
+
+// testClient is just enough of an HTTP/2 client to drive the server
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *Decoder
+	// autoWindowUpdate returns flow-control credit for every DATA frame received
+	autoWindowUpdate bool
+}
+
+// testResponse is what arrived on one stream
+type testResponse struct {
+	headers   map[string]string
+	trailers  map[string]string
+	body      string
+	dataSizes []int
+}
+
+// dialH2 starts srv on a loopback listener and connects to it with prior knowledge
+func dialH2(t *testing.T, srv *Server, handler Handler, settings ...Setting) *testClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		prefix, isHTTP2, err := DetectPreface(conn)
+		if err != nil || !isHTTP2 {
+			conn.Close()
+			return
+		}
+		srv.ServeConn(context.Background(), conn, prefix, handler)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: NewDecoder(DefaultHeaderTableSize), autoWindowUpdate: true}
+	c.writePreface(settings...)
+	return c
+}
+
+func (c *testClient) writePreface(settings ...Setting) {
+	_, err := c.conn.Write([]byte(ClientPreface))
+	require.NoError(c.t, err)
+	c.writeFrame(&Frame{Type: FrameSettings, Payload: AppendSettings(nil, settings...)})
+}
+
+func (c *testClient) writeFrame(f *Frame) {
+	require.NoError(c.t, WriteFrame(c.conn, f))
+}
+
+func (c *testClient) writeHeaders(id uint32, endStream bool, fields ...HeaderField) {
+	var block []byte
+	for _, field := range fields {
+		block = AppendHeaderField(block, field)
+	}
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(&Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: block})
+}
+
+func (c *testClient) writeData(id uint32, endStream bool, data []byte) {
+	var flags Flags
+	if endStream {
+		flags = FlagEndStream
+	}
+	c.writeFrame(&Frame{Type: FrameData, Flags: flags, StreamID: id, Payload: data})
+}
+
+// readFrame reads the next frame, acknowledging SETTINGS along the way
+func (c *testClient) readFrame() *Frame {
+	for {
+		f, err := ReadFrame(c.reader, maxMaxFrameSize)
+		require.NoError(c.t, err)
+		if f.Type == FrameSettings && !f.Has(FlagAck) {
+			c.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+			continue
+		}
+		return f
+	}
+}
+
+// readFrameOfType skips frames until one of the given type arrives
+func (c *testClient) readFrameOfType(frameType FrameType) *Frame {
+	for {
+		if f := c.readFrame(); f.Type == frameType {
+			return f
+		}
+	}
+}
+
+// readReset waits for a RST_STREAM on a stream and returns its error code
+func (c *testClient) readReset(id uint32) ErrCode {
+	for {
+		f := c.readFrame()
+		if f.Type == FrameRSTStream && f.StreamID == id {
+			return ErrCode(binary.BigEndian.Uint32(f.Payload))
+		}
+	}
+}
+
+func (c *testClient) readResponse(id uint32) *testResponse {
+	return c.readResponses(id)[id]
+}
+
+// readResponses reads frames until every listed stream has ended
+func (c *testClient) readResponses(ids ...uint32) map[uint32]*testResponse {
+	responses := map[uint32]*testResponse{}
+	pending := map[uint32]bool{}
+	for _, id := range ids {
+		responses[id] = &testResponse{}
+		pending[id] = true
+	}
+	for len(pending) > 0 {
+		f := c.readFrame()
+		resp := responses[f.StreamID]
+		if resp == nil {
+			continue
+		}
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.decoder.Decode(f.Payload)
+			require.NoError(c.t, err)
+			decoded := map[string]string{}
+			for _, field := range fields {
+				decoded[field.Name] = field.Value
+			}
+			if resp.headers == nil {
+				resp.headers = decoded
+			} else {
+				resp.trailers = decoded
+			}
+		case FrameData:
+			resp.body += string(f.Payload)
+			resp.dataSizes = append(resp.dataSizes, len(f.Payload))
+			if c.autoWindowUpdate && len(f.Payload) > 0 {
+				increment := binary.BigEndian.AppendUint32(nil, uint32(len(f.Payload)))
+				c.writeFrame(&Frame{Type: FrameWindowUpdate, Payload: increment})
+				c.writeFrame(&Frame{Type: FrameWindowUpdate, StreamID: f.StreamID, Payload: increment})
+			}
+		case FrameRSTStream:
+			c.t.Fatalf("stream %d reset with %s", f.StreamID, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+		}
+		if f.Has(FlagEndStream) && (f.Type == FrameHeaders || f.Type == FrameData) {
+			delete(pending, f.StreamID)
+		}
+	}
+	return responses
+}
+
+func requestFields(method, path string, extra ...HeaderField) []HeaderField {
+	fields := []HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	}
+	return append(fields, extra...)
+}
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRoutes caps how many distinct routes HTTPMetrics labels requests with
+const DefaultMaxRoutes = 100
+
+// otherLabel stands in for methods and routes beyond what is tracked
+const otherLabel = "other"
+
+// SizeBuckets suit request and response body sizes in bytes, from 100B to 100MB
+var SizeBuckets = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000}
+
+// knownMethods are labelled as themselves; any other method is labelled "other"
+// so clients can't grow the number of series
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// HTTPMetrics counts requests by method, route and status and records
+// their latency and body sizes
+type HTTPMetrics struct {
+	// Route names the route a request is counted under. If nil, the path
+	// of the request target without the query is used.
+	Route func(req *request.Request) string
+	// MaxRoutes caps how many distinct routes are tracked; requests to
+	// routes beyond it are counted as "other". If zero, DefaultMaxRoutes.
+	// Routes first seen on a 404 are counted as "other" too, so requests
+	// for made-up paths can't use up the routes.
+	MaxRoutes int
+
+	requests     *Counter
+	duration     *Histogram
+	requestSize  *Histogram
+	responseSize *Histogram
+	inFlight     *Gauge
+	routesMu     sync.Mutex
+	routes       map[string]bool
+}
+
+// NewHTTPMetrics registers the request metrics with reg:
+// http_requests_total, http_request_duration_seconds,
+// http_request_size_bytes, http_response_size_bytes and
+// http_requests_in_flight
+func NewHTTPMetrics(reg *Registry) *HTTPMetrics {
+	labels := []string{"method", "route", "status"}
+	return &HTTPMetrics{
+		requests:     reg.NewCounter("http_requests_total", "Requests handled, by method, route and status.", labels...),
+		duration:     reg.NewHistogram("http_request_duration_seconds", "Time taken to handle requests.", DefaultBuckets, labels...),
+		requestSize:  reg.NewHistogram("http_request_size_bytes", "Size of request bodies.", SizeBuckets, labels...),
+		responseSize: reg.NewHistogram("http_response_size_bytes", "Size of response bodies written.", SizeBuckets, labels...),
+		inFlight:     reg.NewGauge("http_requests_in_flight", "Requests being handled right now."),
+		routes:       make(map[string]bool),
+	}
+}
+
+// Middleware records every request once the handler returns
+func (m *HTTPMetrics) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		next(w, req)
+
+		status := w.Status()
+		labels := []string{m.method(req), m.route(req, status), strconv.Itoa(int(status))}
+		m.requests.Inc(labels...)
+		m.duration.Observe(time.Since(start).Seconds(), labels...)
+		m.requestSize.Observe(float64(len(req.Body)), labels...)
+		m.responseSize.Observe(float64(w.BytesWritten()), labels...)
+	}
+}
+
+func (m *HTTPMetrics) method(req *request.Request) string {
+	if knownMethods[req.RequestLine.Method] {
+		return req.RequestLine.Method
+	}
+	return otherLabel
+}
+
+// route returns the route label, keeping to MaxRoutes distinct values
+func (m *HTTPMetrics) route(req *request.Request, status response.StatusCode) string {
+	var route string
+	if m.Route != nil {
+		route = m.Route(req)
+	} else {
+		route, _, _ = strings.Cut(req.RequestLine.RequestTarget, "?")
+	}
+
+	maxRoutes := m.MaxRoutes
+	if maxRoutes <= 0 {
+		maxRoutes = DefaultMaxRoutes
+	}
+	m.routesMu.Lock()
+	defer m.routesMu.Unlock()
+	if !m.routes[route] {
+		if len(m.routes) >= maxRoutes || status == response.StatusNotFound {
+			return otherLabel
+		}
+		m.routes[route] = true
+	}
+	return route
+}
+
+// Handler serves the metrics of reg in the text exposition format
+func Handler(reg *Registry) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		var body bytes.Buffer
+		reg.WriteTo(&body)
+		h := headers.NewHeaders()
+		h.Override("Content-Type", ContentType)
+		w.WriteResponse(response.StatusOK, h, body.Bytes())
+	}
+}
+
+// Expose returns middleware that answers requests for path with the
+// metrics of reg and passes everything else on
+func Expose(reg *Registry, path string) server.Middleware {
+	serveMetrics := Handler(reg)
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			target, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+			if target == path {
+				serveMetrics(w, req)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// RegisterServer registers the connection counters of srv with reg, read
+// from srv.Stats whenever the metrics are written out
+func RegisterServer(reg *Registry, srv *server.Server) {
+	counter := func(name, help string, value func(server.ConnStats) uint64) {
+		reg.NewCounterFunc(name, help, nil, func() []Sample {
+			return []Sample{{Value: float64(value(srv.Stats()))}}
+		})
+	}
+	reg.NewGaugeFunc("http_connections_active", "Connections open right now.", nil, func() []Sample {
+		return []Sample{{Value: float64(srv.Stats().Active)}}
+	})
+	counter("http_connections_accepted_total", "Connections accepted and handled.",
+		func(s server.ConnStats) uint64 { return s.Accepted })
+	reg.NewCounterFunc("http_connections_rejected_total", "Connections turned away, by the limit they exceeded.",
+		[]string{"reason"}, func() []Sample {
+			stats := srv.Stats()
+			return []Sample{
+				{LabelValues: []string{"max_conns"}, Value: float64(stats.RejectedMaxConns)},
+				{LabelValues: []string{"per_ip"}, Value: float64(stats.RejectedPerIP)},
+			}
+		})
+	counter("http_accept_errors_total", "Failed calls to Accept.",
+		func(s server.ConnStats) uint64 { return s.AcceptErrors })
+	counter("http_connection_requests_total", "HTTP/1.1 requests read off connections.",
+		func(s server.ConnStats) uint64 { return s.Requests })
+	counter("http_keepalive_reused_total", "Requests read off a connection that had already served one.",
+		func(s server.ConnStats) uint64 { return s.KeepAliveReuses })
+	reg.NewCounterFunc("http_parse_errors_total", "Malformed requests, by kind of error.",
+		[]string{"kind"}, func() []Sample {
+			var samples []Sample
+			for kind, n := range srv.Stats().ParseErrors {
+				samples = append(samples, Sample{LabelValues: []string{kind}, Value: float64(n)})
+			}
+			return samples
+		})
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exposition(t *testing.T, reg *Registry) string {
+	var out bytes.Buffer
+	_, err := reg.WriteTo(&out)
+	require.NoError(t, err)
+	return out.String()
+}
+
+func TestRegistry(t *testing.T) {
+	// Test: Counters and gauges with labels, sorted and escaped
+	reg := NewRegistry()
+	counter := reg.NewCounter("jobs_total", "Jobs run.", "queue")
+	counter.Inc("b")
+	counter.Add(2, "a")
+	counter.Inc(`quo"te\`)
+	gauge := reg.NewGauge("workers", "Workers busy.\nRight now.")
+	gauge.Add(3)
+	gauge.Add(-1)
+	assert.Equal(t, `# HELP jobs_total Jobs run.
+# TYPE jobs_total counter
+jobs_total{queue="a"} 2
+jobs_total{queue="b"} 1
+jobs_total{queue="quo\"te\\"} 1
+# HELP workers Workers busy.\nRight now.
+# TYPE workers gauge
+workers 2
+`, exposition(t, reg))
+
+	// Test: Histogram buckets are cumulative, with +Inf, sum and count
+	reg = NewRegistry()
+	histogram := reg.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	histogram.Observe(0.05, "read")
+	histogram.Observe(0.1, "read")
+	histogram.Observe(0.5, "read")
+	histogram.Observe(3, "read")
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="read",le="0.1"} 2
+latency_seconds_bucket{op="read",le="1"} 3
+latency_seconds_bucket{op="read",le="+Inf"} 4
+latency_seconds_sum{op="read"} 3.65
+latency_seconds_count{op="read"} 4
+`, exposition(t, reg))
+
+	// Test: Function collectors are read at exposition time
+	reg = NewRegistry()
+	n := 1.0
+	reg.NewGaugeFunc("queued", "Queued.", []string{"kind"}, func() []Sample {
+		return []Sample{{LabelValues: []string{"y"}, Value: n}, {LabelValues: []string{"x"}, Value: 2 * n}}
+	})
+	n = 5
+	assert.Contains(t, exposition(t, reg), "queued{kind=\"x\"} 10\nqueued{kind=\"y\"} 5\n")
+
+	// Test: Misuse panics
+	assert.Panics(t, func() { reg.NewCounter("queued", "Again.") })
+	assert.Panics(t, func() { counter.Inc() })
+	assert.Panics(t, func() { counter.Add(-1, "a") })
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := NewRegistry()
+	m := NewHTTPMetrics(reg)
+	m.MaxRoutes = 2
+	handler := Expose(reg, "/metrics")(m.Middleware(func(w *response.Writer, req *request.Request) {
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/missing") {
+			w.WriteError(response.StatusNotFound, nil)
+			return
+		}
+		w.WriteResponse(response.StatusOK, nil, []byte("hello"))
+	}))
+	serve := func(method, target string, body string) string {
+		var out bytes.Buffer
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+			Body:        []byte(body),
+		}
+		handler(response.NewWriter(&out), req)
+		return out.String()
+	}
+
+	serve("GET", "/missing/1", "")
+	serve("GET", "/missing/2", "")
+	serve("GET", "/a?x=1", "")
+	serve("GET", "/a", "")
+	serve("POST", "/b", "twelve bytes")
+	serve("BREW", "/c", "")
+	serve("GET", "/d", "")
+
+	// Test: The metrics path serves the exposition format
+	out := serve("GET", "/metrics", "")
+	require.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: "+ContentType+"\r\n")
+
+	// Test: Requests are counted by method, route and status, ignoring the query
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/a",status="200"} 2`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",route="/b",status="200"} 1`+"\n")
+
+	// Test: Unknown methods and routes beyond MaxRoutes are counted as other
+	assert.Contains(t, out, `http_requests_total{method="other",route="other",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 1`+"\n")
+
+	// Test: Paths that aren't found don't use up the routes
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="404"} 2`+"\n")
+
+	// Test: Body sizes and latency are recorded
+	assert.Contains(t, out, `http_request_size_bytes_sum{method="POST",route="/b",status="200"} 12`+"\n")
+	assert.Contains(t, out, `http_response_size_bytes_sum{method="GET",route="/a",status="200"} 10`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/a",status="200"} 2`+"\n")
+	assert.Contains(t, out, "http_requests_in_flight 0\n")
+}
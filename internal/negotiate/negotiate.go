@@ -0,0 +1,232 @@
+// Package negotiate picks which of the representations a server offers suits
+// a client best, going by its Accept, Accept-Language and Accept-Charset
+// headers (RFC 9110 section 12).
+package negotiate
+
+import (
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+)
+
+// Preference is one element of an Accept-style header: a value such as a
+// media range or language range, its parameters and its weight
+type Preference struct {
+	Value string
+	// Params holds the parameters before the weight, used by media ranges
+	Params map[string]string
+	// Q is the weight from 0 (not acceptable) to 1, 1 when not given
+	Q float64
+}
+
+// ParsePreferences parses an Accept-style header value. Elements with an
+// invalid weight are left out.
+func ParsePreferences(value string) []Preference {
+	var prefs []Preference
+	for _, element := range headers.SplitList(value) {
+		parts := strings.Split(element, ";")
+		pref := Preference{Value: strings.ToLower(strings.TrimSpace(parts[0])), Q: 1}
+		valid := true
+		for _, param := range parts[1:] {
+			name, val, _ := strings.Cut(param, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+			if name == "q" {
+				q, ok := parseQ(val)
+				if !ok {
+					valid = false
+				}
+				pref.Q = q
+				// Anything after the weight is an extension, not a parameter
+				break
+			}
+			if name != "" {
+				if pref.Params == nil {
+					pref.Params = make(map[string]string)
+				}
+				pref.Params[name] = val
+			}
+		}
+		if valid && pref.Value != "" {
+			prefs = append(prefs, pref)
+		}
+	}
+	return prefs
+}
+
+// parseQ parses a weight: 0 or 1 with up to three decimals
+func parseQ(value string) (float64, bool) {
+	if value == "" || len(value) > 5 || (value[0] != '0' && value[0] != '1') {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(value, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// matcher reports how specifically a range from the client matches an
+// offer, with -1 meaning not at all
+type matcher func(pref Preference, offer string) int
+
+// best returns the offer the client prefers, or false if none is
+// acceptable. An empty or missing header accepts everything. Each offer is
+// weighted by the most specific range that matches it, and ties go to the
+// offer listed first.
+func best(header string, offers []string, match matcher) (string, bool) {
+	prefs := ParsePreferences(header)
+	if len(prefs) == 0 {
+		return offers[0], true
+	}
+	bestOffer, bestQ := "", 0.0
+	for _, offer := range offers {
+		specificity, q := -1, 0.0
+		for _, pref := range prefs {
+			if s := match(pref, offer); s > specificity {
+				specificity, q = s, pref.Q
+			}
+		}
+		if q > bestQ {
+			bestOffer, bestQ = offer, q
+		}
+	}
+	return bestOffer, bestQ > 0
+}
+
+// matchMediaType matches media ranges: type/subtype beats type/* which
+// beats */*, and a range with parameters only matches offers that have them
+func matchMediaType(pref Preference, offer string) int {
+	m, err := headers.ParseMediaType(offer)
+	if err != nil {
+		return -1
+	}
+	typ, subtype, _ := strings.Cut(pref.Value, "/")
+	switch {
+	case typ == "*" && subtype == "*":
+		return 0
+	case typ != m.Type:
+		return -1
+	case subtype == "*":
+		return 1
+	case subtype != m.Subtype:
+		return -1
+	}
+	for name, value := range pref.Params {
+		if !strings.EqualFold(m.Params[name], value) {
+			return -1
+		}
+	}
+	return 2 + len(pref.Params)
+}
+
+// matchLanguage matches language ranges by prefix as in RFC 4647 basic
+// filtering, so en matches en-US; longer ranges are more specific
+func matchLanguage(pref Preference, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case pref.Value == "*":
+		return 0
+	case offer == pref.Value || strings.HasPrefix(offer, pref.Value+"-"):
+		return len(pref.Value)
+	}
+	return -1
+}
+
+// matchCharset matches charsets exactly, or any with *
+func matchCharset(pref Preference, offer string) int {
+	switch {
+	case pref.Value == "*":
+		return 0
+	case strings.EqualFold(pref.Value, offer):
+		return 1
+	}
+	return -1
+}
+
+// Result is the representation chosen for a request. Fields for dimensions
+// the server doesn't offer choices in are empty.
+type Result struct {
+	Type     string
+	Language string
+	Charset  string
+}
+
+// Negotiator chooses among the representations a server offers. Each list
+// holds what is on offer in one dimension, the server's favourite first;
+// empty lists aren't negotiated.
+type Negotiator struct {
+	Types     []string
+	Languages []string
+	Charsets  []string
+	// Default is used in the dimensions where the client accepts none of
+	// the offers, instead of answering 406 Not Acceptable. Leave a field
+	// empty to insist on the client's preferences there.
+	Default Result
+}
+
+// Negotiate picks the representation for req. It reports false if the
+// client accepts none of the offers in some dimension without a default.
+func (n *Negotiator) Negotiate(req *request.Request) (Result, bool) {
+	var result Result
+	ok := true
+	choose := func(field *string, header string, offers []string, match matcher, fallback string) {
+		if len(offers) == 0 {
+			return
+		}
+		choice, found := best(req.Headers.Get(header), offers, match)
+		if !found {
+			choice, found = fallback, fallback != ""
+		}
+		*field = choice
+		ok = ok && found
+	}
+	choose(&result.Type, "Accept", n.Types, matchMediaType, n.Default.Type)
+	choose(&result.Language, "Accept-Language", n.Languages, matchLanguage, n.Default.Language)
+	choose(&result.Charset, "Accept-Charset", n.Charsets, matchCharset, n.Default.Charset)
+	return result, ok
+}
+
+// Vary lists the request headers the choice depends on, for the Vary header
+func (n *Negotiator) Vary() []string {
+	var vary []string
+	if len(n.Types) > 1 {
+		vary = append(vary, "Accept")
+	}
+	if len(n.Languages) > 1 {
+		vary = append(vary, "Accept-Language")
+	}
+	if len(n.Charsets) > 1 {
+		vary = append(vary, "Accept-Charset")
+	}
+	return vary
+}
+
+// Apply negotiates the representation for req and adds the matching Vary
+// to w's headers. If nothing acceptable is on offer it answers 406 Not
+// Acceptable and reports false, leaving nothing more for the handler to do.
+func (n *Negotiator) Apply(w *response.Writer, req *request.Request) (Result, bool) {
+	if vary := n.Vary(); len(vary) > 0 {
+		h := w.Header()
+		for _, name := range vary {
+			if !headers.HasToken(h.Get("Vary"), name) {
+				h.Set("Vary", name)
+			}
+		}
+	}
+	result, ok := n.Negotiate(req)
+	if !ok {
+		w.WriteError(response.StatusNotAcceptable, nil)
+	}
+	return result, ok
+}
+
+// ContentType formats the negotiated media type with the negotiated charset
+func (r Result) ContentType() string {
+	if r.Charset == "" {
+		return r.Type
+	}
+	return r.Type + "; charset=" + r.Charset
+}
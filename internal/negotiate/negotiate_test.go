@@ -0,0 +1,159 @@
+package negotiate
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(pairs ...string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders()}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		req.Headers.Set(pairs[i], pairs[i+1])
+	}
+	return req
+}
+
+func TestParsePreferences(t *testing.T) {
+	// Test: Weights default to 1 and parameters before q are kept
+	prefs := ParsePreferences(`text/html;level=1, text/*;q=0.5, */*;q=0;ext=1`)
+	require.Len(t, prefs, 3)
+	assert.Equal(t, "text/html", prefs[0].Value)
+	assert.Equal(t, map[string]string{"level": "1"}, prefs[0].Params)
+	assert.Equal(t, 1.0, prefs[0].Q)
+	assert.Equal(t, 0.5, prefs[1].Q)
+	assert.Equal(t, 0.0, prefs[2].Q)
+	assert.Nil(t, prefs[2].Params)
+
+	// Test: Invalid weights drop the element
+	prefs = ParsePreferences("en;q=2, fr;q=0.1234, de;q=abc, es;q=0.8")
+	require.Len(t, prefs, 1)
+	assert.Equal(t, "es", prefs[0].Value)
+
+	// Test: Empty values give no preferences
+	assert.Empty(t, ParsePreferences(""))
+	assert.Empty(t, ParsePreferences(" , "))
+}
+
+func TestNegotiateTypes(t *testing.T) {
+	n := &Negotiator{Types: []string{"application/json", "text/html", "text/plain"}}
+
+	cases := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		// Test: Without Accept the server's favourite is chosen
+		{"", "application/json", true},
+		// Test: Exact matches win over wildcards
+		{"text/html, */*;q=0.1", "text/html", true},
+		// Test: The most specific range sets an offer's weight
+		{"text/*;q=0.9, text/plain;q=0.2, application/json;q=0.5", "text/html", true},
+		// Test: Ties go to server order
+		{"text/plain, text/html", "text/html", true},
+		// Test: q=0 rules an offer out even if a wildcard accepts it
+		{"*/*, application/json;q=0", "text/html", true},
+		// Test: Parameters must match the offer
+		{"text/html;level=1", "", false},
+		// Test: Nothing acceptable
+		{"image/png", "", false},
+		{"*/*;q=0", "", false},
+	}
+	for _, tc := range cases {
+		result, ok := n.Negotiate(newRequest("Accept", tc.accept))
+		assert.Equal(t, tc.ok, ok, tc.accept)
+		if tc.ok {
+			assert.Equal(t, tc.want, result.Type, tc.accept)
+		}
+	}
+
+	// Test: Parameterised ranges match offers with those parameters
+	n = &Negotiator{Types: []string{"text/html", "text/html;level=1"}}
+	result, ok := n.Negotiate(newRequest("Accept", "text/html;level=1, text/html;q=0.5"))
+	require.True(t, ok)
+	assert.Equal(t, "text/html;level=1", result.Type)
+}
+
+func TestNegotiateLanguagesAndCharsets(t *testing.T) {
+	n := &Negotiator{
+		Languages: []string{"en-US", "fr", "de-CH"},
+		Charsets:  []string{"utf-8", "iso-8859-1"},
+	}
+
+	// Test: Language ranges match by prefix, case-insensitively
+	result, ok := n.Negotiate(newRequest("Accept-Language", "DE;q=0.8, fr;q=0.5"))
+	require.True(t, ok)
+	assert.Equal(t, "de-CH", result.Language)
+
+	// Test: Longer ranges are more specific than shorter ones
+	result, ok = n.Negotiate(newRequest("Accept-Language", "en;q=0.1, en-us, fr;q=0.5"))
+	require.True(t, ok)
+	assert.Equal(t, "en-US", result.Language)
+
+	// Test: * matches any language not otherwise listed
+	result, ok = n.Negotiate(newRequest("Accept-Language", "en-US;q=0, *"))
+	require.True(t, ok)
+	assert.Equal(t, "fr", result.Language)
+
+	// Test: Charsets match exactly
+	result, ok = n.Negotiate(newRequest("Accept-Charset", "ISO-8859-1, utf-8;q=0.5"))
+	require.True(t, ok)
+	assert.Equal(t, "iso-8859-1", result.Charset)
+
+	// Test: A prefix isn't enough for charsets
+	_, ok = n.Negotiate(newRequest("Accept-Charset", "utf"))
+	assert.False(t, ok)
+
+	// Test: Dimensions without offers aren't negotiated
+	result, ok = n.Negotiate(newRequest("Accept", "image/png"))
+	require.True(t, ok)
+	assert.Empty(t, result.Type)
+}
+
+func TestNegotiateDefault(t *testing.T) {
+	n := &Negotiator{
+		Types:     []string{"application/json", "text/html"},
+		Languages: []string{"en", "fr"},
+		Default:   Result{Type: "application/json"},
+	}
+
+	// Test: The default stands in when nothing matches
+	result, ok := n.Negotiate(newRequest("Accept", "image/png"))
+	require.True(t, ok)
+	assert.Equal(t, "application/json", result.Type)
+
+	// Test: Dimensions without a default still fail
+	_, ok = n.Negotiate(newRequest("Accept-Language", "de"))
+	assert.False(t, ok)
+}
+
+func TestApply(t *testing.T) {
+	n := &Negotiator{
+		Types:    []string{"application/json", "text/html"},
+		Charsets: []string{"utf-8"},
+	}
+
+	// Test: Vary lists the headers with a choice and is added to the response
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	w.Header().Override("Vary", "Origin")
+	result, ok := n.Apply(w, newRequest("Accept", "text/html"))
+	require.True(t, ok)
+	assert.Equal(t, "text/html; charset=utf-8", result.ContentType())
+	require.NoError(t, w.WriteResponse(response.StatusOK, nil, []byte("ok")))
+	assert.Contains(t, out.String(), "vary: Origin, Accept\r\n")
+
+	// Test: Nothing acceptable answers 406
+	out.Reset()
+	w = response.NewWriter(&out)
+	_, ok = n.Apply(w, newRequest("Accept", "image/png"))
+	assert.False(t, ok)
+	assert.Equal(t, response.StatusNotAcceptable, w.Status())
+	assert.Contains(t, out.String(), "HTTP/1.1 406 Not Acceptable\r\n")
+	assert.Contains(t, out.String(), "vary: Accept\r\n")
+}
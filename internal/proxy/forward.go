@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/trace"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDestinationDenied is returned when the access rules reject every address of a destination
+var errDestinationDenied = errors.New("destination not allowed")
+
+// SpecialPurposeNetworks are the loopback, private, link-local and other
+// special-purpose address blocks (RFC 6890) that a forward proxy reachable
+// from the internet should deny. 0.0.0.0/8 and :: are among them because
+// connecting to them reaches the local host.
+var SpecialPurposeNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// ForwardProxy lets clients reach arbitrary destinations through this server,
+// either by sending absolute-form requests or by tunneling with CONNECT
+type ForwardProxy struct {
+	// Allow, if not empty, restricts destinations to those matching a rule.
+	// Rules are "host", "*.domain", "host:port", "*.domain:port" or a CIDR
+	// such as "10.0.0.0/8". Deny rules take precedence over Allow rules.
+	Allow []string
+	Deny  []string
+	// Credentials maps usernames to passwords for Proxy-Authorization basic
+	// auth. When empty no authentication is required.
+	Credentials map[string]string
+	// Realm is sent in the Proxy-Authenticate challenge
+	Realm string
+	// DialTimeout bounds connecting to the destination
+	DialTimeout time.Duration
+	// ResponseTimeout bounds waiting for response headers on forwarded requests
+	ResponseTimeout time.Duration
+}
+
+// NewForwardProxy creates an open forward proxy with the default timeouts
+func NewForwardProxy() *ForwardProxy {
+	return &ForwardProxy{
+		Realm:           "httpfromtcp",
+		DialTimeout:     DefaultDialTimeout,
+		ResponseTimeout: DefaultResponseTimeout,
+	}
+}
+
+// IsForwardProxyRequest reports whether a request is addressed to a forward
+// proxy rather than to this server: a CONNECT or an absolute-form target
+func IsForwardProxyRequest(req *request.Request) bool {
+	target := req.RequestLine.RequestTarget
+	return req.RequestLine.Method == "CONNECT" ||
+		strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// Handle serves a forward proxy request. It has the same shape as server.Handler.
+func (f *ForwardProxy) Handle(w *response.Writer, req *request.Request) {
+	if !f.authorized(req) {
+		challenge := headers.NewHeaders()
+		challenge.Override("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", f.Realm))
+		w.WriteError(response.StatusProxyAuthRequired, challenge)
+		return
+	}
+
+	if req.RequestLine.Method == "CONNECT" {
+		f.handleConnect(w, req)
+		return
+	}
+	f.handleForward(w, req)
+}
+
+// authorized checks the Proxy-Authorization header against Credentials
+func (f *ForwardProxy) authorized(req *request.Request) bool {
+	if len(f.Credentials) == 0 {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	expected, known := f.Credentials[username]
+	// Compare even for unknown users so timing doesn't reveal which names exist
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return known && match
+}
+
+// handleConnect opens a tunnel to the authority-form target and splices bytes
+// between it and the client until either side closes
+func (f *ForwardProxy) handleConnect(w *response.Writer, req *request.Request) {
+	host, port, err := net.SplitHostPort(req.RequestLine.RequestTarget)
+	if err != nil || host == "" || port == "" {
+		w.WriteError(response.StatusBadRequest, nil)
+		return
+	}
+
+	upstream, err := f.dial(net.JoinHostPort(host, port), f.DialTimeout)
+	if err != nil {
+		writeDialError(w, err)
+		return
+	}
+	defer upstream.Close()
+
+	// After the 200 the connection is a raw byte pipe
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(headers.NewHeaders())
+	clientConn, buffered, err := w.Hijack()
+	if err != nil {
+		return
+	}
+	defer clientConn.Close()
+	// Tear the tunnel down if the server gives up on it
+	stop := context.AfterFunc(req.Context(), func() {
+		clientConn.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	// The client may have started talking before it saw our 200
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+	splice(clientConn, upstream)
+}
+
+// handleForward relays an absolute-form request to its destination
+func (f *ForwardProxy) handleForward(w *response.Writer, req *request.Request) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		w.WriteError(response.StatusBadRequest, nil)
+		return
+	}
+
+	outHeaders := headers.NewHeaders()
+	for key, value := range req.Headers {
+		outHeaders.Override(key, value)
+	}
+	removeHopHeaders(outHeaders)
+	outHeaders.Set("Via", viaPseudonym)
+	outHeaders.Override("Host", target.Host)
+
+	// The destination continues the trace from a span of our own
+	ctx, span := trace.Start(req.Context(), req.RequestLine.Method+" "+target.Host, trace.KindClient)
+	defer span.Finish()
+	span.SetAttribute("server.address", target.Host)
+	trace.Inject(ctx, outHeaders)
+	if req.ID != "" {
+		outHeaders.Override(request.IDHeader, req.ID)
+	}
+
+	outReq := &request.Request{
+		RequestLine: req.RequestLine,
+		Headers:     outHeaders,
+		Body:        req.Body,
+	}
+	outReq = outReq.WithContext(ctx)
+	destinationClient := &client.Client{
+		DialTimeout:           f.DialTimeout,
+		ResponseHeaderTimeout: f.ResponseTimeout,
+		Dial:                  f.dial,
+	}
+	resp, err := destinationClient.Do(outReq)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		writeDialError(w, err)
+		return
+	}
+	defer resp.Close()
+	span.SetAttribute("http.status_code", int(resp.StatusLine.StatusCode))
+
+	copyResponse(w, resp.Response, req.RequestLine.Method)
+}
+
+// dial resolves addr, checks every candidate address against the access rules
+// and connects to the first allowed one. Checking resolved addresses stops a
+// hostname that points at a denied network from slipping through.
+func (f *ForwardProxy) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	allowed, byName := f.allowedHost(host, port)
+	if !allowed {
+		return nil, errDestinationDenied
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	lastErr := errDestinationDenied
+	for _, ip := range ips {
+		if !f.allowedIP(ip.IP, port, byName) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// allowedHost applies the name based rules to a destination. byName is false
+// when the decision has to wait for the resolved address to meet a CIDR rule.
+func (f *ForwardProxy) allowedHost(host, port string) (allowed, byName bool) {
+	for _, rule := range f.Deny {
+		if matchHostRule(rule, host, port) {
+			return false, true
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true, true
+	}
+	for _, rule := range f.Allow {
+		if matchHostRule(rule, host, port) {
+			return true, true
+		}
+	}
+	return hasCIDRRule(f.Allow), false
+}
+
+// allowedIP applies the address based rules to a resolved destination
+func (f *ForwardProxy) allowedIP(ip net.IP, port string, allowedByName bool) bool {
+	for _, rule := range f.Deny {
+		if matchIPRule(rule, ip) || matchHostRule(rule, ip.String(), port) {
+			return false
+		}
+	}
+	if allowedByName {
+		return true
+	}
+	for _, rule := range f.Allow {
+		if matchIPRule(rule, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostRule matches "host", "*.domain" and their ":port" variants
+func matchHostRule(rule, host, port string) bool {
+	if strings.Contains(rule, "/") {
+		return false
+	}
+	ruleHost, rulePort := rule, ""
+	if h, p, err := net.SplitHostPort(rule); err == nil {
+		ruleHost, rulePort = h, p
+	}
+	if rulePort != "" && rulePort != port {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ruleHost = strings.ToLower(ruleHost)
+	if suffix, ok := strings.CutPrefix(ruleHost, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == ruleHost
+}
+
+// matchIPRule matches CIDR rules
+func matchIPRule(rule string, ip net.IP) bool {
+	_, network, err := net.ParseCIDR(rule)
+	return err == nil && network.Contains(ip)
+}
+
+func hasCIDRRule(rules []string) bool {
+	for _, rule := range rules {
+		if strings.Contains(rule, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDialError maps a failure reaching the destination to a response
+func writeDialError(w *response.Writer, err error) {
+	if errors.Is(err, errDestinationDenied) {
+		w.WriteError(response.StatusForbidden, nil)
+		return
+	}
+	writeUpstreamError(w, err)
+}
+
+// splice copies bytes both ways between two connections until both directions are done
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		closeWrite(a)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		closeWrite(b)
+	}()
+	wg.Wait()
+}
+
+// closeWrite signals EOF to the peer while still allowing reads, if the connection supports it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardProxy(t *testing.T) {
+	backend := startBackend(t, "origin", 200)
+
+	// Test: Absolute-form requests are forwarded to their destination
+	f := NewForwardProxy()
+	req := newGetRequest(backend + "/page")
+	req.Headers.Set("Proxy-Connection", "keep-alive")
+	assert.True(t, IsForwardProxyRequest(req))
+	assert.Equal(t, "origin", forwardBody(t, f, req))
+
+	// Test: Origin-form requests aren't proxy requests
+	assert.False(t, IsForwardProxyRequest(newGetRequest("/page")))
+
+	// Test: Missing credentials get a 407 challenge
+	f = NewForwardProxy()
+	f.Credentials = map[string]string{"alice": "secret"}
+	resp := forwardRequest(t, f, newGetRequest(backend+"/"))
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+	assert.Equal(t, `Basic realm="httpfromtcp"`, resp.Headers.Get("Proxy-Authenticate"))
+
+	// Test: Wrong password is rejected
+	req = newGetRequest(backend + "/")
+	req.Headers.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wrong")))
+	resp = forwardRequest(t, f, req)
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+
+	// Test: Valid credentials are accepted
+	req = newGetRequest(backend + "/")
+	req.Headers.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	assert.Equal(t, "origin", forwardBody(t, f, req))
+
+	// Test: Denied networks are refused, even when reached through a hostname
+	f = NewForwardProxy()
+	f.Deny = []string{"127.0.0.0/8"}
+	resp = forwardRequest(t, f, newGetRequest(backend+"/"))
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	resp = forwardRequest(t, f, newGetRequest(strings.Replace(backend, "127.0.0.1", "localhost", 1)+"/"))
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+
+	// Test: 0.0.0.0 reaches the local host, so it is denied with the other special-purpose networks
+	f = NewForwardProxy()
+	f.Deny = SpecialPurposeNetworks
+	resp = forwardRequest(t, f, newGetRequest(strings.Replace(backend, "127.0.0.1", "0.0.0.0", 1)+"/"))
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	assert.Equal(t, "origin", forwardBody(t, NewForwardProxy(), newGetRequest(strings.Replace(backend, "127.0.0.1", "0.0.0.0", 1)+"/")))
+
+	// Test: Destinations outside the allow list are refused
+	f = NewForwardProxy()
+	f.Allow = []string{"*.example.com:443"}
+	resp = forwardRequest(t, f, newGetRequest(backend+"/"))
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	// An upstream that echoes whatever it receives
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// Test: CONNECT answers 200, forwards bytes the client sent early and then tunnels both ways
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	req := newGetRequest(listener.Addr().String())
+	req.RequestLine.Method = "CONNECT"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := response.NewHijackableWriter(serverSide, func() (net.Conn, []byte, error) {
+			return serverSide, []byte("early"), nil
+		})
+		NewForwardProxy().Handle(w, req)
+	}()
+
+	reader := bufio.NewReader(clientSide)
+	statusLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	blank, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", blank)
+
+	_, err = clientSide.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 9)
+	_, err = io.ReadFull(reader, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "earlyping", string(echoed))
+
+	clientSide.Close()
+	<-done
+
+	// Test: CONNECT to a denied port is refused before tunneling
+	f := NewForwardProxy()
+	f.Allow = []string{"127.0.0.1:1"}
+	req = newGetRequest(listener.Addr().String())
+	req.RequestLine.Method = "CONNECT"
+	resp := forwardRequest(t, f, req)
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+
+	// Test: Targets without a port are malformed
+	req = newGetRequest("example.com")
+	req.RequestLine.Method = "CONNECT"
+	resp = forwardRequest(t, f, req)
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+
+	// Test: 0.0.0.0 reaches the local host, so it is denied with the other special-purpose networks
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	f = NewForwardProxy()
+	f.Deny = SpecialPurposeNetworks
+	req = newGetRequest(net.JoinHostPort("0.0.0.0", port))
+	req.RequestLine.Method = "CONNECT"
+	resp = forwardRequest(t, f, req)
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+}
+
+func forwardRequest(t *testing.T, f *ForwardProxy, req *request.Request) *response.Response {
+	t.Helper()
+	pr, pw := io.Pipe()
+	go func() {
+		f.Handle(response.NewWriter(pw), req)
+		pw.Close()
+	}()
+	resp, err := response.ResponseFromReader(pr, req.RequestLine.Method)
+	require.NoError(t, err)
+	return resp
+}
+
+func forwardBody(t *testing.T, f *ForwardProxy, req *request.Request) string {
+	t.Helper()
+	body, err := io.ReadAll(forwardRequest(t, f, req).Body)
+	require.NoError(t, err)
+	return string(body)
+}
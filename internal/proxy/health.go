@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"httpfromtcp/internal/client"
+	"sync"
+	"time"
+)
+
+// HealthCheckType selects how a backend is probed
+type HealthCheckType int
+
+const (
+	// HealthCheckTCP only checks that a connection can be opened
+	HealthCheckTCP HealthCheckType = iota
+	// HealthCheckHTTP sends a GET and expects a 2xx or 3xx status
+	HealthCheckHTTP
+)
+
+// Defaults for active health checks
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// HealthCheck configures active probing of a pool's backends
+type HealthCheck struct {
+	Type HealthCheckType
+	// Path is requested by HTTP checks, defaulting to "/"
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// StartHealthChecks probes every backend once and then keeps probing on the
+// health check interval until Stop is called. It does nothing if the pool has
+// no HealthCheck or checks were already started.
+func (p *Pool) StartHealthChecks() {
+	if p.HealthCheck == nil || !p.started.CompareAndSwap(false, true) {
+		return
+	}
+	stop := p.stopChan()
+	interval := p.HealthCheck.Interval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	p.CheckHealth()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.CheckHealth()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends background health checks
+func (p *Pool) Stop() {
+	stop := p.stopChan()
+	p.stopOnce.Do(func() { close(stop) })
+}
+
+// stopChan returns the channel Stop closes, making it on first use so pools
+// not built by NewPool work too
+func (p *Pool) stopChan() chan struct{} {
+	p.initOnce.Do(func() { p.stop = make(chan struct{}) })
+	return p.stop
+}
+
+// CheckHealth probes every backend concurrently and marks each one up or down
+func (p *Pool) CheckHealth() {
+	if p.HealthCheck == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, b := range p.Backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			err := p.HealthCheck.probe(b)
+			b.down.Store(err != nil)
+			if err == nil {
+				// A backend that passes an active check is trusted again straight away
+				b.ejectedUntil.Store(0)
+				b.failures.Store(0)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// probe runs a single check against a backend
+func (hc *HealthCheck) probe(b *Backend) error {
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	if hc.Type == HealthCheckTCP {
+		conn, err := client.Dial(b.URL, timeout, nil)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := hc.Path
+	if path == "" {
+		path = "/"
+	}
+	probeURL, err := b.URL.Parse(path)
+	if err != nil {
+		return err
+	}
+	probeClient := &client.Client{Timeout: timeout, DialTimeout: timeout}
+	resp, err := probeClient.Get(probeURL.String())
+	if err != nil {
+		return err
+	}
+	resp.Close()
+	if code := resp.StatusLine.StatusCode; code < 200 || code >= 400 {
+		return fmt.Errorf("health check got status %d", code)
+	}
+	return nil
+}
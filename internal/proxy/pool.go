@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for passive ejection when a Pool doesn't set its own
+const (
+	DefaultMaxFails      = 3
+	DefaultEjectDuration = 30 * time.Second
+)
+
+// Backend is a single upstream server in a pool
+type Backend struct {
+	URL *url.URL
+
+	// down is set by active health checks
+	down atomic.Bool
+	// ejectedUntil is set by passive ejection, as unix nanoseconds
+	ejectedUntil atomic.Int64
+	// failures counts consecutive failed requests
+	failures atomic.Int64
+	active   atomic.Int64
+}
+
+// Available reports whether the backend should receive traffic
+func (b *Backend) Available() bool {
+	return !b.down.Load() && time.Now().UnixNano() >= b.ejectedUntil.Load()
+}
+
+// ActiveConnections returns the number of requests currently in flight to the backend
+func (b *Backend) ActiveConnections() int64 {
+	return b.active.Load()
+}
+
+// Balancer chooses which of the candidate backends serves a request.
+// candidates is never empty and only contains available backends.
+type Balancer interface {
+	Pick(candidates []*Backend, req *request.Request) *Backend
+}
+
+// RoundRobin cycles through the backends in order
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (r *RoundRobin) Pick(candidates []*Backend, req *request.Request) *Backend {
+	n := r.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// LeastConnections picks the backend with the fewest requests in flight,
+// preferring the earliest one on ties
+type LeastConnections struct{}
+
+func (LeastConnections) Pick(candidates []*Backend, req *request.Request) *Backend {
+	best := candidates[0]
+	for _, b := range candidates[1:] {
+		if b.ActiveConnections() < best.ActiveConnections() {
+			best = b
+		}
+	}
+	return best
+}
+
+// ConsistentHash sends requests with the same key to the same backend, and
+// only remaps the keys of a backend that leaves the pool. The key is the
+// value of Header, or the client IP when Header is empty or missing.
+type ConsistentHash struct {
+	Header string
+}
+
+func (c ConsistentHash) Pick(candidates []*Backend, req *request.Request) *Backend {
+	key := ""
+	if c.Header != "" {
+		key = req.Headers.Get(c.Header)
+	}
+	if key == "" {
+		key = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			key = host
+		}
+	}
+
+	// Rendezvous hashing: every backend scores the key and the highest wins
+	var best *Backend
+	var bestScore uint64
+	for _, b := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(b.URL.String()))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// Pool is a named group of interchangeable backends
+type Pool struct {
+	Name     string
+	Backends []*Backend
+	Balancer Balancer
+	// MaxFails consecutive failed requests eject a backend for EjectDuration.
+	// Requests fail when the backend can't be reached or answers with a 5xx.
+	MaxFails      int
+	EjectDuration time.Duration
+	// MaxRetries is how many other backends an idempotent request is retried on
+	MaxRetries int
+	// HealthCheck, if set, is run by StartHealthChecks
+	HealthCheck *HealthCheck
+
+	started  atomic.Bool
+	initOnce sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewPool creates a pool from a list of upstream base URLs. A nil balancer
+// defaults to round-robin.
+func NewPool(name string, upstreams []string, balancer Balancer) (*Pool, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("pool %s has no upstreams", name)
+	}
+	if balancer == nil {
+		balancer = &RoundRobin{}
+	}
+
+	pool := &Pool{
+		Name:          name,
+		Balancer:      balancer,
+		MaxFails:      DefaultMaxFails,
+		EjectDuration: DefaultEjectDuration,
+		MaxRetries:    len(upstreams) - 1,
+	}
+	for _, upstream := range upstreams {
+		upstreamURL, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		pool.Backends = append(pool.Backends, &Backend{URL: upstreamURL})
+	}
+	return pool, nil
+}
+
+// Pick chooses an available backend for req, skipping any in tried.
+// It returns nil when no backend is left.
+func (p *Pool) Pick(req *request.Request, tried map[*Backend]bool) *Backend {
+	var candidates []*Backend
+	for _, b := range p.Backends {
+		if b.Available() && !tried[b] {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return p.Balancer.Pick(candidates, req)
+}
+
+// recordFailure counts a failed request and ejects the backend once it has
+// failed MaxFails times in a row
+func (p *Pool) recordFailure(b *Backend) {
+	if p.MaxFails > 0 && b.failures.Add(1) >= int64(p.MaxFails) {
+		b.ejectedUntil.Store(time.Now().Add(p.EjectDuration).UnixNano())
+		b.failures.Store(0)
+	}
+}
+
+func (p *Pool) recordSuccess(b *Backend) {
+	b.failures.Store(0)
+}
+
+// idempotentMethods can be safely sent again after a failure (RFC 9110 section 9.2.2)
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// handlePool proxies a request to a backend chosen from the pool, retrying
+// idempotent requests on other backends if the chosen one fails
+func (p *ReverseProxy) handlePool(w *response.Writer, req *request.Request) {
+	tried := map[*Backend]bool{}
+	attempts := 1
+	if idempotentMethods[req.RequestLine.Method] {
+		attempts += p.Pool.MaxRetries
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		backend := p.Pool.Pick(req, tried)
+		if backend == nil {
+			break
+		}
+		tried[backend] = true
+
+		backend.active.Add(1)
+		upstreamResp, err := p.roundTrip(backend.URL, req)
+		if err != nil {
+			backend.active.Add(-1)
+			if req.Context().Err() != nil {
+				// The client went away, which says nothing about the backend
+				return
+			}
+			p.Pool.recordFailure(backend)
+			lastErr = err
+			continue
+		}
+		if upstreamResp.StatusLine.StatusCode >= 500 {
+			// The answer still goes to the client, but a backend erroring
+			// on every request is as good as down
+			p.Pool.recordFailure(backend)
+		} else {
+			p.Pool.recordSuccess(backend)
+		}
+
+		copyResponse(w, upstreamResp.Response, req.RequestLine.Method)
+		upstreamResp.Close()
+		backend.active.Add(-1)
+		return
+	}
+
+	if lastErr == nil {
+		// Every backend is down, there was nobody to even try
+		w.WriteError(response.StatusServiceUnavailable, nil)
+		return
+	}
+	writeUpstreamError(w, lastErr)
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolBalancing(t *testing.T) {
+	a := startBackend(t, "a", 200)
+	b := startBackend(t, "b", 200)
+	c := startBackend(t, "c", 200)
+
+	// Test: Round-robin cycles through every backend
+	pool, err := NewPool("web", []string{a, b, c}, nil)
+	require.NoError(t, err)
+	p := NewPoolProxy(pool)
+	var served []string
+	for i := 0; i < 4; i++ {
+		served = append(served, proxyBody(t, p, newGetRequest("/")))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a"}, served)
+
+	// Test: Least-connections prefers the idlest backend
+	pool, err = NewPool("web", []string{a, b, c}, LeastConnections{})
+	require.NoError(t, err)
+	pool.Backends[0].active.Store(2)
+	pool.Backends[1].active.Store(1)
+	pool.Backends[2].active.Store(3)
+	assert.Equal(t, pool.Backends[1], pool.Pick(newGetRequest("/"), nil))
+
+	// Test: Consistent hash by header is sticky
+	pool, err = NewPool("web", []string{a, b, c}, ConsistentHash{Header: "X-User"})
+	require.NoError(t, err)
+	p = NewPoolProxy(pool)
+	req := newGetRequest("/")
+	req.Headers.Set("X-User", "alice")
+	first := proxyBody(t, p, req)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, first, proxyBody(t, p, req))
+	}
+
+	// Test: Consistent hash only remaps keys of a backend that goes away
+	pool, err = NewPool("web", []string{a, b, c}, ConsistentHash{})
+	require.NoError(t, err)
+	before := map[string]*Backend{}
+	for i := 0; i < 50; i++ {
+		req := newGetRequest("/")
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:1000", i)
+		before[req.RemoteAddr] = pool.Pick(req, nil)
+	}
+	removed := pool.Backends[0]
+	removed.down.Store(true)
+	for addr, backend := range before {
+		req := newGetRequest("/")
+		req.RemoteAddr = addr
+		if backend != removed {
+			assert.Equal(t, backend, pool.Pick(req, nil))
+		}
+	}
+}
+
+func TestPoolFailures(t *testing.T) {
+	good := startBackend(t, "good", 200)
+	dead := deadAddr(t)
+
+	// Test: Idempotent requests are retried on another backend and failures eject the dead one
+	pool, err := NewPool("api", []string{dead, good}, nil)
+	require.NoError(t, err)
+	pool.MaxFails = 2
+	p := NewPoolProxy(pool)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "good", proxyBody(t, p, newGetRequest("/")))
+	}
+	assert.False(t, pool.Backends[0].Available())
+	assert.True(t, pool.Backends[1].Available())
+
+	// Test: Non-idempotent requests are not retried
+	pool, err = NewPool("api", []string{dead, good}, nil)
+	require.NoError(t, err)
+	p = NewPoolProxy(pool)
+	post := newGetRequest("/")
+	post.RequestLine.Method = "POST"
+	resp := proxyRequest(t, p, post)
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: Backends answering with 5xx are ejected too, the errors still
+	// reaching the client
+	failing := startBackend(t, "failing", 503)
+	pool, err = NewPool("api", []string{failing, good}, &RoundRobin{})
+	require.NoError(t, err)
+	pool.MaxFails = 2
+	pool.MaxRetries = 0
+	p = NewPoolProxy(pool)
+	statuses := map[response.StatusCode]int{}
+	for i := 0; i < 6; i++ {
+		statuses[proxyRequest(t, p, newGetRequest("/")).StatusLine.StatusCode]++
+	}
+	assert.Equal(t, 2, statuses[response.StatusServiceUnavailable])
+	assert.False(t, pool.Backends[0].Available())
+
+	// Test: No available backends is a 503
+	pool, err = NewPool("api", []string{good}, nil)
+	require.NoError(t, err)
+	pool.Backends[0].down.Store(true)
+	resp = proxyRequest(t, NewPoolProxy(pool), newGetRequest("/"))
+	assert.Equal(t, response.StatusServiceUnavailable, resp.StatusLine.StatusCode)
+
+	// Test: Empty pool is rejected
+	_, err = NewPool("empty", nil, nil)
+	require.Error(t, err)
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	healthy := startBackend(t, "healthy", 200)
+	failing := startBackend(t, "failing", 500)
+	dead := deadAddr(t)
+
+	// Test: TCP checks only mark unreachable backends down
+	pool, err := NewPool("checked", []string{healthy, failing, dead}, nil)
+	require.NoError(t, err)
+	pool.HealthCheck = &HealthCheck{Type: HealthCheckTCP, Timeout: time.Second}
+	pool.CheckHealth()
+	assert.True(t, pool.Backends[0].Available())
+	assert.True(t, pool.Backends[1].Available())
+	assert.False(t, pool.Backends[2].Available())
+
+	// Test: HTTP checks also mark error statuses down
+	pool.HealthCheck = &HealthCheck{Type: HealthCheckHTTP, Path: "/healthz", Timeout: time.Second}
+	pool.CheckHealth()
+	assert.True(t, pool.Backends[0].Available())
+	assert.False(t, pool.Backends[1].Available())
+	assert.False(t, pool.Backends[2].Available())
+
+	// Test: A passing check brings an ejected backend back
+	pool.Backends[0].ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	assert.False(t, pool.Backends[0].Available())
+	pool.StartHealthChecks()
+	defer pool.Stop()
+	assert.True(t, pool.Backends[0].Available())
+
+	// Test: Starting twice doesn't start a second checker
+	pool.Backends[0].ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	pool.StartHealthChecks()
+	assert.False(t, pool.Backends[0].Available())
+
+	// Test: Pools not made by NewPool can be stopped
+	(&Pool{}).Stop()
+	unchecked := &Pool{HealthCheck: &HealthCheck{Interval: time.Hour}}
+	unchecked.StartHealthChecks()
+	unchecked.Stop()
+	unchecked.Stop()
+}
+
+// startBackend runs a fake backend that answers every request with its name
+// as the body and the given status
+func startBackend(t *testing.T, name string, status int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := request.RequestFromReader(conn); err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 %d X\r\nContent-Length: %d\r\n\r\n%s", status, len(name), name)
+			}(conn)
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+// deadAddr returns the URL of a port nothing is listening on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return (&url.URL{Scheme: "http", Host: addr}).String()
+}
+
+func proxyBody(t *testing.T, p *ReverseProxy, req *request.Request) string {
+	t.Helper()
+	resp := proxyRequest(t, p, req)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
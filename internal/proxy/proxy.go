@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/trace"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// viaPseudonym identifies this proxy in Via headers
+const viaPseudonym = "1.1 httpfromtcp"
+
+// Default timeouts used when a ReverseProxy doesn't set its own
+const (
+	DefaultDialTimeout     = 10 * time.Second
+	DefaultResponseTimeout = 30 * time.Second
+)
+
+// hopHeaders are connection-specific and must not be forwarded (RFC 9110 section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ReverseProxy forwards requests to an upstream server and streams the
+// upstream response back to the client
+type ReverseProxy struct {
+	// Upstream is the base URL requests are forwarded to. Its path is
+	// prepended to every forwarded request path.
+	Upstream *url.URL
+	// Pool, if set, replaces Upstream with a load balanced set of backends
+	Pool *Pool
+	// StripPrefix is removed from the start of the request path before forwarding
+	StripPrefix string
+	// Rewrite optionally rewrites the outgoing request target once the
+	// prefix has been stripped and the upstream path joined on
+	Rewrite func(target string) string
+	// DialTimeout bounds connecting to the upstream
+	DialTimeout time.Duration
+	// ResponseTimeout bounds waiting for the upstream response headers
+	ResponseTimeout time.Duration
+}
+
+// New creates a reverse proxy for the given upstream base URL
+func New(upstream string) (*ReverseProxy, error) {
+	upstreamURL, err := parseUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReverseProxy{
+		Upstream:        upstreamURL,
+		DialTimeout:     DefaultDialTimeout,
+		ResponseTimeout: DefaultResponseTimeout,
+	}, nil
+}
+
+// parseUpstream parses and validates an upstream base URL
+func parseUpstream(upstream string) (*url.URL, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL %q: %w", upstream, err)
+	}
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", upstreamURL.Scheme)
+	}
+	if upstreamURL.Host == "" {
+		return nil, fmt.Errorf("upstream URL %q has no host", upstream)
+	}
+	return upstreamURL, nil
+}
+
+// NewPoolProxy creates a reverse proxy that balances requests across a pool of backends
+func NewPoolProxy(pool *Pool) *ReverseProxy {
+	return &ReverseProxy{
+		Pool:            pool,
+		DialTimeout:     DefaultDialTimeout,
+		ResponseTimeout: DefaultResponseTimeout,
+	}
+}
+
+// Handle proxies a single request. It has the same shape as server.Handler.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	if p.Pool != nil {
+		p.handlePool(w, req)
+		return
+	}
+
+	upstreamResp, err := p.roundTrip(p.Upstream, req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			// Nobody is left to answer
+			return
+		}
+		writeUpstreamError(w, err)
+		return
+	}
+	defer upstreamResp.Close()
+
+	copyResponse(w, upstreamResp.Response, req.RequestLine.Method)
+}
+
+// roundTrip sends req to upstream and reads the response headers. The
+// returned response streams the body and must be closed by the caller. When
+// the request is traced, the exchange up to the response headers is recorded
+// as a client span that the upstream continues.
+func (p *ReverseProxy) roundTrip(upstream *url.URL, req *request.Request) (*client.Response, error) {
+	ctx, span := trace.Start(req.Context(), req.RequestLine.Method+" "+upstream.Host, trace.KindClient)
+	defer span.Finish()
+	span.SetAttribute("server.address", upstream.Host)
+
+	upstreamClient := &client.Client{
+		DialTimeout:           p.DialTimeout,
+		ResponseHeaderTimeout: p.ResponseTimeout,
+	}
+	resp, err := upstreamClient.Do(p.outgoingRequest(upstream, req.WithContext(ctx)))
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", int(resp.StatusLine.StatusCode))
+	return resp, nil
+}
+
+// outgoingRequest builds the request sent upstream from the client's request
+func (p *ReverseProxy) outgoingRequest(upstream *url.URL, req *request.Request) *request.Request {
+	outHeaders := headers.NewHeaders()
+	for key, value := range req.Headers {
+		outHeaders.Override(key, value)
+	}
+	removeHopHeaders(outHeaders)
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		outHeaders.Set("X-Forwarded-For", clientIP)
+	}
+	if host := req.Headers.Get("Host"); host != "" {
+		outHeaders.Override("X-Forwarded-Host", host)
+	}
+	if req.TLS != nil {
+		outHeaders.Override("X-Forwarded-Proto", "https")
+	} else {
+		outHeaders.Override("X-Forwarded-Proto", "http")
+	}
+	outHeaders.Set("Via", viaPseudonym)
+	trace.Inject(req.Context(), outHeaders)
+	if req.ID != "" {
+		outHeaders.Override(request.IDHeader, req.ID)
+	}
+
+	outHeaders.Override("Host", upstream.Host)
+	if req.Headers.Get("Content-Length") != "" {
+		outHeaders.Override("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	// The upstream exchange is cut short once the client goes away
+	outReq := &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        req.RequestLine.Method,
+			RequestTarget: upstream.Scheme + "://" + upstream.Host + p.rewriteTarget(upstream, req.RequestLine.RequestTarget),
+			HttpVersion:   "1.1",
+		},
+		Headers: outHeaders,
+		Body:    req.Body,
+	}
+	return outReq.WithContext(req.Context())
+}
+
+// rewriteTarget maps a client request target onto the upstream
+func (p *ReverseProxy) rewriteTarget(upstream *url.URL, target string) string {
+	path, query, hasQuery := strings.Cut(target, "?")
+
+	path = strings.TrimPrefix(path, p.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	path = strings.TrimSuffix(upstream.Path, "/") + path
+
+	if upstream.RawQuery != "" {
+		if hasQuery {
+			query = upstream.RawQuery + "&" + query
+		} else {
+			query = upstream.RawQuery
+		}
+		hasQuery = true
+	}
+	target = path
+	if hasQuery {
+		target += "?" + query
+	}
+
+	if p.Rewrite != nil {
+		target = p.Rewrite(target)
+	}
+	return target
+}
+
+// copyResponse streams the upstream response back to the client, keeping its
+// status and end-to-end headers
+func copyResponse(w *response.Writer, upstreamResp *response.Response, method string) {
+	w.WriteStatusLine(upstreamResp.StatusLine.StatusCode)
+
+	responseHeaders := headers.NewHeaders()
+	for key, value := range upstreamResp.Headers {
+		responseHeaders.Override(key, value)
+	}
+	chunked := response.IsChunked(upstreamResp.Headers)
+	removeHopHeaders(responseHeaders)
+	responseHeaders.Set("Via", viaPseudonym)
+
+	if !response.BodyAllowed(method, upstreamResp.StatusLine.StatusCode) {
+		w.WriteHeaders(responseHeaders)
+		return
+	}
+
+	// A Content-Length body can be passed straight through, anything else is
+	// re-chunked so the client can tell where it ends
+	if !chunked && responseHeaders.Get("Content-Length") != "" {
+		w.WriteHeaders(responseHeaders)
+		io.Copy(bodyWriter{w}, upstreamResp.Body)
+		return
+	}
+
+	responseHeaders.Delete("Content-Length")
+	responseHeaders.Override("Transfer-Encoding", "chunked")
+	if trailerNames := upstreamResp.Headers.Get("Trailer"); trailerNames != "" {
+		responseHeaders.Override("Trailer", trailerNames)
+	}
+	w.WriteHeaders(responseHeaders)
+
+	if _, err := io.Copy(chunkWriter{w}, upstreamResp.Body); err != nil {
+		// The status is already sent, so the best we can do is cut the
+		// response short without the terminating chunk
+		return
+	}
+	w.WriteChunkedBodyDone()
+	w.WriteTrailers(upstreamResp.Trailers)
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including any the Connection header names
+func removeHopHeaders(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Delete(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Delete(name)
+	}
+}
+
+// writeUpstreamError maps a failure talking to the upstream to 504 for
+// timeouts and 502 for everything else
+func writeUpstreamError(w *response.Writer, err error) {
+	if isTimeout(err) {
+		w.WriteError(response.StatusGatewayTimeout, nil)
+		return
+	}
+	w.WriteError(response.StatusBadGateway, nil)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// bodyWriter adapts a response.Writer to io.Writer for fixed-length bodies
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
+
+// chunkWriter adapts a response.Writer to io.Writer for chunked bodies
+type chunkWriter struct {
+	w *response.Writer
+}
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	return c.w.WriteChunkedBody(p)
+}
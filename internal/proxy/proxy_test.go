@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/trace"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseProxy(t *testing.T) {
+	// Test: Method, body and end-to-end headers are forwarded, hop-by-hop headers are not
+	upstream, received := startUpstream(t, "HTTP/1.1 201 Created\r\n"+
+		"Content-Length: 7\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"\r\n"+
+		`{"a":1}`)
+	p, err := New("http://" + upstream + "/api")
+	require.NoError(t, err)
+	p.StripPrefix = "/svc"
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "PUT", RequestTarget: "/svc/items/1?x=y", HttpVersion: "1.1"},
+		Headers: map[string]string{
+			"host":           "example.com",
+			"content-type":   "text/plain",
+			"content-length": "5",
+			"connection":     "close, x-secret",
+			"x-secret":       "hop",
+			"x-custom":       "kept",
+		},
+		Body:       []byte("hello"),
+		RemoteAddr: "10.1.2.3:5555",
+		ID:         "01J9Z3",
+	}
+	resp := proxyRequest(t, p, req)
+
+	upstreamReq := <-received
+	assert.Equal(t, "PUT", upstreamReq.RequestLine.Method)
+	assert.Equal(t, "/api/items/1?x=y", upstreamReq.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(upstreamReq.Body))
+	assert.Equal(t, upstream, upstreamReq.Headers.Get("Host"))
+	assert.Equal(t, "kept", upstreamReq.Headers.Get("X-Custom"))
+	assert.Equal(t, "", upstreamReq.Headers.Get("X-Secret"))
+	assert.Equal(t, "10.1.2.3", upstreamReq.Headers.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", upstreamReq.Headers.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", upstreamReq.Headers.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "1.1 httpfromtcp", upstreamReq.Headers.Get("Via"))
+	assert.Equal(t, "01J9Z3", upstreamReq.Headers.Get("X-Request-ID"))
+
+	assert.Equal(t, response.StatusCode(201), resp.StatusLine.StatusCode)
+	assert.Equal(t, "application/json", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "", resp.Headers.Get("Keep-Alive"))
+	assert.Equal(t, "", resp.Headers.Get("Connection"), "the server decides whether the client connection is kept")
+	assert.Equal(t, "1.1 httpfromtcp", resp.Headers.Get("Via"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(body))
+
+	// Test: Requests that arrived over TLS are forwarded as https
+	upstream, received = startUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+	p, err = New("http://" + upstream)
+	require.NoError(t, err)
+	req = newGetRequest("/")
+	req.TLS = &tls.ConnectionState{}
+	proxyRequest(t, p, req)
+	assert.Equal(t, "https", (<-received).Headers.Get("X-Forwarded-Proto"))
+
+	// Test: Chunked upstream responses are streamed back with their trailers
+	upstream, _ = startUpstream(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: X-Checksum\r\n"+
+		"\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n")
+	p, err = New("http://" + upstream)
+	require.NoError(t, err)
+	resp = proxyRequest(t, p, newGetRequest("/stream"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "abc", resp.Trailers.Get("X-Checksum"))
+
+	// Test: Upstream that closes without framing is re-chunked
+	upstream, _ = startUpstream(t, "HTTP/1.1 200 OK\r\n\r\nuntil close")
+	p, err = New("http://" + upstream)
+	require.NoError(t, err)
+	resp = proxyRequest(t, p, newGetRequest("/"))
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "until close", string(body))
+
+	// Test: Unreachable upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	listener.Close()
+	p, err = New("http://" + closedAddr)
+	require.NoError(t, err)
+	resp = proxyRequest(t, p, newGetRequest("/"))
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: Upstream that never answers is a 504
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	p, err = New("http://" + listener.Addr().String())
+	require.NoError(t, err)
+	p.ResponseTimeout = 50 * time.Millisecond
+	resp = proxyRequest(t, p, newGetRequest("/"))
+	assert.Equal(t, response.StatusGatewayTimeout, resp.StatusLine.StatusCode)
+
+	// Test: Invalid upstream URLs are rejected
+	_, err = New("ftp://example.com")
+	require.Error(t, err)
+	_, err = New("http://")
+	require.Error(t, err)
+}
+
+func TestReverseProxyTracing(t *testing.T) {
+	upstream, received := startUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+	p, err := New("http://" + upstream)
+	require.NoError(t, err)
+	exporter := &trace.MemoryExporter{}
+	tracer := &trace.Tracer{Exporter: exporter}
+
+	// Test: The upstream continues the trace from the proxy's client span
+	req := newGetRequest("/")
+	req.Headers["traceparent"] = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req.Headers["tracestate"] = "congo=t61rcWkgMzE"
+	var out bytes.Buffer
+	tracer.Middleware(p.Handle)(response.NewWriter(&out), req)
+
+	upstreamReq := <-received
+	sc, ok := trace.Extract(upstreamReq.Headers)
+	require.True(t, ok)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", sc.TraceID.String())
+	assert.Equal(t, "congo=t61rcWkgMzE", sc.TraceState)
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 2)
+	client, server := spans[0], spans[1]
+	assert.Equal(t, trace.KindClient, client.Kind)
+	assert.Equal(t, sc.SpanID, client.Context.SpanID)
+	assert.Equal(t, server.Context.SpanID, client.Parent)
+	assert.Equal(t, 204, client.Attributes["http.status_code"])
+}
+
+// startUpstream runs a one-shot upstream that replies with rawResponse and
+// reports the request it received
+func startUpstream(t *testing.T, rawResponse string) (string, <-chan *request.Request) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan *request.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := request.RequestFromReader(conn)
+		if err != nil {
+			return
+		}
+		received <- req
+		conn.Write([]byte(rawResponse))
+	}()
+	return listener.Addr().String(), received
+}
+
+// proxyRequest runs the proxy handler and parses what it wrote to the client
+func proxyRequest(t *testing.T, p *ReverseProxy, req *request.Request) *response.Response {
+	t.Helper()
+	var out bytes.Buffer
+	p.Handle(response.NewWriter(&out), req)
+	resp, err := response.ResponseFromReader(&out, req.RequestLine.Method)
+	require.NoError(t, err)
+	return resp
+}
+
+func newGetRequest(target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     map[string]string{},
+		RemoteAddr:  "127.0.0.1:1234",
+	}
+}
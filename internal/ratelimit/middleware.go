@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"strings"
+	"time"
+)
+
+// KeyFunc picks the key a request is counted under. Requests it returns ""
+// for aren't limited.
+type KeyFunc func(req *request.Request) string
+
+// ByClientIP counts requests by the address of the connection they came on
+func ByClientIP(req *request.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader counts requests by the value of a header such as an API key.
+// Requests without it aren't limited.
+func ByHeader(name string) KeyFunc {
+	return func(req *request.Request) string {
+		return req.Headers.Get(name)
+	}
+}
+
+// ByRoute counts requests by method and path, ignoring the query
+func ByRoute(req *request.Request) string {
+	path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	return req.RequestLine.Method + " " + path
+}
+
+// Combine counts requests by several keys together, such as client and
+// route. Requests any of them returns "" for aren't limited.
+func Combine(keys ...KeyFunc) KeyFunc {
+	return func(req *request.Request) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			if parts[i] = key(req); parts[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(parts, "\x00")
+	}
+}
+
+// Middleware returns middleware that counts each request with limiter under
+// the key it gets from key. Requests over the limit are answered with 429
+// and Retry-After. Every response carries the RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy headers of the
+// IETF rate limit headers draft. If the store fails, requests are let
+// through rather than turning an outage of the store into one of the server.
+// It panics if limiter has a Validate method that fails, as a misconfigured
+// limiter would otherwise be let through on every request.
+func Middleware(limiter Limiter, key KeyFunc) server.Middleware {
+	if v, ok := limiter.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			panic("ratelimit: " + err.Error())
+		}
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			k := key(req)
+			if k == "" {
+				next(w, req)
+				return
+			}
+			d, err := limiter.Allow(k, time.Now())
+			if err != nil {
+				next(w, req)
+				return
+			}
+
+			h := w.Header()
+			h.Override("RateLimit-Limit", fmt.Sprint(d.Limit))
+			h.Override("RateLimit-Remaining", fmt.Sprint(d.Remaining))
+			h.Override("RateLimit-Reset", fmt.Sprint(ceilSeconds(d.Reset)))
+			h.Override("RateLimit-Policy", fmt.Sprintf("%d;w=%d", d.Limit, ceilSeconds(d.Window)))
+			if d.Allowed {
+				next(w, req)
+				return
+			}
+			extra := headers.NewHeaders()
+			extra.Override("Retry-After", fmt.Sprint(max(ceilSeconds(d.RetryAfter), 1)))
+			w.WriteError(response.StatusTooManyRequests, extra)
+		}
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds, as the headers carry them
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
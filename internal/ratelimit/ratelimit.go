@@ -0,0 +1,158 @@
+// Package ratelimit limits how often clients may make requests, using token
+// buckets or sliding windows whose state lives in a pluggable Store.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrInvalidPolicy is returned for limiters whose limit or period isn't
+// positive, which would otherwise let every request through or none
+var ErrInvalidPolicy = errors.New("invalid rate limit policy")
+
+// Decision is a limiter's verdict on one request
+type Decision struct {
+	Allowed bool
+	// Limit is how many requests the policy allows in Window
+	Limit  int
+	Window time.Duration
+	// Remaining is how many more requests would be allowed right now
+	Remaining int
+	// Reset is how long until the full quota is available again
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed, zero
+	// when this one was
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether the request counted under key may proceed at now
+type Limiter interface {
+	Allow(key string, now time.Time) (Decision, error)
+}
+
+// TokenBucket allows bursts of up to Limit requests, refilled steadily so
+// that Limit requests are allowed per Period
+type TokenBucket struct {
+	Limit  int
+	Period time.Duration
+	Store  Store
+}
+
+// Validate reports whether Limit and Period are positive
+func (b *TokenBucket) Validate() error {
+	return validate(b.Limit, b.Period)
+}
+
+// Allow takes a token from key's bucket if one is left
+func (b *TokenBucket) Allow(key string, now time.Time) (Decision, error) {
+	if err := b.Validate(); err != nil {
+		return Decision{}, err
+	}
+	limit := float64(b.Limit)
+	rate := limit / b.Period.Seconds()
+	d := Decision{Limit: b.Limit, Window: b.Period}
+
+	// A bucket left alone for a whole period is full, so it may be forgotten
+	err := b.Store.Update(key, b.Period, func(state State, ok bool) State {
+		tokens := limit
+		if ok {
+			elapsed := max(now.Sub(state.Time).Seconds(), 0)
+			tokens = min(limit, state.Value+elapsed*rate)
+		}
+		if tokens >= 1 {
+			tokens--
+			d.Allowed = true
+		} else {
+			d.RetryAfter = seconds((1 - tokens) / rate)
+		}
+		d.Remaining = int(tokens)
+		d.Reset = seconds((limit - tokens) / rate)
+		return State{Value: tokens, Time: now}
+	})
+	return d, err
+}
+
+// SlidingWindow allows Limit requests in any Window. It counts requests in
+// fixed windows and weighs the previous window's count by how much of it
+// still overlaps the sliding one, which needs only two counters per key.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+	Store  Store
+}
+
+// Validate reports whether Limit and Window are positive
+func (w *SlidingWindow) Validate() error {
+	return validate(w.Limit, w.Window)
+}
+
+// Allow counts a request for key if the estimated count leaves room for it
+func (w *SlidingWindow) Allow(key string, now time.Time) (Decision, error) {
+	if err := w.Validate(); err != nil {
+		return Decision{}, err
+	}
+	limit := float64(w.Limit)
+	start := now.Truncate(w.Window)
+	d := Decision{Limit: w.Limit, Window: w.Window}
+
+	// The previous window stops mattering once the next one starts
+	err := w.Store.Update(key, 2*w.Window, func(state State, ok bool) State {
+		var previous, current float64
+		switch {
+		case ok && state.Time.Equal(start):
+			previous, current = state.Previous, state.Value
+		case ok && state.Time.Equal(start.Add(-w.Window)):
+			previous = state.Value
+		}
+
+		elapsed := now.Sub(start)
+		overlap := 1 - float64(elapsed)/float64(w.Window)
+		estimate := previous*overlap + current
+		if estimate+1 <= limit {
+			current++
+			estimate++
+			d.Allowed = true
+		} else {
+			d.RetryAfter = w.retryAfter(previous, current, elapsed)
+		}
+		d.Remaining = max(int(limit-estimate), 0)
+		// Requests counted in a window have slid out a window after it ends
+		switch {
+		case current > 0:
+			d.Reset = 2*w.Window - elapsed
+		case previous > 0:
+			d.Reset = w.Window - elapsed
+		}
+		return State{Value: current, Previous: previous, Time: start}
+	})
+	return d, err
+}
+
+// retryAfter works out when the estimate drops low enough for one more request
+func (w *SlidingWindow) retryAfter(previous, current float64, elapsed time.Duration) time.Duration {
+	room := float64(w.Limit) - 1
+	window := w.Window.Seconds()
+	if current <= room {
+		// The previous window's weight shrinks until current plus it fits
+		at := window * (1 - (room-current)/previous)
+		return seconds(at - elapsed.Seconds())
+	}
+	// The current window has to become the previous one and shrink in turn
+	at := window + window*(1-room/current)
+	return seconds(at - elapsed.Seconds())
+}
+
+func validate(limit int, period time.Duration) error {
+	if limit <= 0 || period <= 0 {
+		return fmt.Errorf("%w: %d requests per %v", ErrInvalidPolicy, limit, period)
+	}
+	return nil
+}
+
+// seconds converts a non-negative number of seconds to a Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(max(s, 0) * float64(time.Second)))
+}
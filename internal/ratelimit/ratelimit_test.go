@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := &TokenBucket{Limit: 3, Period: 3 * time.Second, Store: NewMemoryStore()}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Test: A full bucket allows a burst of Limit requests
+	for i := 2; i >= 0; i-- {
+		d, err := b.Allow("a", now)
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, i, d.Remaining)
+	}
+
+	// Test: An empty bucket denies and says when a token is back
+	d, err := b.Allow("a", now)
+	require.NoError(t, err)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, time.Second, d.RetryAfter)
+	assert.Equal(t, 3*time.Second, d.Reset)
+
+	// Test: Tokens refill over time
+	d, _ = b.Allow("a", now.Add(time.Second))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// Test: Keys have separate buckets
+	d, _ = b.Allow("b", now)
+	assert.True(t, d.Allowed)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	w := &SlidingWindow{Limit: 4, Window: 10 * time.Second, Store: NewMemoryStore()}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Test: Limit requests are allowed in a window
+	for i := 0; i < 4; i++ {
+		d, err := w.Allow("a", start.Add(5*time.Second))
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+	}
+	d, _ := w.Allow("a", start.Add(6*time.Second))
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	// Test: Early in the next window the previous count still weighs in
+	d, _ = w.Allow("a", start.Add(11*time.Second))
+	assert.False(t, d.Allowed)                           // 4 * 0.9 = 3.6 counted
+	assert.Equal(t, 1500*time.Millisecond, d.RetryAfter) // 4 * 0.75 = 3 leaves room at 12.5s
+
+	// Test: Once enough of the previous window slid out there is room again
+	d, _ = w.Allow("a", start.Add(15*time.Second))
+	assert.True(t, d.Allowed) // 4 * 0.5 + 1 = 3 counted
+	assert.Equal(t, 1, d.Remaining)
+
+	// Test: Windows long gone are forgotten
+	d, _ = w.Allow("a", start.Add(time.Minute))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 3, d.Remaining)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := &MemoryStore{MaxKeys: 2}
+	set := func(key string, ttl time.Duration) {
+		require.NoError(t, s.Update(key, ttl, func(State, bool) State { return State{Value: 1} }))
+	}
+
+	// Test: Updates see the state stored before
+	set("a", time.Hour)
+	require.NoError(t, s.Update("a", time.Hour, func(state State, ok bool) State {
+		assert.True(t, ok)
+		assert.Equal(t, 1.0, state.Value)
+		return state
+	}))
+
+	// Test: Expired keys are treated as missing
+	set("b", -time.Second)
+	require.NoError(t, s.Update("b", time.Hour, func(state State, ok bool) State {
+		assert.False(t, ok)
+		return state
+	}))
+
+	// Test: Past MaxKeys the key closest to expiring is evicted
+	set("a", time.Minute)
+	set("c", time.Hour)
+	assert.Equal(t, 2, s.Len())
+	require.NoError(t, s.Update("a", time.Hour, func(state State, ok bool) State {
+		assert.False(t, ok)
+		return state
+	}))
+
+	// Test: Expired keys are dropped by the next update, whatever its key
+	s = &MemoryStore{}
+	set("x", -time.Second)
+	set("y", -time.Second)
+	set("z", time.Hour)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestMiddleware(t *testing.T) {
+	limiter := &TokenBucket{Limit: 1, Period: time.Minute, Store: NewMemoryStore()}
+	handler := Middleware(limiter, ByHeader("X-API-Key"))(func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte("ok"))
+	})
+	call := func(apiKey string) *response.Response {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+			RemoteAddr:  "10.0.0.1:1234",
+		}
+		if apiKey != "" {
+			req.Headers.Override("X-API-Key", apiKey)
+		}
+		var out bytes.Buffer
+		handler(response.NewWriter(&out), req)
+		resp, err := response.ResponseFromReader(&out, "GET")
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Test: Allowed responses carry the rate limit headers
+	resp := call("k1")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "1", resp.Headers.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Headers.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", resp.Headers.Get("RateLimit-Reset"))
+	assert.Equal(t, "1;w=60", resp.Headers.Get("RateLimit-Policy"))
+
+	// Test: Requests over the limit get 429 with Retry-After
+	resp = call("k1")
+	assert.Equal(t, response.StatusTooManyRequests, resp.StatusLine.StatusCode)
+	assert.Equal(t, "60", resp.Headers.Get("Retry-After"))
+
+	// Test: Other keys are counted apart and requests without a key aren't limited
+	assert.Equal(t, response.StatusOK, call("k2").StatusLine.StatusCode)
+	for i := 0; i < 3; i++ {
+		resp = call("")
+		assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+		assert.Empty(t, resp.Headers.Get("RateLimit-Limit"))
+	}
+
+	// Test: Limiters without a positive limit and period are refused rather
+	// than silently letting everything through
+	_, err := (&TokenBucket{Limit: 1, Store: NewMemoryStore()}).Allow("k", time.Now())
+	require.ErrorIs(t, err, ErrInvalidPolicy)
+	_, err = (&SlidingWindow{Window: time.Minute, Store: NewMemoryStore()}).Allow("k", time.Now())
+	require.ErrorIs(t, err, ErrInvalidPolicy)
+	assert.Panics(t, func() { Middleware(&SlidingWindow{Limit: 1, Store: NewMemoryStore()}, ByClientIP) })
+}
+
+func TestKeyFuncs(t *testing.T) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/items?page=2"},
+		Headers:     headers.NewHeaders(),
+		RemoteAddr:  "[::1]:5000",
+	}
+
+	// Test: Keys come from the client address, route and headers
+	assert.Equal(t, "::1", ByClientIP(req))
+	assert.Equal(t, "GET /items", ByRoute(req))
+	assert.Equal(t, "::1\x00GET /items", Combine(ByClientIP, ByRoute)(req))
+	assert.Empty(t, Combine(ByClientIP, ByHeader("X-API-Key"))(req))
+}
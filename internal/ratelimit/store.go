@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"httpfromtcp/internal/expiry"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys bounds a MemoryStore when MaxKeys is zero
+const DefaultMaxKeys = 100_000
+
+// State is what a limiter remembers about one key. It is plain data so
+// that stores outside the process can hold it.
+type State struct {
+	// Value is the number of tokens left in a token bucket, or the count of
+	// the current window of a sliding window
+	Value float64
+	// Previous is the count of the previous window of a sliding window
+	Previous float64
+	// Time is when a bucket was last refilled, or when the current window started
+	Time time.Time
+}
+
+// Store holds limiter state by key. Update must be atomic for each key, so
+// concurrent requests never both see the same state; a store shared between
+// servers would do this with a transaction or script.
+type Store interface {
+	// Update replaces the state of key with what fn returns. fn gets the
+	// current state, or ok false if there is none. The store may forget
+	// the key once ttl has passed without another update.
+	Update(key string, ttl time.Duration, fn func(state State, ok bool) State) error
+}
+
+// MemoryStore is a Store in process memory. Expired keys are dropped as
+// later updates come in, and past MaxKeys the keys closest to expiring are
+// evicted. Keys are kept ordered by expiry, so neither needs a scan of the
+// whole store.
+type MemoryStore struct {
+	// MaxKeys bounds how many keys are held, DefaultMaxKeys when zero
+	MaxKeys int
+
+	mu      sync.Mutex
+	entries map[string]State
+	// byExpiry orders the keys of entries by when they expire
+	byExpiry expiry.Queue[string]
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Update implements Store
+func (s *MemoryStore) Update(key string, ttl time.Duration, fn func(state State, ok bool) State) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]State)
+	}
+
+	for {
+		expired, ok := s.byExpiry.PopExpired(now)
+		if !ok {
+			break
+		}
+		delete(s.entries, expired)
+	}
+	state, ok := s.entries[key]
+	if !ok {
+		s.makeRoom()
+	}
+	s.entries[key] = fn(state, ok)
+	s.byExpiry.Set(key, now.Add(ttl))
+	return nil
+}
+
+// Len returns how many keys the store holds, including expired ones not yet dropped
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// makeRoom evicts the keys closest to expiring until there is room for one more
+func (s *MemoryStore) makeRoom() {
+	maxKeys := s.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	for len(s.entries) >= maxKeys {
+		key, _ := s.byExpiry.Pop()
+		delete(s.entries, key)
+	}
+}
@@ -0,0 +1,68 @@
+package request
+
+import "context"
+
+// Context returns the request's context. For requests read by the server it
+// is canceled when the client disconnects, the server closes or a handler
+// timeout elapses; for others it is context.Background().
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// for middleware to pass on in place of r
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// WithValue returns a shallow copy of r whose context carries value under
+// key, as context.WithValue does
+func (r *Request) WithValue(key, value any) *Request {
+	return r.WithContext(context.WithValue(r.Context(), key, value))
+}
+
+// Value returns the value stored under key in the request's context, or nil
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+// contextKey is the type of the keys this package stores values under, so
+// they can't collide with anyone else's
+type contextKey int
+
+const (
+	paramsKey contextKey = iota
+	identityKey
+)
+
+// WithParams returns a shallow copy of r carrying the parameters a router
+// matched in its path, such as {"id": "42"} for /users/{id}
+func (r *Request) WithParams(params map[string]string) *Request {
+	return r.WithValue(paramsKey, params)
+}
+
+// Param returns the path parameter called name, or "" if there is none
+func (r *Request) Param(name string) string {
+	params, _ := r.Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+// WithIdentity returns a shallow copy of r carrying who the client was
+// authenticated as, such as a user name or API key ID
+func (r *Request) WithIdentity(identity string) *Request {
+	return r.WithValue(identityKey, identity)
+}
+
+// Identity returns who the client was authenticated as, or "" if it wasn't
+func (r *Request) Identity() string {
+	identity, _ := r.Value(identityKey).(string)
+	return identity
+}
@@ -0,0 +1,90 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedEncoding is returned by DecodeBody when the request uses a
+	// Content-Encoding we don't know how to decode
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	// ErrDecodedBodyTooLarge is returned by DecodeBody when the decompressed
+	// body would exceed the configured limit
+	ErrDecodedBodyTooLarge = errors.New("decoded body exceeds size limit")
+)
+
+// SupportedEncodings lists the content codings DecodeBody understands,
+// formatted for use in an Accept-Encoding header
+const SupportedEncodings = "gzip, deflate"
+
+// DecodeBody decodes the request body according to its Content-Encoding header.
+// The decoded body replaces Body, Content-Encoding is removed and Content-Length
+// is updated to match. maxSize caps the decoded size to guard against zip bombs.
+func (r *Request) DecodeBody(maxSize int64) error {
+	contentEncoding := r.Headers.Get("Content-Encoding")
+	if contentEncoding == "" {
+		return nil
+	}
+
+	// Codings are listed in the order they were applied, so undo them in reverse
+	codings := headers.SplitList(contentEncoding)
+	body := r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(codings[i])
+		decoded, err := decodeBody(coding, body, maxSize)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	}
+
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	r.Headers.Override("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// decodeBody undoes a single content coding
+func decodeBody(coding string, body []byte, maxSize int64) ([]byte, error) {
+	var reader io.ReadCloser
+	switch coding {
+	case "identity", "":
+		return body, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		reader = gzipReader
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but plenty of clients send raw deflate
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zlibReader
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, coding)
+	}
+	defer reader.Close()
+
+	// Read one byte past the limit so we can tell "exactly maxSize" from "too big"
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", coding, err)
+	}
+	if int64(len(decoded)) > maxSize {
+		return nil, ErrDecodedBodyTooLarge
+	}
+	return decoded, nil
+}
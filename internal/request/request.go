@@ -2,20 +2,51 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
-	"strconv"
+	"math"
+	"net"
 	"strings"
 )
 
+// Errors ReadRequest wraps, so callers can tell what was wrong with a request
+var (
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrMalformedHeader      = errors.New("malformed header")
+	ErrInvalidContentLength = errors.New("invalid Content-Length")
+	// ErrIncompleteRequest means the connection ended partway through a
+	// request; ending it before the first byte gives io.EOF instead
+	ErrIncompleteRequest = errors.New("incomplete request")
+	// ErrBodyTooLarge means Content-Length declared a body over the
+	// Reader's MaxBodySize; none of it was read
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// IDHeader carries the ID that identifies a request across logs and services
+const IDHeader = "X-Request-ID"
+
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
+	// RemoteAddr is the network address of the client, set by the server
+	RemoteAddr string
+	// TLS describes the connection when it arrived over TLS, including any
+	// verified client certificate chains; nil for plain connections
+	TLS *tls.ConnectionState
+	// ID identifies the request in logs, error pages and proxied requests,
+	// set by the server.RequestID middleware
+	ID string
 
+	// ctx is returned by Context, set through WithContext
+	ctx   context.Context
 	state requestState
+	// maxBodySize is copied from the Reader parsing the request
+	maxBodySize int64
 }
 
 type RequestLine struct {
@@ -39,42 +70,116 @@ const (
 )
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// Reader parses consecutive requests from a connection, keeping any bytes it
+// reads past the end of one request for the next
+type Reader struct {
+	// MaxBodySize, if positive, bounds the Content-Length of requests.
+	// Larger ones fail with ErrBodyTooLarge before their body is read.
+	MaxBodySize int64
+
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+}
+
+// NewReader creates a Reader on top of reader
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// Buffered returns the bytes read from the connection that are not part of
+// any request returned so far
+func (r *Reader) Buffered() []byte {
+	return r.buf[:r.readToIndex]
+}
+
+// ReadRequest parses the next request
+func (r *Reader) ReadRequest() (*Request, error) {
 	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
+		state:       requestStateInitialized,
+		Headers:     headers.NewHeaders(),
+		maxBodySize: r.MaxBodySize,
 	}
+
+	// Bytes left over from the previous request may already hold this one
+	if r.readToIndex > 0 {
+		if err := r.parseBuffered(req); err != nil {
+			return nil, err
+		}
+	}
+
 	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, len(r.buf)*2)
+			copy(newBuf, r.buf)
+			r.buf = newBuf
 		}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+		numBytesRead, err := r.reader.Read(r.buf[r.readToIndex:])
 		if err != nil {
 			if errors.Is(err, io.EOF) {
+				if req.state == requestStateInitialized && r.readToIndex == 0 {
+					return nil, io.EOF
+				}
 				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
+					return nil, fmt.Errorf("%w, in state: %d, read n bytes on EOF: %d", ErrIncompleteRequest, req.state, numBytesRead)
 				}
 				break
 			}
 			return nil, err
 		}
-		readToIndex += numBytesRead
+		r.readToIndex += numBytesRead
 
-		numBytesParsed, err := req.parse(buf[:readToIndex])
-		if err != nil {
+		if err := r.parseBuffered(req); err != nil {
 			return nil, err
 		}
-
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
 	}
 	return req, nil
 }
 
+// parseBuffered feeds the buffered bytes to req and drops what it consumed
+func (r *Reader) parseBuffered(req *Request) error {
+	numBytesParsed, err := req.parse(r.buf[:r.readToIndex])
+	if err != nil {
+		return err
+	}
+
+	copy(r.buf, r.buf[numBytesParsed:r.readToIndex])
+	r.readToIndex -= numBytesParsed
+	return nil
+}
+
+// Write serializes the request in HTTP/1.1 wire format. Repeated Set-Cookie
+// values go on lines of their own; values containing CR or LF are refused.
+func (r *Request) Write(w io.Writer) error {
+	requestLine := fmt.Sprintf("%s %s HTTP/1.1\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget)
+	if _, err := w.Write([]byte(requestLine)); err != nil {
+		return err
+	}
+	for key := range r.Headers {
+		for _, value := range r.Headers.Lines(key) {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("%w: %s value contains CR or LF", ErrMalformedHeader, key)
+			}
+			headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+			if _, err := w.Write([]byte(headerLine)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.Write([]byte(crlf)); err != nil {
+		return err
+	}
+	_, err := w.Write(r.Body)
+	return err
+}
+
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
@@ -102,6 +207,9 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}
 
 	requestTarget := parts[1]
+	if err := validateRequestTarget(method, requestTarget); err != nil {
+		return nil, err
+	}
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
@@ -124,6 +232,29 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}, nil
 }
 
+// validateRequestTarget checks the target is in a form allowed for the method
+// (RFC 9112 section 3.2): authority-form only for CONNECT, asterisk-form only
+// for OPTIONS, and origin-form or absolute-form otherwise
+func validateRequestTarget(method, target string) error {
+	if method == "CONNECT" {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("CONNECT requires an authority-form target: %s", target)
+		}
+		return nil
+	}
+	if target == "*" {
+		if method != "OPTIONS" {
+			return fmt.Errorf("asterisk-form target is only allowed for OPTIONS")
+		}
+		return nil
+	}
+	if strings.HasPrefix(target, "/") || strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return nil
+	}
+	return fmt.Errorf("invalid request-target: %s", target)
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.state != requestStateDone {
@@ -145,7 +276,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		requestLine, n, err := parseRequestLine(data)
 		if err != nil {
 			// something actually went wrong
-			return 0, err
+			return 0, fmt.Errorf("%w: %w", ErrMalformedRequestLine, err)
 		}
 		if n == 0 {
 			// just need more data
@@ -157,7 +288,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case requestStateParsingHeaders:
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
 		}
 		if done {
 			r.state = requestStateParsingBody
@@ -173,33 +304,31 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 }
 
 func (r *Request) parseBody(data []byte) (int, error) {
-	contentLengthStr := r.Headers.Get("Content-Length")
+	contentLength, err := r.Headers.ContentLength()
 
 	// If no Content-Length header, no body to parse
-	if contentLengthStr == "" {
+	if errors.Is(err, headers.ErrMissing) {
 		r.state = requestStateDone
 		return 0, nil
 	}
-
-	// Parse Content-Length
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil {
-		return 0, fmt.Errorf("invalid Content-Length: %s", contentLengthStr)
+	if err != nil || contentLength > math.MaxInt {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidContentLength, r.Headers.Get("Content-Length"))
+	}
+	if r.maxBodySize > 0 && contentLength > r.maxBodySize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, contentLength)
 	}
 
-	// Append data to body
-	r.Body = append(r.Body, data...)
-
-	// Check if we have too much data
-	if len(r.Body) > contentLength {
-		return 0, fmt.Errorf("body length %d exceeds Content-Length %d", len(r.Body), contentLength)
+	// Take no more than the body still needs, anything after belongs to the next request
+	remaining := int(contentLength) - len(r.Body)
+	if len(data) > remaining {
+		data = data[:remaining]
 	}
+	r.Body = append(r.Body, data...)
 
 	// Check if we have all the data we need
-	if len(r.Body) == contentLength {
+	if len(r.Body) == int(contentLength) {
 		r.state = requestStateDone
 	}
 
-	// We consumed all the data given to us
 	return len(data), nil
 }
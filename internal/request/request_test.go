@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"httpfromtcp/internal/headers"
 	"io"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -68,6 +74,40 @@ func TestRequestLineParse(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: CONNECT with authority-form target
+	reader = &chunkReader{
+		data:            "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+
+	// Test: CONNECT without a port
+	reader = &chunkReader{
+		data:            "CONNECT example.com HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Absolute-form target
+	reader = &chunkReader{
+		data:            "GET http://example.com/coffee HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/coffee", r.RequestLine.RequestTarget)
+
+	// Test: Asterisk-form target outside OPTIONS
+	reader = &chunkReader{
+		data:            "GET * HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.Error(t, err)
 }
 
 func TestHeadersParse(t *testing.T) {
@@ -195,6 +235,172 @@ func TestRequestBodyParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body)) // Should be empty since no Content-Length
+
+	// Test: Repeated Content-Length headers must agree
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 4\r\n" +
+			"Content-Length: 4\r\n" +
+			"\r\n" +
+			"body",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(r.Body))
+	for _, contentLength := range []string{"4, 5", "+4", "99999999999999999999"} {
+		reader = &chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nContent-Length: " + contentLength + "\r\n\r\nbody",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		assert.ErrorIs(t, err, ErrInvalidContentLength, contentLength)
+	}
+}
+
+func TestRequestDecodeBody(t *testing.T) {
+	payload := `{"hello":"world"}`
+
+	// Test: gzip body is decoded and headers are updated
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(payload))
+	gw.Close()
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Encoding: gzip\r\n" +
+			"Content-Length: " + strconv.Itoa(gzipped.Len()) + "\r\n" +
+			"\r\n" +
+			gzipped.String(),
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, payload, string(r.Body))
+	assert.Equal(t, "", r.Headers.Get("Content-Encoding"))
+	assert.Equal(t, strconv.Itoa(len(payload)), r.Headers.Get("Content-Length"))
+
+	// Test: deflate body is decoded
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(payload))
+	zw.Close()
+	r = &Request{Headers: map[string]string{"content-encoding": "deflate"}, Body: deflated.Bytes()}
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, payload, string(r.Body))
+
+	// Test: No Content-Encoding leaves the body alone
+	r = &Request{Headers: map[string]string{}, Body: []byte(payload)}
+	require.NoError(t, r.DecodeBody(1024))
+	assert.Equal(t, payload, string(r.Body))
+
+	// Test: Decoded body larger than the limit
+	var bomb bytes.Buffer
+	gw = gzip.NewWriter(&bomb)
+	gw.Write(bytes.Repeat([]byte("a"), 4096))
+	gw.Close()
+	r = &Request{Headers: map[string]string{"content-encoding": "gzip"}, Body: bomb.Bytes()}
+	require.ErrorIs(t, r.DecodeBody(1024), ErrDecodedBodyTooLarge)
+
+	// Test: Unsupported encoding
+	r = &Request{Headers: map[string]string{"content-encoding": "br"}, Body: []byte(payload)}
+	require.ErrorIs(t, r.DecodeBody(1024), ErrUnsupportedEncoding)
+
+	// Test: Corrupt gzip body
+	r = &Request{Headers: map[string]string{"content-encoding": "gzip"}, Body: []byte("not gzip")}
+	err = r.DecodeBody(1024)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestRequestContext(t *testing.T) {
+	req, err := RequestFromReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")))
+	require.NoError(t, err)
+
+	// Test: Requests start with the background context
+	assert.Equal(t, context.Background(), req.Context())
+
+	// Test: WithContext copies the request rather than changing it
+	ctx, cancel := context.WithCancel(context.Background())
+	withCtx := req.WithContext(ctx)
+	cancel()
+	assert.ErrorIs(t, withCtx.Context().Err(), context.Canceled)
+	assert.NoError(t, req.Context().Err())
+	assert.Equal(t, req.RequestLine, withCtx.RequestLine)
+
+	// Test: Route params and identity are carried along
+	withValues := withCtx.WithParams(map[string]string{"id": "42"}).WithIdentity("alice")
+	assert.Equal(t, "42", withValues.Param("id"))
+	assert.Equal(t, "", withValues.Param("name"))
+	assert.Equal(t, "alice", withValues.Identity())
+	assert.Equal(t, "", req.Identity())
+	assert.ErrorIs(t, withValues.Context().Err(), context.Canceled)
+}
+
+func TestRequestReader(t *testing.T) {
+	// Test: Pipelined requests are read one after the other
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /second HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: A connection closed between requests gives a plain io.EOF
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Bytes past the request stay buffered
+	reader = NewReader(&chunkReader{
+		data:            "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n\r\n\x81\x05hello",
+		numBytesPerRead: 100,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/chat", r.RequestLine.RequestTarget)
+	assert.Equal(t, "\x81\x05hello", string(reader.Buffered()))
+
+	// Test: Errors say what was wrong with the request
+	for data, want := range map[string]error{
+		"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n": ErrInvalidContentLength,
+		"GET /\r\n\r\n": ErrMalformedRequestLine,
+		"GET / HTTP/1.1\r\nBad Header: x\r\n\r\n":        ErrMalformedHeader,
+		"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhi": ErrIncompleteRequest,
+	} {
+		_, err = NewReader(&chunkReader{data: data, numBytesPerRead: 100}).ReadRequest()
+		require.ErrorIs(t, err, want, data)
+	}
+
+	// Test: A body declared over MaxBodySize is refused without reading it
+	reader = NewReader(&chunkReader{data: "POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\n", numBytesPerRead: 100})
+	reader.MaxBodySize = 5
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestRequestWrite(t *testing.T) {
+	req := &Request{
+		RequestLine: RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	req.Headers.Set("Set-Cookie", "a=1")
+	req.Headers.Set("Set-Cookie", "b=2")
+
+	// Test: Values joined by Set go out on separate lines
+	var out bytes.Buffer
+	require.NoError(t, req.Write(&out))
+	assert.Equal(t, "GET / HTTP/1.1\r\nset-cookie: a=1\r\nset-cookie: b=2\r\n\r\n", out.String())
+
+	// Test: Values that would start a new line are refused
+	req.Headers.Override("X-Injected", "1\r\nHost: evil")
+	require.ErrorIs(t, req.Write(io.Discard), ErrMalformedHeader)
 }
 
 type chunkReader struct {
@@ -0,0 +1,331 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Response is an HTTP response read from a connection. The body is streamed:
+// the head is parsed up front and Body reads the rest from the connection.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       io.Reader
+	// Trailers is filled in once a chunked Body has been read to EOF
+	Trailers headers.Headers
+
+	state responseState
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type responseState int
+
+const (
+	responseStateInitialized responseState = iota
+	responseStateParsingHeaders
+	responseStateDone
+)
+
+const (
+	crlf       = "\r\n"
+	bufferSize = 8
+)
+
+// ResponseFromReader parses the status line and headers of a response and
+// sets up Body to stream the rest. method is the method of the request the
+// response answers, since responses to HEAD never carry a body.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	buf := make([]byte, bufferSize)
+	readToIndex := 0
+	resp := &Response{
+		state:    responseStateInitialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+	}
+	for resp.state != responseStateDone {
+		if readToIndex >= len(buf) {
+			newBuf := make([]byte, len(buf)*2)
+			copy(newBuf, buf)
+			buf = newBuf
+		}
+
+		numBytesRead, err := reader.Read(buf[readToIndex:])
+		readToIndex += numBytesRead
+		if numBytesRead > 0 {
+			numBytesParsed, parseErr := resp.parse(buf[:readToIndex])
+			if parseErr != nil {
+				return nil, parseErr
+			}
+			copy(buf, buf[numBytesParsed:readToIndex])
+			readToIndex -= numBytesParsed
+		}
+		if err != nil && resp.state != responseStateDone {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("incomplete response, in state: %d", resp.state)
+			}
+			return nil, err
+		}
+	}
+
+	// Whatever we read past the headers belongs to the body
+	leftover := make([]byte, readToIndex)
+	copy(leftover, buf[:readToIndex])
+	bodyReader := io.MultiReader(bytes.NewReader(leftover), reader)
+
+	body, err := resp.bodyReader(bodyReader, method)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// bodyReader picks how the body is framed (RFC 9112 section 6.3)
+func (r *Response) bodyReader(reader io.Reader, method string) (io.Reader, error) {
+	if !BodyAllowed(method, r.StatusLine.StatusCode) {
+		return bytes.NewReader(nil), nil
+	}
+
+	if IsChunked(r.Headers) {
+		return &chunkedReader{reader: bufio.NewReader(reader), trailers: r.Trailers}, nil
+	}
+
+	contentLength, err := r.Headers.ContentLength()
+	if err == nil {
+		return &fixedLengthReader{reader: reader, remaining: contentLength}, nil
+	}
+	if !errors.Is(err, headers.ErrMissing) {
+		return nil, fmt.Errorf("invalid Content-Length: %s", r.Headers.Get("Content-Length"))
+	}
+
+	// No framing, the body runs until the connection closes
+	return reader, nil
+}
+
+// BodyAllowed reports whether a response with this status code, answering a
+// request with this method, may carry a body
+func BodyAllowed(method string, code StatusCode) bool {
+	if method == "HEAD" || (code >= 100 && code < 200) || code == 204 || code == 304 {
+		return false
+	}
+	return true
+}
+
+// IsChunked reports whether the headers declare a chunked transfer coding
+func IsChunked(h headers.Headers) bool {
+	codings := strings.Split(h.Get("Transfer-Encoding"), ",")
+	last := strings.TrimSpace(codings[len(codings)-1])
+	return strings.EqualFold(last, "chunked")
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.state != responseStateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return 0, err
+		}
+		totalBytesParsed += n
+		if n == 0 {
+			break
+		}
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case responseStateInitialized:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			// just need more data
+			return 0, nil
+		}
+		statusLine, err := statusLineFromString(string(data[:idx]))
+		if err != nil {
+			return 0, err
+		}
+		r.StatusLine = *statusLine
+		r.state = responseStateParsingHeaders
+		return idx + 2, nil
+	case responseStateParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			r.state = responseStateDone
+		}
+		return n, nil
+	case responseStateDone:
+		return 0, fmt.Errorf("error: trying to read data in a done state")
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+func statusLineFromString(str string) (*StatusLine, error) {
+	// The reason phrase may contain spaces or be missing entirely
+	parts := strings.SplitN(str, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("poorly formatted status-line: %s", str)
+	}
+
+	versionParts := strings.Split(parts[0], "/")
+	if len(versionParts) != 2 || versionParts[0] != "HTTP" {
+		return nil, fmt.Errorf("malformed status-line: %s", str)
+	}
+	if versionParts[1] != "1.1" && versionParts[1] != "1.0" {
+		return nil, fmt.Errorf("unrecognized HTTP-version: %s", versionParts[1])
+	}
+
+	if len(parts[1]) != 3 {
+		return nil, fmt.Errorf("invalid status code: %s", parts[1])
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 {
+		return nil, fmt.Errorf("invalid status code: %s", parts[1])
+	}
+
+	reasonPhrase := ""
+	if len(parts) == 3 {
+		reasonPhrase = parts[2]
+	}
+
+	return &StatusLine{
+		HttpVersion:  versionParts[1],
+		StatusCode:   StatusCode(code),
+		ReasonPhrase: reasonPhrase,
+	}, nil
+}
+
+// fixedLengthReader reads a Content-Length delimited body and reports a
+// truncated body instead of a clean EOF
+type fixedLengthReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (f *fixedLengthReader) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.reader.Read(p)
+	f.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && f.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if f.remaining == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body and collects any trailers
+type chunkedReader struct {
+	reader    *bufio.Reader
+	trailers  headers.Headers
+	remaining int64
+	done      bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		size, err := c.readChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			if err := c.readTrailers(); err != nil {
+				return 0, err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if c.remaining == 0 {
+		// Every chunk's data is followed by CRLF
+		line, err := c.readLine()
+		if err != nil {
+			return n, err
+		}
+		if line != "" {
+			return n, fmt.Errorf("malformed chunk terminator")
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkedReader) readChunkSize() (int64, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return 0, err
+	}
+	// Ignore chunk extensions
+	if idx := strings.IndexByte(line, ';'); idx != -1 {
+		line = line[:idx]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid chunk size: %s", line)
+	}
+	return size, nil
+}
+
+func (c *chunkedReader) readTrailers() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		if _, _, err := c.trailers.Parse([]byte(line + crlf)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
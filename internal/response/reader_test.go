@@ -0,0 +1,67 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Content-Length body
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloEXTRA"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Chunked body with trailers
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"4;ext=1\r\nWiki\r\n5\r\npedia\r\n0\r\nX-Sum: 9\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "Wikipedia", string(body))
+	assert.Equal(t, "9", r.Trailers.Get("X-Sum"))
+
+	// Test: Body runs until close without framing
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 404 Not Found\r\n\r\nall of it"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(404), r.StatusLine.StatusCode)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "all of it", string(body))
+
+	// Test: HEAD responses have no body despite Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"), "HEAD")
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: Truncated Content-Length body
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"), "GET")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Missing reason phrase
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 204\r\n\r\n"), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(204), r.StatusLine.StatusCode)
+
+	// Test: Malformed status line
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 abc OK\r\n\r\n"), "GET")
+	require.Error(t, err)
+
+	// Test: Incomplete headers
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 1"), "GET")
+	require.Error(t, err)
+}
@@ -1,10 +1,13 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
 	"strconv"
+	"strings"
 )
 
 // StatusCode represents an HTTP status code
@@ -12,27 +15,54 @@ type StatusCode int
 
 // HTTP status codes we support
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest         StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusBadRequest                  StatusCode = 400
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusNotAcceptable               StatusCode = 406
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusRequestEntityTooLarge       StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusUpgradeRequired             StatusCode = 426
+	StatusTooManyRequests             StatusCode = 429
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
 
+// statusText maps status codes to their reason phrases
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusBadRequest:                  "Bad Request",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusNotAcceptable:               "Not Acceptable",
+	StatusProxyAuthRequired:           "Proxy Authentication Required",
+	StatusRequestEntityTooLarge:       "Request Entity Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+}
+
+// StatusText returns the reason phrase for the status code, or "" if it is unknown
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
 // WriteStatusLine writes the HTTP status line to the writer
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var reasonPhrase string
-	
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusInternalServerError:
-		reasonPhrase = "Internal Server Error"
-	default:
-		reasonPhrase = ""
-	}
-	
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", int(statusCode), reasonPhrase)
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", int(statusCode), StatusText(statusCode))
 	_, err := w.Write([]byte(statusLine))
 	return err
 }
@@ -48,11 +78,13 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 
 // WriteHeaders writes HTTP headers to the writer
 func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for key, value := range headers {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.Write([]byte(headerLine))
-		if err != nil {
-			return err
+	for key := range headers {
+		for _, value := range headers.Lines(key) {
+			headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+			_, err := w.Write([]byte(headerLine))
+			if err != nil {
+				return err
+			}
 		}
 	}
 	
@@ -72,12 +104,41 @@ const (
 	stateChunkedBodyWriting
 	stateChunkedBodyDone
 	stateTrailersWritten
+	stateHijacked
 )
 
+var (
+	// ErrNotHijackable is returned by Hijack when the writer isn't backed by a connection
+	ErrNotHijackable = errors.New("response writer is not backed by a connection")
+	// ErrHijacked is returned by every method once the connection has been hijacked
+	ErrHijacked = errors.New("connection has been hijacked")
+)
+
+// HijackFunc takes a connection away from its owner. It returns the
+// connection along with any bytes already read from it but not yet consumed.
+type HijackFunc func() (net.Conn, []byte, error)
+
 // Writer provides a structured way to write HTTP responses
 type Writer struct {
 	writer io.Writer
 	state  writerState
+	hijack HijackFunc
+	// header is added to the headers the handler writes
+	header headers.Headers
+	// onHeaders run just before the headers are written
+	onHeaders []func(headers.Headers)
+	// status and bytesWritten record what was sent, for logs and metrics
+	status       StatusCode
+	bytesWritten int64
+	// keepAlive leaves Connection: close out of WriteResponse's headers
+	keepAlive bool
+	// closing, chunked and declaredLength record what the written headers
+	// promised, for Reusable; declaredLength is -1 without Content-Length
+	closing        bool
+	chunked        bool
+	declaredLength int64
+	// requestID is quoted by WriteError so failures can be looked up
+	requestID string
 }
 
 // NewWriter creates a new response writer
@@ -88,8 +149,155 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// NewHijackableWriter creates a response writer on conn whose Hijack hands
+// the connection over using hijack
+func NewHijackableWriter(conn net.Conn, hijack HijackFunc) *Writer {
+	w := NewWriter(conn)
+	w.hijack = hijack
+	return w
+}
+
+// Hijack lets the handler take over the connection, e.g. for protocol upgrades
+// or tunnels. It returns the connection and any bytes the client sent past the
+// end of the request. After Hijack the server no longer manages or closes the
+// connection and the Writer can't be used anymore. Anything written before
+// Hijack has already been sent.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.state == stateHijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijack == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := w.hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.state = stateHijacked
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether Hijack has taken over the connection
+func (w *Writer) Hijacked() bool {
+	return w.state == stateHijacked
+}
+
+// Status returns the status code written, or 0 if none has been yet
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BytesWritten returns how many body bytes have been written, not counting
+// chunked encoding framing
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// SetKeepAlive tells the writer whether the server means to keep the
+// connection open for another request, in which case WriteResponse leaves
+// Connection: close out of its default headers
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetRequestID sets the ID of the request being answered, which WriteError
+// includes in error pages
+func (w *Writer) SetRequestID(id string) {
+	w.requestID = id
+}
+
+// Reusable reports whether the response to a request with method was written
+// completely, framed so the client can tell where it ends, and without asking
+// to close the connection. Only then may the connection carry another request.
+func (w *Writer) Reusable(method string) bool {
+	if w.closing || w.state < stateHeadersWritten || w.state == stateHijacked {
+		return false
+	}
+	switch {
+	case !BodyAllowed(method, w.status):
+		return w.bytesWritten == 0
+	case w.chunked:
+		return w.state == stateTrailersWritten
+	default:
+		return w.declaredLength >= 0 && w.bytesWritten == w.declaredLength
+	}
+}
+
+// Buffer returns a writer that writes to dst instead of the connection,
+// starting with a copy of w's Header and keep-alive setting. Once it holds a
+// complete response, Commit sends that on w. The returned writer can't be
+// hijacked.
+func (w *Writer) Buffer(dst io.Writer) *Writer {
+	b := NewWriter(dst)
+	b.keepAlive = w.keepAlive
+	b.requestID = w.requestID
+	b.onHeaders = append(b.onHeaders, w.onHeaders...)
+	if len(w.header) > 0 {
+		b.header = headers.NewHeaders()
+		for key, value := range w.header {
+			b.header.Override(key, value)
+		}
+	}
+	return b
+}
+
+// Commit sends data, the bytes b wrote to its destination, as w's response
+// and takes over b's record of what was written. Nothing is sent if b wrote
+// nothing.
+func (w *Writer) Commit(b *Writer, data []byte) error {
+	if w.state == stateHijacked {
+		return ErrHijacked
+	}
+	if w.state != stateStart {
+		return fmt.Errorf("buffered response must be committed before anything else is written")
+	}
+	if b.state == stateStart {
+		return nil
+	}
+
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.state = b.state
+	w.status = b.status
+	w.bytesWritten = b.bytesWritten
+	w.closing = b.closing
+	w.chunked = b.chunked
+	w.declaredLength = b.declaredLength
+	return nil
+}
+
+// Header returns headers to be added to the ones passed to WriteHeaders,
+// letting middleware attach headers to responses it doesn't write itself.
+// Where both name the same header, the one passed to WriteHeaders wins,
+// except for Vary whose lists are combined and Set-Cookie where both are
+// sent. Changes after the headers are written have no effect.
+func (w *Writer) Header() headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// OnHeaders registers fn to run just before the headers are written, with
+// the headers Header returns. It lets middleware set headers that depend on
+// what the handler did, such as a session cookie. Writers made by Buffer run
+// the functions registered so far too.
+func (w *Writer) OnHeaders(fn func(h headers.Headers)) {
+	w.onHeaders = append(w.onHeaders, fn)
+}
+
+// DropOnHeaders forgets the functions registered with OnHeaders, for when a
+// writer made by Buffer has them and the two mustn't both run them
+func (w *Writer) DropOnHeaders() {
+	w.onHeaders = nil
+}
+
 // WriteStatusLine writes the HTTP status line
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.state == stateHijacked {
+		return ErrHijacked
+	}
 	if w.state != stateStart {
 		return fmt.Errorf("status line must be written first")
 	}
@@ -97,30 +305,67 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	err := WriteStatusLine(w.writer, statusCode)
 	if err == nil {
 		w.state = stateStatusWritten
+		w.status = statusCode
 	}
 	return err
 }
 
 // WriteHeaders writes the HTTP headers
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if w.state == stateHijacked {
+		return ErrHijacked
+	}
 	if w.state != stateStatusWritten {
 		return fmt.Errorf("headers must be written after status line and before body")
 	}
 	
-	err := WriteHeaders(w.writer, headers)
+	hooks := w.onHeaders
+	w.onHeaders = nil
+	for _, fn := range hooks {
+		fn(w.Header())
+	}
+	if len(w.header) > 0 {
+		merged := headers.NewHeaders()
+		for key, value := range w.header {
+			merged.Override(key, value)
+		}
+		for key, value := range h {
+			merged.Override(key, value)
+		}
+		if vary := mergeVary(w.header.Get("Vary"), h.Get("Vary")); vary != "" {
+			merged.Override("Vary", vary)
+		}
+		if cookies := w.header.Get("Set-Cookie"); cookies != "" && h.Get("Set-Cookie") != "" {
+			merged.Override("Set-Cookie", cookies)
+			merged.Set("Set-Cookie", h.Get("Set-Cookie"))
+		}
+		h = merged
+	}
+	err := WriteHeaders(w.writer, h)
 	if err == nil {
 		w.state = stateHeadersWritten
+		w.closing = headers.HasToken(h.Get("Connection"), "close")
+		w.chunked = IsChunked(h)
+		w.declaredLength = -1
+		if n, err := h.ContentLength(); err == nil {
+			w.declaredLength = n
+		}
 	}
 	return err
 }
 
-// WriteBody writes the response body
+// WriteBody writes the response body. It may be called repeatedly to stream
+// a body whose length was declared up front.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	if w.state != stateHeadersWritten {
+	if w.state == stateHijacked {
+		return 0, ErrHijacked
+	}
+	if w.state != stateHeadersWritten && w.state != stateBodyWritten {
 		return 0, fmt.Errorf("body must be written after headers")
 	}
 	
 	n, err := w.writer.Write(p)
+	w.bytesWritten += int64(n)
 	if err == nil {
 		w.state = stateBodyWritten
 	}
@@ -129,6 +374,9 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 
 // WriteChunkedBody writes a chunk of data using HTTP chunked transfer encoding
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state == stateHijacked {
+		return 0, ErrHijacked
+	}
 	if w.state != stateHeadersWritten && w.state != stateChunkedBodyWriting {
 		return 0, fmt.Errorf("chunked body must be written after headers")
 	}
@@ -146,6 +394,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	
 	// Write chunk data
 	n, err := w.writer.Write(p)
+	w.bytesWritten += int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -162,7 +411,11 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 
 // WriteChunkedBodyDone signals the end of chunked transfer encoding
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	if w.state != stateChunkedBodyWriting {
+	if w.state == stateHijacked {
+		return 0, ErrHijacked
+	}
+	// An empty chunked body goes straight from the headers to the final chunk
+	if w.state != stateChunkedBodyWriting && w.state != stateHeadersWritten {
 		return 0, fmt.Errorf("chunked body done can only be called during chunked transfer")
 	}
 	
@@ -178,16 +431,21 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 
 // WriteTrailers writes HTTP trailers after chunked body
 func (w *Writer) WriteTrailers(trailers headers.Headers) error {
+	if w.state == stateHijacked {
+		return ErrHijacked
+	}
 	if w.state != stateChunkedBodyDone {
 		return fmt.Errorf("trailers can only be written after chunked body is done")
 	}
 	
 	// Write trailers (formatted like headers)
-	for key, value := range trailers {
-		trailerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		_, err := w.writer.Write([]byte(trailerLine))
-		if err != nil {
-			return err
+	for key := range trailers {
+		for _, value := range trailers.Lines(key) {
+			trailerLine := fmt.Sprintf("%s: %s\r\n", key, value)
+			_, err := w.writer.Write([]byte(trailerLine))
+			if err != nil {
+				return err
+			}
 		}
 	}
 	
@@ -199,4 +457,51 @@ func (w *Writer) WriteTrailers(trailers headers.Headers) error {
 	
 	w.state = stateTrailersWritten
 	return nil
-}
\ No newline at end of file
+}
+
+// WriteResponse writes a complete response with a fixed-length body.
+// The default headers are written first and extra headers override them.
+func (w *Writer) WriteResponse(statusCode StatusCode, extra headers.Headers, body []byte) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+
+	responseHeaders := GetDefaultHeaders(len(body))
+	if w.keepAlive {
+		responseHeaders.Delete("Connection")
+	}
+	for key, value := range extra {
+		responseHeaders.Override(key, value)
+	}
+	if err := w.WriteHeaders(responseHeaders); err != nil {
+		return err
+	}
+
+	_, err := w.WriteBody(body)
+	return err
+}
+
+// WriteError writes a plain text response whose body is the status reason
+// phrase, followed by the request ID if one was set
+func (w *Writer) WriteError(statusCode StatusCode, extra headers.Headers) error {
+	body := StatusText(statusCode) + "\n"
+	if w.requestID != "" {
+		body += "Request ID: " + w.requestID + "\n"
+	}
+	return w.WriteResponse(statusCode, extra, []byte(body))
+}
+
+// mergeVary combines two Vary values, leaving out names the first already
+// has. A * in either means the response varies on anything.
+func mergeVary(a, b string) string {
+	if headers.HasToken(a, "*") || headers.HasToken(b, "*") {
+		return "*"
+	}
+	names := headers.SplitList(a)
+	for _, name := range headers.SplitList(b) {
+		if !headers.HasToken(a, name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
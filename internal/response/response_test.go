@@ -0,0 +1,194 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterHijack(t *testing.T) {
+	// Test: Plain writers can't be hijacked
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	_, _, err := w.Hijack()
+	require.ErrorIs(t, err, ErrNotHijackable)
+	assert.False(t, w.Hijacked())
+
+	// Test: Hijack hands over the connection and buffered bytes
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	w = NewHijackableWriter(serverSide, func() (net.Conn, []byte, error) {
+		return serverSide, []byte("extra"), nil
+	})
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, serverSide, conn)
+	assert.Equal(t, "extra", string(buffered))
+	assert.True(t, w.Hijacked())
+
+	// Test: The writer is unusable once hijacked
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrHijacked)
+	_, err = w.WriteBody([]byte("x"))
+	require.ErrorIs(t, err, ErrHijacked)
+	_, _, err = w.Hijack()
+	require.ErrorIs(t, err, ErrHijacked)
+}
+
+func TestWriterHeader(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Header().Override("X-Added", "middleware")
+	w.Header().Override("Content-Type", "text/html")
+
+	// Test: Headers set through Header are added, but the handler's own win
+	extra := headers.NewHeaders()
+	extra.Override("Content-Type", "application/json")
+	require.NoError(t, w.WriteResponse(StatusOK, extra, []byte("{}")))
+	assert.Contains(t, out.String(), "x-added: middleware\r\n")
+	assert.Contains(t, out.String(), "content-type: application/json\r\n")
+	assert.NotContains(t, out.String(), "text/html")
+
+	// Test: The handler's headers aren't modified
+	assert.Empty(t, extra.Get("X-Added"))
+}
+
+func TestWriterOnHeaders(t *testing.T) {
+	// Test: Hooks run once, before the headers are written, and can add to them
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	calls := 0
+	w.OnHeaders(func(h headers.Headers) {
+		calls++
+		h.Override("X-Status", fmt.Sprint(int(w.Status())))
+	})
+	require.NoError(t, w.WriteResponse(StatusOK, nil, []byte("ok")))
+	assert.Equal(t, 1, calls)
+	assert.Contains(t, out.String(), "x-status: 200\r\n")
+
+	// Test: Buffered writers run the hooks registered on their parent
+	out.Reset()
+	var buf bytes.Buffer
+	w = NewWriter(&out)
+	w.OnHeaders(func(h headers.Headers) { h.Override("X-Hook", "ran") })
+	b := w.Buffer(&buf)
+	require.NoError(t, b.WriteResponse(StatusOK, nil, nil))
+	assert.Contains(t, buf.String(), "x-hook: ran\r\n")
+}
+
+func TestWriterMergesVary(t *testing.T) {
+	// Test: Vary from middleware and handler are combined without repeats
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Header().Override("Vary", "Accept, Accept-Language")
+	extra := headers.NewHeaders()
+	extra.Override("Vary", "accept-language, Origin")
+	require.NoError(t, w.WriteResponse(StatusOK, extra, []byte("ok")))
+	assert.Contains(t, out.String(), "vary: Accept, Accept-Language, Origin\r\n")
+
+	// Test: A * in either wins
+	assert.Equal(t, "*", mergeVary("Accept", "*"))
+	assert.Equal(t, "Accept", mergeVary("", "Accept"))
+}
+
+func TestWriterBuffer(t *testing.T) {
+	var out, buf bytes.Buffer
+	w := NewWriter(&out)
+	w.Header().Override("X-Added", "middleware")
+	w.SetKeepAlive(true)
+
+	// Test: A buffered writer keeps Header and keep-alive but writes elsewhere
+	b := w.Buffer(&buf)
+	require.NoError(t, b.WriteResponse(StatusOK, nil, []byte("hello")))
+	assert.Empty(t, out.String())
+	assert.Contains(t, buf.String(), "x-added: middleware\r\n")
+	assert.NotContains(t, buf.String(), "connection")
+
+	// Test: Commit sends the buffered response and its record
+	require.NoError(t, w.Commit(b, buf.Bytes()))
+	assert.Equal(t, buf.String(), out.String())
+	assert.Equal(t, StatusOK, w.Status())
+	assert.Equal(t, int64(5), w.BytesWritten())
+	assert.True(t, w.Reusable("GET"))
+	assert.Error(t, w.Commit(b, buf.Bytes()))
+
+	// Test: Committing an empty buffer sends nothing
+	w = NewWriter(&out)
+	out.Reset()
+	require.NoError(t, w.Commit(w.Buffer(&buf), nil))
+	assert.Empty(t, out.String())
+	assert.Equal(t, StatusCode(0), w.Status())
+}
+
+func TestWriterRecordsStatusAndBytes(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	assert.Equal(t, StatusCode(0), w.Status())
+
+	// Test: The status and body bytes are recorded, without chunk framing
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte(" world"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, w.Status())
+	assert.Equal(t, int64(11), w.BytesWritten())
+
+	// Test: Fixed-length bodies are counted too
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteResponse(StatusBadRequest, nil, []byte("bad")))
+	assert.Equal(t, StatusBadRequest, w.Status())
+	assert.Equal(t, int64(3), w.BytesWritten())
+}
+
+func TestWriterReusable(t *testing.T) {
+	// Test: Default headers ask to close unless the server keeps the connection alive
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	require.NoError(t, w.WriteResponse(StatusOK, nil, []byte("hi")))
+	assert.Contains(t, out.String(), "connection: close")
+	assert.False(t, w.Reusable("GET"))
+
+	out.Reset()
+	w = NewWriter(&out)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteResponse(StatusOK, nil, []byte("hi")))
+	assert.NotContains(t, out.String(), "connection")
+	assert.True(t, w.Reusable("GET"))
+
+	// Test: A body shorter than its Content-Length leaves the connection unusable
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Override("Content-Length", "10")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("short"))
+	require.NoError(t, err)
+	assert.False(t, w.Reusable("GET"))
+
+	// Test: Chunked bodies are complete once the trailers are written
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Override("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.False(t, w.Reusable("GET"))
+	require.NoError(t, w.WriteTrailers(nil))
+	assert.True(t, w.Reusable("GET"))
+
+	// Test: HEAD responses need no body
+	w = NewWriter(&out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Override("Content-Length", "10")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.True(t, w.Reusable("HEAD"))
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLogMessage is the message of every record AccessLog emits
+const accessLogMessage = "request"
+
+// clfTimeFormat is the timestamp layout of Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog returns middleware that logs every request to logger once the
+// handler returns, as an Info record with the message "request" and these
+// attributes: method, target, proto, status, bytes (of body written),
+// duration, client, request_id, referer and user_agent. Log through a
+// slog.JSONHandler for JSON lines or a CLFHandler for Common or Combined Log
+// Format.
+func AccessLog(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			logger.LogAttrs(context.Background(), slog.LevelInfo, accessLogMessage,
+				slog.String("method", req.RequestLine.Method),
+				slog.String("target", req.RequestLine.RequestTarget),
+				slog.String("proto", "HTTP/"+req.RequestLine.HttpVersion),
+				slog.Int("status", int(w.Status())),
+				slog.Int64("bytes", w.BytesWritten()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("client", req.RemoteAddr),
+				slog.String("request_id", req.ID),
+				slog.String("referer", req.Headers.Get("Referer")),
+				slog.String("user_agent", req.Headers.Get("User-Agent")),
+			)
+		}
+	}
+}
+
+// CLFHandler is a slog.Handler that writes the records of AccessLog in
+// Common Log Format, or Combined Log Format which adds the referer and user
+// agent. Other records are written by a slog.TextHandler on the same writer.
+type CLFHandler struct {
+	w        io.Writer
+	combined bool
+	mu       *sync.Mutex
+	attrs    []slog.Attr
+	// grouped is set once WithGroup is used, after which attributes no
+	// longer have the names access records are recognised by
+	grouped bool
+	text    slog.Handler
+}
+
+// NewCLFHandler creates a handler writing Common Log Format lines to w, or
+// Combined Log Format lines if combined is set
+func NewCLFHandler(w io.Writer, combined bool) *CLFHandler {
+	return &CLFHandler{w: w, combined: combined, mu: &sync.Mutex{}, text: slog.NewTextHandler(w, nil)}
+}
+
+// Enabled implements slog.Handler
+func (h *CLFHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *CLFHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message != accessLogMessage || h.grouped {
+		return h.text.Handle(ctx, r)
+	}
+	fields := make(map[string]slog.Value, len(h.attrs)+r.NumAttrs())
+	for _, a := range h.attrs {
+		fields[a.Key] = a.Value.Resolve()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fields[a.Key] = a.Value.Resolve()
+		return true
+	})
+	if _, ok := fields["status"]; !ok {
+		return h.text.Handle(ctx, r)
+	}
+
+	host := fields["client"].String()
+	if ip, _, err := net.SplitHostPort(host); err == nil {
+		host = ip
+	}
+	bytes := "-"
+	if n := intField(fields["bytes"]); n > 0 {
+		bytes = strconv.FormatInt(n, 10)
+	}
+	// Quoting escapes quotes and control characters, so clients can't forge lines
+	requestLine := fmt.Sprintf("%s %s %s", fields["method"], fields["target"], fields["proto"])
+	line := fmt.Sprintf("%s - - [%s] %s %d %s",
+		orDash(host), r.Time.Format(clfTimeFormat), strconv.Quote(requestLine), intField(fields["status"]), bytes)
+	if h.combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(orDash(fields["referer"].String())), strconv.Quote(orDash(fields["user_agent"].String())))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+// WithAttrs implements slog.Handler
+func (h *CLFHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	clone.text = h.text.WithAttrs(attrs)
+	return &clone
+}
+
+// WithGroup implements slog.Handler
+func (h *CLFHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.grouped = true
+	clone.text = h.text.WithGroup(name)
+	return &clone
+}
+
+// intField returns an integer attribute, or 0 if it is missing or of another kind
+func intField(v slog.Value) int64 {
+	if v.Kind() != slog.KindInt64 {
+		return 0
+	}
+	return v.Int64()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
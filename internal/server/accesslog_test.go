@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte("hello"))
+	}
+	serveLogged := func(logger *slog.Logger) {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/a?b=1", HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+			RemoteAddr:  "192.0.2.7:5555",
+		}
+		req.Headers.Override("User-Agent", `curl/8 "quoted"`)
+		req.ID = "req-1"
+		AccessLog(logger)(handler)(response.NewWriter(io.Discard), req)
+	}
+
+	// Test: JSON records carry every field
+	var out bytes.Buffer
+	serveLogged(slog.New(slog.NewJSONHandler(&out, nil)))
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "GET", record["method"])
+	assert.Equal(t, "/a?b=1", record["target"])
+	assert.Equal(t, float64(200), record["status"])
+	assert.Equal(t, float64(5), record["bytes"])
+	assert.Equal(t, "192.0.2.7:5555", record["client"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Contains(t, record, "duration")
+
+	// Test: Common Log Format
+	out.Reset()
+	serveLogged(slog.New(NewCLFHandler(&out, false)))
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=1 HTTP/1\.1" 200 5\n$`), out.String())
+
+	// Test: Combined Log Format escapes quotes in client supplied fields
+	out.Reset()
+	serveLogged(slog.New(NewCLFHandler(&out, true)))
+	assert.Contains(t, out.String(), `200 5 "-" "curl/8 \"quoted\""`+"\n")
+
+	// Test: Other records fall back to text
+	out.Reset()
+	slog.New(NewCLFHandler(&out, true)).Info("server started", "addr", ":80")
+	assert.Contains(t, out.String(), `msg="server started" addr=:80`)
+}
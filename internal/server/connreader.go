@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline in the past, which makes a blocked Read
+// return at once
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader reads requests off a connection. While a handler runs and the
+// client has nothing more to send, it keeps one read waiting in the
+// background so that a client hanging up cancels the request's context.
+type connReader struct {
+	conn net.Conn
+
+	mu sync.Mutex
+	// pending holds the byte a background read returned, for the next request
+	pending []byte
+	// done is closed when the background read in progress returns
+	done chan struct{}
+	// gone is set once a background read found the connection ended
+	gone bool
+}
+
+// Read implements io.Reader, returning any byte read in the background first
+func (r *connReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		r.mu.Unlock()
+		return n, nil
+	}
+	r.mu.Unlock()
+	return r.conn.Read(p)
+}
+
+// startBackgroundRead waits for the connection to end in the background,
+// calling onEnd if it does. A byte of a pipelined request is kept for Read.
+func (r *connReader) startBackgroundRead(onEnd func()) {
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.done = done
+	r.mu.Unlock()
+	go func() {
+		defer close(done)
+		var b [1]byte
+		n, err := r.conn.Read(b[:])
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if n > 0 {
+			r.pending = append(r.pending, b[0])
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Aborted by stopBackgroundRead
+			return
+		}
+		r.gone = true
+		onEnd()
+	}()
+}
+
+// stopBackgroundRead aborts the background read and waits for it to return.
+// It reports whether the connection is still usable.
+func (r *connReader) stopBackgroundRead() bool {
+	r.mu.Lock()
+	done := r.done
+	r.done = nil
+	r.mu.Unlock()
+	if done != nil {
+		r.conn.SetReadDeadline(aLongTimeAgo)
+		<-done
+		r.conn.SetReadDeadline(time.Time{})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.gone
+}
+
+// buffered returns and forgets the bytes a background read kept
+func (r *connReader) buffered() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := r.pending
+	r.pending = nil
+	return pending
+}
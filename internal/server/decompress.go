@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// DecompressRequests returns middleware that transparently decodes gzip and
+// deflate request bodies before the handler sees them. Bodies that decode to
+// more than maxSize bytes are rejected with 413, unknown encodings with 415.
+func DecompressRequests(maxSize int64) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			err := req.DecodeBody(maxSize)
+			switch {
+			case err == nil:
+				next(w, req)
+			case errors.Is(err, request.ErrUnsupportedEncoding):
+				// Tell the client which encodings we do accept (RFC 7694)
+				extra := headers.NewHeaders()
+				extra.Override("Accept-Encoding", request.SupportedEncodings)
+				w.WriteError(response.StatusUnsupportedMediaType, extra)
+			case errors.Is(err, request.ErrDecodedBodyTooLarge):
+				w.WriteError(response.StatusRequestEntityTooLarge, nil)
+			default:
+				w.WriteError(response.StatusBadRequest, nil)
+			}
+		}
+	}
+}
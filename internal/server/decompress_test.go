@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecompressRequests(t *testing.T) {
+	var got *request.Request
+	handler := DecompressRequests(16)(func(w *response.Writer, req *request.Request) {
+		got = req
+		w.WriteResponse(response.StatusOK, nil, nil)
+	})
+	serve := func(encoding string, body []byte) string {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "POST", RequestTarget: "/", HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+			Body:        body,
+		}
+		req.Headers.Override("Content-Encoding", encoding)
+		req.Headers.Override("Content-Length", "999")
+		var out bytes.Buffer
+		got = nil
+		handler(response.NewWriter(&out), req)
+		return out.String()
+	}
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	// Test: Decoded bodies reach the handler with Content-Encoding removed
+	// and Content-Length matching
+	out := serve("gzip", gzipped("hello"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+	require.NotNil(t, got)
+	assert.Equal(t, "hello", string(got.Body))
+	assert.Empty(t, got.Headers.Get("Content-Encoding"))
+	assert.Equal(t, "5", got.Headers.Get("Content-Length"))
+
+	// Test: Unknown codings get a 415 listing the ones we accept
+	out = serve("br", []byte("x"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"), out)
+	assert.Contains(t, strings.ToLower(out), "accept-encoding: gzip, deflate\r\n")
+	assert.Nil(t, got)
+
+	// Test: Bodies decoding past the limit get a 413
+	out = serve("gzip", gzipped(strings.Repeat("a", 17)))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 "), out)
+	assert.Nil(t, got)
+
+	// Test: Bodies that don't decode get a 400
+	out = serve("gzip", []byte("not gzip"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	assert.Nil(t, got)
+}
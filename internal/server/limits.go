@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Accept errors are retried after a delay that doubles from minAcceptDelay up to maxAcceptDelay
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// rejectTimeout bounds how long writing a 503 to a rejected connection may take
+const rejectTimeout = time.Second
+
+var (
+	errTooManyConns      = errors.New("server: too many connections")
+	errTooManyConnsPerIP = errors.New("server: too many connections from one address")
+)
+
+// LimitPolicy says what happens to connections beyond Server.MaxConns
+type LimitPolicy int
+
+const (
+	// LimitReject answers connections beyond the limit with 503 Service
+	// Unavailable and closes them
+	LimitReject LimitPolicy = iota
+	// LimitPause stops accepting until a connection finishes, leaving new
+	// ones waiting in the listen backlog
+	LimitPause
+)
+
+// ConnStats counts what happened to the connections a server accepted
+type ConnStats struct {
+	// Accepted counts connections that were handled
+	Accepted uint64
+	// Active is the number of connections open right now
+	Active int
+	// RejectedMaxConns and RejectedPerIP count connections turned away by
+	// MaxConns and MaxConnsPerIP
+	RejectedMaxConns uint64
+	RejectedPerIP    uint64
+	// AcceptErrors counts failed Accept calls, each followed by a backoff
+	AcceptErrors uint64
+	// Requests counts HTTP/1.1 requests read, and KeepAliveReuses the ones
+	// among them that arrived on a connection that had already served one
+	Requests        uint64
+	KeepAliveReuses uint64
+	// ParseErrors counts malformed requests by kind: request_line, header,
+	// content_length, incomplete, body_too_large, timeout or other
+	ParseErrors map[string]uint64
+}
+
+// connCounters are updated without holding the server's lock
+type connCounters struct {
+	accepted         atomic.Uint64
+	rejectedMaxConns atomic.Uint64
+	rejectedPerIP    atomic.Uint64
+	acceptErrors     atomic.Uint64
+	requests         atomic.Uint64
+	keepAliveReuses  atomic.Uint64
+}
+
+// Stats returns the server's connection counters
+func (s *Server) Stats() ConnStats {
+	s.mu.Lock()
+	active := len(s.conns)
+	parseErrors := make(map[string]uint64, len(s.parseErrors))
+	for kind, n := range s.parseErrors {
+		parseErrors[kind] = n
+	}
+	s.mu.Unlock()
+	return ConnStats{
+		Accepted:         s.stats.accepted.Load(),
+		Active:           active,
+		RejectedMaxConns: s.stats.rejectedMaxConns.Load(),
+		RejectedPerIP:    s.stats.rejectedPerIP.Load(),
+		AcceptErrors:     s.stats.acceptErrors.Load(),
+		Requests:         s.stats.requests.Load(),
+		KeepAliveReuses:  s.stats.keepAliveReuses.Load(),
+		ParseErrors:      parseErrors,
+	}
+}
+
+// countParseError records a malformed request under its kind
+func (s *Server) countParseError(err error) {
+	var kind string
+	switch {
+	case errors.Is(err, request.ErrMalformedRequestLine):
+		kind = "request_line"
+	case errors.Is(err, request.ErrMalformedHeader):
+		kind = "header"
+	case errors.Is(err, request.ErrInvalidContentLength):
+		kind = "content_length"
+	case errors.Is(err, request.ErrIncompleteRequest):
+		kind = "incomplete"
+	case errors.Is(err, request.ErrBodyTooLarge):
+		kind = "body_too_large"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		kind = "timeout"
+	default:
+		kind = "other"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parseErrors == nil {
+		s.parseErrors = make(map[string]uint64)
+	}
+	s.parseErrors[kind]++
+}
+
+// waitForSlot blocks while MaxConns is reached under LimitPause. It reports
+// false if the server closed meanwhile.
+func (s *Server) waitForSlot() bool {
+	if s.MaxConns <= 0 || s.OverLimit != LimitPause {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connDone == nil {
+		s.connDone = sync.NewCond(&s.mu)
+	}
+	for len(s.conns) >= s.MaxConns && !s.closed.Load() {
+		s.connDone.Wait()
+	}
+	return !s.closed.Load()
+}
+
+// nextAcceptDelay doubles the backoff after a failed Accept
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	return min(2*delay, maxAcceptDelay)
+}
+
+// reject answers a connection over a limit with 503 and closes it
+func reject(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	h := headers.NewHeaders()
+	h.Override("Retry-After", "1")
+	response.NewWriter(conn).WriteError(response.StatusServiceUnavailable, h)
+}
+
+// clientIP returns the IP a connection comes from, or "" for connections
+// without one such as Unix sockets
+func clientIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimits(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteResponse(response.StatusOK, nil, nil)
+	}
+
+	// Test: Connections over MaxConns get a 503 and are counted
+	server, addr := serveLocal(t, &Server{Handler: handler, MaxConns: 1})
+	first := sendRequest(t, addr)
+	<-started
+	resp := readResponse(t, sendRequest(t, addr))
+	assert.Equal(t, response.StatusServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Equal(t, "1", resp.Headers.Get("Retry-After"))
+	release <- struct{}{}
+	assert.Equal(t, response.StatusOK, readResponse(t, first).StatusLine.StatusCode)
+	stats := server.Stats()
+	assert.Equal(t, uint64(1), stats.Accepted)
+	assert.Equal(t, uint64(1), stats.RejectedMaxConns)
+
+	// Test: Connections over MaxConnsPerIP get a 503 and are counted
+	server, addr = serveLocal(t, &Server{Handler: handler, MaxConnsPerIP: 1})
+	first = sendRequest(t, addr)
+	<-started
+	resp = readResponse(t, sendRequest(t, addr))
+	assert.Equal(t, response.StatusServiceUnavailable, resp.StatusLine.StatusCode)
+	release <- struct{}{}
+	assert.Equal(t, uint64(1), server.Stats().RejectedPerIP)
+
+	// Test: With LimitPause connections over MaxConns wait their turn
+	server, addr = serveLocal(t, &Server{Handler: handler, MaxConns: 1, OverLimit: LimitPause})
+	first = sendRequest(t, addr)
+	<-started
+	second := sendRequest(t, addr)
+	select {
+	case <-started:
+		t.Fatal("second connection was handled while the first was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	assert.Equal(t, response.StatusOK, readResponse(t, first).StatusLine.StatusCode)
+	assert.Equal(t, response.StatusOK, readResponse(t, second).StatusLine.StatusCode)
+	assert.Equal(t, uint64(0), server.Stats().RejectedMaxConns)
+
+	// Test: A connection that never sends a request is closed after
+	// HeaderTimeout and counted
+	server, addr = serveLocal(t, &Server{Handler: handler, HeaderTimeout: 50 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"timeout": 1}, server.Stats().ParseErrors)
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	// Test: The delay doubles up to the cap
+	assert.Equal(t, minAcceptDelay, nextAcceptDelay(0))
+	assert.Equal(t, 2*minAcceptDelay, nextAcceptDelay(minAcceptDelay))
+	assert.Equal(t, maxAcceptDelay, nextAcceptDelay(maxAcceptDelay))
+
+	// Test: Failed accepts are retried and counted instead of stopping the server
+	listener := &failingListener{failures: 3}
+	server := &Server{Handler: nopHandler}
+	assert.ErrorIs(t, server.Serve(listener), net.ErrClosed)
+	assert.Equal(t, uint64(3), server.Stats().AcceptErrors)
+}
+
+func TestKeepAlive(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte("hi"))
+	}
+
+	// Test: Requests on a kept-alive connection are served and counted as reuses
+	server, addr := serveLocal(t, &Server{Handler: handler, KeepAlive: true})
+	conn := sendRequest(t, addr)
+	resp := readResponse(t, conn)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Empty(t, resp.Headers.Get("Connection"))
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, readResponse(t, conn).StatusLine.StatusCode)
+	stats := server.Stats()
+	assert.Equal(t, uint64(2), stats.Requests)
+	assert.Equal(t, uint64(1), stats.KeepAliveReuses)
+
+	// Test: Without KeepAlive the connection closes after one response
+	_, addr = serveLocal(t, &Server{Handler: handler})
+	conn = sendRequest(t, addr)
+	assert.Equal(t, "close", readResponse(t, conn).Headers.Get("Connection"))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Malformed requests are counted by kind
+	server, addr = serveLocal(t, &Server{Handler: handler, KeepAlive: true})
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusBadRequest, readResponse(t, conn).StatusLine.StatusCode)
+	assert.Equal(t, map[string]uint64{"request_line": 1}, server.Stats().ParseErrors)
+
+	// Test: Bodies declared over MaxBodySize get a 413 before being sent
+	server, addr = serveLocal(t, &Server{Handler: handler, MaxBodySize: 4})
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusRequestEntityTooLarge, readResponse(t, conn).StatusLine.StatusCode)
+	assert.Equal(t, map[string]uint64{"body_too_large": 1}, server.Stats().ParseErrors)
+}
+
+// failingListener fails Accept a number of times, then reports being closed
+type failingListener struct {
+	failures int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, errors.New("accept: too many open files")
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error   { return nil }
+func (l *failingListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+// serveLocal serves s on a loopback port until the test ends
+func serveLocal(t *testing.T, s *Server) (*Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+	return s, listener.Addr().String()
+}
+
+// sendRequest sends a GET on a new connection
+func sendRequest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return conn
+}
+
+// readResponse reads the response to a request sent with sendRequest
+func readResponse(t *testing.T, conn net.Conn) *response.Response {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := response.ResponseFromReader(conn, "GET")
+	require.NoError(t, err)
+	return resp
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor a supervisor passes sockets
+// in, as systemd's SD_LISTEN_FDS_START
+const listenFDsStart = 3
+
+// Listen opens a listener for addr, which is one of:
+//
+//	"host:port" or ":port"   TCP, IPv6 hosts in brackets ("[::1]:8080")
+//	"tcp4:host:port"         TCP over IPv4 only
+//	"tcp6:host:port"         TCP over IPv6 only
+//	"unix:/path/to.sock"     a Unix domain socket
+//
+// A Unix socket file left behind by a process that died is replaced, but
+// one that still accepts connections is not.
+func Listen(addr string) (net.Listener, error) {
+	network, address := splitNetwork(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	listener, err := net.Listen("unix", address)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return listener, err
+	}
+	if conn, dialErr := net.Dial("unix", address); dialErr == nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := os.Remove(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", address)
+}
+
+// splitNetwork splits an optional network prefix off a listen address
+func splitNetwork(addr string) (network, address string) {
+	for _, network := range []string{"unix", "tcp4", "tcp6"} {
+		if rest, ok := strings.CutPrefix(addr, network+":"); ok {
+			return network, rest
+		}
+	}
+	return "tcp", addr
+}
+
+// InheritedListeners returns the listening sockets a supervisor passed to
+// this process the way systemd socket activation does: LISTEN_FDS sockets
+// starting at file descriptor 3, meant for the process LISTEN_PID names.
+// Since a parent can't know its child's pid before starting it, Restart sets
+// LISTEN_PARENT_PID to its own pid instead. It returns nothing when no
+// sockets were passed or they were meant for another process. The variables
+// are unset so child processes don't claim the sockets too.
+func InheritedListeners() ([]net.Listener, error) {
+	pid, parentPID, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_PARENT_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_PARENT_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) && parentPID != strconv.Itoa(os.Getppid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		// FileListener works on a duplicate, so the original is closed either way
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerServe(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte(req.RemoteAddr))
+	}
+	server := &Server{Handler: handler}
+
+	// Test: A provided listener bound to loopback only is served
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	body := get(t, "tcp", listener.Addr().String())
+	assert.Contains(t, body, "127.0.0.1:")
+	assert.Eventually(t, func() bool { return len(server.Addrs()) == 1 }, time.Second, time.Millisecond)
+
+	// Test: Close stops Serve with ErrServerClosed and refuses new listeners
+	require.NoError(t, server.Close())
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.ErrorIs(t, server.Serve(other), ErrServerClosed)
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		w.WriteResponse(response.StatusOK, nil, []byte("finished"))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	server := &Server{Handler: handler}
+	go server.Serve(listener)
+
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	body := make(chan string, 1)
+	go func() { body <- get(t, "tcp", addr) }()
+	<-started
+
+	// Test: Shutdown waits for requests in progress
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Test: Connections that haven't sent anything are closed and new ones refused
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// Test: The request in progress still completes
+	close(release)
+	assert.Equal(t, "finished", <-body)
+	require.NoError(t, server.Shutdown(context.Background()))
+}
+
+func TestRequestContext(t *testing.T) {
+	started := make(chan struct{}, 1)
+	canceled := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-req.Context().Done()
+		canceled <- req.Context().Err()
+	}
+
+	// Test: The context is canceled when the client hangs up
+	server, addr := serveLocal(t, &Server{Handler: handler})
+	conn := sendRequest(t, addr)
+	<-started
+	conn.Close()
+	select {
+	case err := <-canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled on disconnect")
+	}
+
+	// Test: The context is canceled when the server closes
+	sendRequest(t, addr)
+	<-started
+	server.Close()
+	select {
+	case err := <-canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled on close")
+	}
+
+	// Test: A pipelined request is still served after the handler is watched
+	handler = func(w *response.Writer, req *request.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteResponse(response.StatusOK, nil, []byte(req.RequestLine.RequestTarget))
+	}
+	_, addr = serveLocal(t, &Server{Handler: handler, KeepAlive: true})
+	conn = sendRequest(t, addr)
+	time.Sleep(5 * time.Millisecond)
+	_, err := conn.Write([]byte("GET /second HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(out, []byte("HTTP/1.1 200 OK")))
+	assert.True(t, bytes.HasSuffix(out, []byte("\r\n\r\n/second")), "got %q", out)
+}
+
+func TestListen(t *testing.T) {
+	// Test: Unix domain sockets are served
+	path := filepath.Join(t.TempDir(), "http.sock")
+	listener, err := Listen("unix:" + path)
+	require.NoError(t, err)
+	server := &Server{Handler: nopHandler}
+	go server.Serve(listener)
+	defer server.Close()
+	assert.Empty(t, get(t, "unix", path))
+
+	// Test: A socket that is still accepting isn't taken over
+	_, err = Listen("unix:" + path)
+	require.Error(t, err)
+
+	// Test: A stale socket file from a dead process is replaced
+	stalePath := filepath.Join(t.TempDir(), "stale.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(stalePath)
+	require.NoError(t, err)
+	listener, err = Listen("unix:" + stalePath)
+	require.NoError(t, err)
+	listener.Close()
+
+	// Test: Network prefixes restrict the address family
+	listener, err = Listen("tcp4:127.0.0.1:0")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", listener.Addr().Network())
+	listener.Close()
+	_, err = Listen("tcp4:[::1]:0")
+	require.Error(t, err)
+}
+
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv("TEST_INHERITED_LISTENERS") != "" {
+		// Running as the child
+		listeners, err := InheritedListeners()
+		require.NoError(t, err)
+		require.Len(t, listeners, 1)
+		assert.Equal(t, os.Getenv("TEST_INHERITED_LISTENERS"), listeners[0].Addr().String())
+		assert.Empty(t, os.Getenv("LISTEN_FDS"))
+		server := &Server{Handler: nopHandler}
+		go server.Serve(listeners[0])
+		time.Sleep(time.Second)
+		return
+	}
+
+	// Test: Sockets passed as fd 3 onwards are served by the child
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$")
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_PARENT_PID="+strconv.Itoa(os.Getpid()), "TEST_INHERITED_LISTENERS="+listener.Addr().String())
+	cmd.ExtraFiles = []*os.File{file}
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	require.NoError(t, cmd.Start())
+	// Close our copies so only the child accepts
+	listener.Close()
+	file.Close()
+	assert.Eventually(t, func() bool {
+		c := client.New()
+		c.Dial = func(_ string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", listener.Addr().String(), timeout)
+		}
+		resp, err := c.Get("http://localhost/")
+		return err == nil && resp.StatusLine.StatusCode == response.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.NoError(t, cmd.Wait(), output.String())
+
+	// Test: Sockets meant for another process are ignored
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+}
+
+// get fetches / from a server listening on network and address and returns the body
+func get(t *testing.T, network, address string) string {
+	t.Helper()
+	c := client.New()
+	c.Dial = func(_ string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, address, timeout)
+	}
+	resp, err := c.Get("http://localhost/")
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	return string(body)
+}
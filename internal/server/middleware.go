@@ -0,0 +1,13 @@
+package server
+
+// Middleware wraps a Handler to add behaviour before or after it runs
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with the given middleware. The first middleware is the
+// outermost, so it sees the request first and the response last.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"time"
+)
+
+// maxRequestIDLength bounds inbound request IDs, so clients can't bloat logs
+const maxRequestIDLength = 128
+
+// crockford is the base32 alphabet of generated IDs, which sorts the same
+// as the values it encodes and leaves out letters that look like digits
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// RequestID returns middleware that gives every request an ID, stored in
+// req.ID for logs and proxies, sent back in the X-Request-ID response header
+// and quoted by error pages. If trustInbound is set, an X-Request-ID the
+// client sent is used as long as it is valid; otherwise a new ID is
+// generated with NewRequestID.
+func RequestID(trustInbound bool) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id := req.Headers.Get(request.IDHeader)
+			if !trustInbound || !ValidRequestID(id) {
+				id = NewRequestID()
+			}
+			req.ID = id
+			w.Header().Override(request.IDHeader, id)
+			w.SetRequestID(id)
+			next(w, req)
+		}
+	}
+}
+
+// ValidRequestID reports whether id is 1 to 128 characters of letters,
+// digits and -_.: only, which keeps it safe to log and to pass on
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID generates a unique ID in the ULID layout: 26 characters
+// encoding the current time in milliseconds followed by 80 random bits, so
+// IDs sort by when they were made
+func NewRequestID() string {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(b[:6], ms[2:])
+	rand.Read(b[6:])
+
+	// 128 bits make 26 base32 digits, the first holding only the top 3 bits
+	var id [26]byte
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
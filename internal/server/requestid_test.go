@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := func(w *response.Writer, req *request.Request) {
+		seen = req.ID
+		w.WriteError(response.StatusBadGateway, nil)
+	}
+	serve := func(trustInbound bool, inbound string) (*request.Request, string) {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+		}
+		if inbound != "" {
+			req.Headers.Override("X-Request-ID", inbound)
+		}
+		var out bytes.Buffer
+		RequestID(trustInbound)(handler)(response.NewWriter(&out), req)
+		return req, out.String()
+	}
+
+	// Test: A valid inbound ID is trusted, stored, echoed and shown on error pages
+	req, out := serve(true, "abc-123")
+	assert.Equal(t, "abc-123", req.ID)
+	assert.Equal(t, "abc-123", seen)
+	assert.Contains(t, out, "x-request-id: abc-123\r\n")
+	assert.True(t, strings.HasSuffix(out, "Bad Gateway\nRequest ID: abc-123\n"), "got %q", out)
+
+	// Test: Invalid inbound IDs are replaced
+	for _, inbound := range []string{"has space", "new\nline", strings.Repeat("a", 129)} {
+		req, _ = serve(true, inbound)
+		assert.NotEqual(t, inbound, req.ID)
+		assert.Len(t, req.ID, 26)
+	}
+
+	// Test: Inbound IDs are ignored unless trusted
+	req, out = serve(false, "abc-123")
+	assert.Len(t, req.ID, 26)
+	assert.Contains(t, out, "x-request-id: "+req.ID+"\r\n")
+
+	// Test: Generated IDs are unique and sort by creation time
+	first := NewRequestID()
+	time.Sleep(2 * time.Millisecond)
+	second := NewRequestID()
+	require.Len(t, first, 26)
+	assert.Less(t, first, second)
+	assert.True(t, ValidRequestID(first))
+	assert.NotEqual(t, NewRequestID(), NewRequestID())
+}
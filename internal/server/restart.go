@@ -0,0 +1,118 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// readyFDEnv names the file descriptor a restarted child reports readiness on
+const readyFDEnv = "RESTART_READY_FD"
+
+// Restart starts a new copy of the running executable with the same
+// arguments and hands it listeners, which it picks up with
+// InheritedListeners. It returns once the child calls Ready, after which the
+// caller should stop accepting and drain with Shutdown. If the child exits or
+// doesn't become ready within timeout it is killed and the caller keeps
+// serving.
+func Restart(listeners []net.Listener, timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("restart: %w", err)
+	}
+
+	// The sockets are passed by descriptor rather than through os/exec, which
+	// would switch them to blocking mode under our own accept loops
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, listener := range listeners {
+		fd, err := listenerFD(listener)
+		if err != nil {
+			return nil, fmt.Errorf("restart: %w", err)
+		}
+		fds = append(fds, fd)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("restart: %w", err)
+	}
+	defer ready.Close()
+	fds = append(fds, readyWriter.Fd())
+
+	env := append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(listeners)),
+		"LISTEN_PARENT_PID="+strconv.Itoa(os.Getpid()),
+		readyFDEnv+"="+strconv.Itoa(listenFDsStart+len(listeners)),
+	)
+	pid, err := syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{Env: env, Files: fds})
+	// Only the child may hold the write end, so its exit shows up as EOF
+	readyWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("restart: %w", err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil, fmt.Errorf("restart: %w", err)
+	}
+
+	ready.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		process.Kill()
+		process.Wait()
+		return nil, fmt.Errorf("restart: new process didn't become ready: %w", err)
+	}
+	// Reap the child whenever it exits, so it doesn't linger as a zombie
+	go process.Wait()
+
+	// The child serves Unix sockets now, so closing ours mustn't remove the file
+	for _, listener := range listeners {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+	return process, nil
+}
+
+// listenerFD returns the descriptor behind a TCP or Unix listener. It stays
+// valid for as long as the listener is open.
+func listenerFD(listener net.Listener) (uintptr, error) {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("can't hand over %T", listener)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd uintptr
+	if err := raw.Control(func(s uintptr) { fd = s }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// Ready tells the parent that started this process with Restart that it is
+// serving, so the parent may stop. It does nothing in processes started any
+// other way.
+func Ready() error {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < listenFDsStart {
+		return fmt.Errorf("invalid %s %q", readyFDEnv, fd)
+	}
+	file := os.NewFile(uintptr(n), "restart-ready")
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		return fmt.Errorf("restart: notifying parent: %w", err)
+	}
+	return nil
+}
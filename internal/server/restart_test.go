@@ -0,0 +1,66 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestart(t *testing.T) {
+	if os.Getenv("TEST_RESTART_CHILD") != "" {
+		// Running as the child: serve what was handed over, then exit quietly
+		if os.Getenv("TEST_RESTART_CHILD") == "fail" {
+			os.Exit(1)
+		}
+		listeners, err := InheritedListeners()
+		if err != nil || len(listeners) != 1 {
+			os.Exit(1)
+		}
+		server := &Server{Handler: func(w *response.Writer, req *request.Request) {
+			w.WriteResponse(response.StatusOK, nil, []byte("child"))
+		}}
+		go server.Serve(listeners[0])
+		if Ready() != nil {
+			os.Exit(1)
+		}
+		time.Sleep(time.Second)
+		os.Exit(0)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	server := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte("parent"))
+	}}
+	go server.Serve(listener)
+	assert.Equal(t, "parent", get(t, "tcp", addr))
+
+	// The child runs this test binary again, so point it at the child branch
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{args[0], "-test.run=^TestRestart$"}
+
+	// Test: A child that exits without becoming ready is reported and the parent keeps serving
+	t.Setenv("TEST_RESTART_CHILD", "fail")
+	_, err = Restart([]net.Listener{listener}, 5*time.Second)
+	require.Error(t, err)
+	assert.Equal(t, "parent", get(t, "tcp", addr))
+
+	// Test: After a restart the child serves the same socket while the parent drains
+	os.Setenv("TEST_RESTART_CHILD", "serve")
+	process, err := Restart([]net.Listener{listener}, 5*time.Second)
+	require.NoError(t, err)
+	assert.NotEqual(t, os.Getpid(), process.Pid)
+	require.NoError(t, server.Shutdown(context.Background()))
+	assert.Equal(t, "child", get(t, "tcp", addr))
+}
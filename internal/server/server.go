@@ -1,85 +1,517 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// DefaultMaxBodySize bounds request bodies when Server.MaxBodySize is zero
+const DefaultMaxBodySize = 10 << 20
+
+// DefaultIdleTimeout is how long a kept-alive connection may sit between requests
+const DefaultIdleTimeout = 2 * time.Minute
+
+// ErrServerClosed is returned by Serve and ListenAndServe once Close is called
+var ErrServerClosed = errors.New("server: closed")
+
+// DefaultHeaderTimeout is how long a new connection may take to send its
+// first request when Server.HeaderTimeout is zero
+const DefaultHeaderTimeout = time.Minute
+
 // Handler function type that processes HTTP requests
 type Handler func(w *response.Writer, req *request.Request)
 
-// Server represents an HTTP server
+// Server represents an HTTP server. One server may serve several listeners
+// at once, for example every socket inherited from systemd.
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   atomic.Bool
+	// Addr is where ListenAndServe listens, in any form Listen accepts.
+	// Empty means ":http".
+	Addr string
+	// Handler answers every request
+	Handler Handler
+	// TLS, if set, terminates TLS on every listener the server serves
+	TLS *TLSConfig
+	// HTTP2 configures connections that speak HTTP/2 without TLS
+	HTTP2 http2.Server
+	// ErrorLog receives errors that can't be reported to a client, such as
+	// failed accepts; slog.Default() when nil
+	ErrorLog *slog.Logger
+	// KeepAlive lets clients send further requests on a connection once a
+	// response is complete, unless either side asks to close it. Handlers
+	// writing their own headers should leave Connection: close out for it
+	// to take effect.
+	KeepAlive bool
+	// IdleTimeout is how long a kept-alive connection may wait for its next
+	// request, DefaultIdleTimeout when zero
+	IdleTimeout time.Duration
+	// MaxBodySize bounds the bodies of HTTP/1.1 requests, which are read in
+	// full before the handler runs; DefaultMaxBodySize when zero. Requests
+	// whose Content-Length is larger get a 413 before any of the body is read.
+	MaxBodySize int64
+	// MaxConns limits how many connections are handled at once; zero means
+	// no limit. OverLimit says what happens to the ones beyond it.
+	MaxConns  int
+	OverLimit LimitPolicy
+	// MaxConnsPerIP limits how many connections one client address may have
+	// open at once; zero means no limit. Connections beyond it get a 503.
+	MaxConnsPerIP int
+	// HeaderTimeout is how long a new connection has to send its first
+	// request, so clients that connect and stay silent don't hold a slot
+	// forever; DefaultHeaderTimeout when zero
+	HeaderTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    atomic.Bool
+	// conns holds open connections, true once they have started a request
+	conns map[net.Conn]bool
+	// active counts connections being handled, for Shutdown to wait on
+	active sync.WaitGroup
+	// perIP counts open connections by client address for MaxConnsPerIP
+	perIP map[string]int
+	// connDone is signalled whenever a connection finishes or the server
+	// closes, for accept loops paused by MaxConns
+	connDone *sync.Cond
+	stats    connCounters
+	// parseErrors counts malformed requests by kind
+	parseErrors map[string]uint64
+	// ctx is the parent of every request's context, canceled once the
+	// server closes or gives up draining
+	ctx    context.Context
+	cancel context.CancelFunc
+	// tlsConfig and certs are set up on first use when TLS is configured
+	tlsConfig *tls.Config
+	certs     *certStore
 }
 
 // Serve creates a new server and starts listening on the given port
 func Serve(port int, handler Handler) (*Server, error) {
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	server := &Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	listener, err := Listen(server.Addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
 	}
-
-	server := &Server{
-		listener: listener,
-		handler:  handler,
+	listener, err = server.track(listener)
+	if err != nil {
+		return nil, err
 	}
 
 	// Start listening in a background goroutine
-	go server.listen()
+	go server.listen(listener)
 
 	return server, nil
 }
 
-// Close stops the server and closes the listener
+// ListenAndServe listens on s.Addr and serves it until Close is called,
+// then returns ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on l until Close is called, then returns
+// ErrServerClosed. The server takes ownership of l and closes it.
+func (s *Server) Serve(l net.Listener) error {
+	l, err := s.track(l)
+	if err != nil {
+		return err
+	}
+	return s.listen(l)
+}
+
+// Addrs returns the addresses of the listeners being served
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Close stops the server, closes every listener and cancels the contexts of
+// requests in progress
 func (s *Server) Close() error {
+	err := s.stopListening()
+	s.cancelRequests()
+	return err
+}
+
+// stopListening marks the server closed and closes every listener
+func (s *Server) stopListening() error {
 	s.closed.Store(true)
-	return s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connDone != nil {
+		s.connDone.Broadcast()
+	}
+	if s.certs != nil {
+		s.certs.close()
+	}
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	return errors.Join(errs...)
+}
+
+// Shutdown stops accepting connections, closes the ones that haven't sent
+// anything yet, sends GOAWAY on HTTP/2 ones and waits for requests in
+// progress to finish. If ctx ends first it returns ctx's error and cancels
+// the contexts of the remaining requests, leaving their handlers to wind
+// down on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+	defer s.cancelRequests()
+	s.HTTP2.Shutdown()
+	s.mu.Lock()
+	for conn, started := range s.conns {
+		if !started {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers l so Close can stop it, wrapping it for TLS when configured
+func (s *Server) track(l net.Listener) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		l.Close()
+		return nil, ErrServerClosed
+	}
+	if s.TLS != nil {
+		if s.tlsConfig == nil {
+			tlsConfig, certs, err := s.TLS.build()
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			s.tlsConfig, s.certs = tlsConfig, certs
+			if interval := s.TLS.reloadInterval(); interval > 0 {
+				go certs.watch(interval)
+			}
+		}
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.listeners = append(s.listeners, l)
+	return l, nil
+}
+
+// context returns the parent of every request's context
+func (s *Server) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// cancelRequests cancels the context of every request, now and to come
+func (s *Server) cancelRequests() {
+	s.context()
+	s.cancel()
+}
+
+func (s *Server) maxBodySize() int64 {
+	if s.MaxBodySize > 0 {
+		return s.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (s *Server) errorLog() *slog.Logger {
+	if s.ErrorLog != nil {
+		return s.ErrorLog
+	}
+	return slog.Default()
+}
+
+// trackConn registers a new connection, or returns why it may not be handled
+func (s *Server) trackConn(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return ErrServerClosed
+	}
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		s.stats.rejectedMaxConns.Add(1)
+		return errTooManyConns
+	}
+	ip := clientIP(conn)
+	if s.MaxConnsPerIP > 0 && ip != "" && s.perIP[ip] >= s.MaxConnsPerIP {
+		s.stats.rejectedPerIP.Add(1)
+		return errTooManyConnsPerIP
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+		s.perIP = make(map[string]int)
+	}
+	s.conns[conn] = false
+	if ip != "" {
+		s.perIP[ip]++
+	}
+	s.active.Add(1)
+	return nil
+}
+
+// startConn marks a connection as having started a request, so Shutdown lets it finish
+func (s *Server) startConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = true
+	}
+}
+
+// idleConn marks a kept-alive connection as waiting for its next request.
+// It reports false once the server is closed, as the connection should end.
+func (s *Server) idleConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return false
+	}
+	s.conns[conn] = false
+	return true
+}
+
+// forgetConn unregisters a connection once it has been handled
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	if ip := clientIP(conn); ip != "" {
+		if s.perIP[ip]--; s.perIP[ip] <= 0 {
+			delete(s.perIP, ip)
+		}
+	}
+	if s.connDone != nil {
+		s.connDone.Broadcast()
+	}
+	s.mu.Unlock()
+	s.active.Done()
 }
 
 // listen accepts incoming connections and handles them
-func (s *Server) listen() {
+func (s *Server) listen(l net.Listener) error {
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		if !s.waitForSlot() {
+			return ErrServerClosed
+		}
+		conn, err := l.Accept()
 		if err != nil {
 			// If server is closed, ignore connection errors
 			if s.closed.Load() {
-				return
+				return ErrServerClosed
 			}
-			// TODO: Log error in production
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Errors such as running out of file descriptors pass once other
+			// connections finish, so back off rather than spin
+			s.stats.acceptErrors.Add(1)
+			delay = nextAcceptDelay(delay)
+			s.errorLog().Warn("accept failed", "error", err, "retry_in", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		switch err := s.trackConn(conn); err {
+		case nil:
+		case ErrServerClosed:
+			conn.Close()
+			return err
+		default:
+			go reject(conn)
 			continue
 		}
+		s.stats.accepted.Add(1)
 
 		// Handle each connection in a separate goroutine
 		go s.handle(conn)
 	}
 }
 
+func (s *Server) headerTimeout() time.Duration {
+	if s.HeaderTimeout > 0 {
+		return s.HeaderTimeout
+	}
+	return DefaultHeaderTimeout
+}
+
 // handle processes a single connection
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	defer s.forgetConn(conn)
+	hijacked := false
+	defer func() {
+		// A hijacked connection belongs to the handler now
+		if !hijacked {
+			conn.Close()
+		}
+	}()
 
-	// Parse the request from the connection
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		// If parsing fails, return 400 Bad Request using response.Writer
-		writer := response.NewWriter(conn)
-		writer.WriteStatusLine(response.StatusBadRequest)
-		headers := response.GetDefaultHeaders(len("Bad Request\n"))
-		writer.WriteHeaders(headers)
-		writer.WriteBody([]byte("Bad Request\n"))
+	// Finish the TLS handshake up front so a slow client can't hold it open
+	// forever and the connection state is ready for the request
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	// Clients with prior knowledge open with the HTTP/2 preface
+	conn.SetReadDeadline(time.Now().Add(s.headerTimeout()))
+	prefix, isHTTP2, err := http2.DetectPreface(conn)
+	s.startConn(conn)
+	if isHTTP2 {
+		conn.SetReadDeadline(time.Time{})
+		hijacked = true
+		s.HTTP2.ServeConn(s.context(), conn, prefix, s.Handler)
 		return
 	}
+	if err != nil && len(prefix) == 0 {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.countParseError(err)
+		}
+		return
+	}
+
+	// The connection's context ends with the server or when the client hangs up
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
 
-	// Create a response writer for the handler
-	writer := response.NewWriter(conn)
+	// Parse requests from the connection, starting with what we already read
+	connReader := &connReader{conn: conn}
+	reader := request.NewReader(io.MultiReader(bytes.NewReader(prefix), connReader))
+	reader.MaxBodySize = s.maxBodySize()
+	for served := 0; ; served++ {
+		if served > 0 {
+			// Between requests the connection is idle, so Shutdown may close it
+			if !s.idleConn(conn) {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		}
+		req, err := reader.ReadRequest()
+		if err != nil {
+			// A kept-alive connection may end quietly between requests
+			if served > 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)) {
+				return
+			}
+			s.countParseError(err)
+			// If parsing fails, return 400 Bad Request using response.Writer
+			writer := response.NewWriter(conn)
+			if errors.Is(err, request.ErrBodyTooLarge) {
+				writer.WriteError(response.StatusRequestEntityTooLarge, nil)
+				return
+			}
+			writer.WriteError(response.StatusBadRequest, nil)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if served > 0 {
+			s.startConn(conn)
+			s.stats.keepAliveReuses.Add(1)
+		}
+		s.stats.requests.Add(1)
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.TLS = tlsState
+		reqCtx, cancelReq := context.WithCancel(ctx)
+		req = req.WithContext(reqCtx)
+
+		// Create a response writer for the handler that can hand over the connection
+		writer := response.NewHijackableWriter(conn, func() (net.Conn, []byte, error) {
+			hijacked = true
+			connReader.stopBackgroundRead()
+			return conn, append(reader.Buffered(), connReader.buffered()...), nil
+		})
+		keepAlive := s.KeepAlive && wantsKeepAlive(req)
+		writer.SetKeepAlive(keepAlive)
+
+		// Requests may ask to continue the connection as HTTP/2
+		if http2.IsUpgradeRequest(req) {
+			s.HTTP2.ServeUpgrade(writer, req, s.Handler)
+			cancelReq()
+			return
+		}
+
+		// Watch for the client hanging up while the handler runs, unless it
+		// already sent more, which tells us it is still there
+		if len(reader.Buffered()) == 0 {
+			connReader.startBackgroundRead(cancel)
+		}
+
+		// Call the handler function
+		s.Handler(writer, req)
+		cancelReq()
+
+		if hijacked || !connReader.stopBackgroundRead() {
+			return
+		}
+		if !keepAlive || !writer.Reusable(req.RequestLine.Method) {
+			return
+		}
+	}
+}
 
-	// Call the handler function
-	s.handler(writer, req)
+// wantsKeepAlive reports whether the connection may carry more requests after
+// req as far as the client is concerned. Request bodies are only framed by
+// Content-Length here, so anything else ends the connection.
+func wantsKeepAlive(req *request.Request) bool {
+	return req.RequestLine.HttpVersion == "1.1" &&
+		!headers.HasToken(req.Headers.Get("Connection"), "close") &&
+		req.Headers.Get("Transfer-Encoding") == ""
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned by the writes of a handler that Timeout
+// already gave up on
+var ErrHandlerTimeout = errors.New("server: handler timeout")
+
+// Timeout returns middleware that gives each request d to be handled. The
+// handler writes to a buffer that is sent once it returns. If d passes first,
+// the client gets 503 Service Unavailable with body as plain text (the status
+// reason phrase when empty), the request's context is canceled and whatever
+// the handler writes from then on is discarded, failing with
+// ErrHandlerTimeout. Functions registered with OnHeaders don't run for the
+// 503. Handlers behind it can't hijack the connection or stream.
+func Timeout(d time.Duration, body string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			parent := req.Context()
+			ctx, cancel := context.WithCancelCause(parent)
+			defer cancel(nil)
+			// The handler's context isn't canceled by a timer of its own, so
+			// it can't see the deadline pass before its writes are refused
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			handlerCtx := &timeoutContext{Context: ctx, deadline: time.Now().Add(d)}
+
+			buf := &timeoutBuffer{}
+			buffered := w.Buffer(buf)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				next(buffered, req.WithContext(handlerCtx))
+			}()
+
+			select {
+			case <-done:
+			case <-timer.C:
+			case <-parent.Done():
+			}
+			// A handler that finished is sent even if time ran out meanwhile
+			select {
+			case <-done:
+				w.Commit(buffered, buf.bytes())
+				return
+			default:
+			}
+
+			buf.discard()
+			cancel(context.DeadlineExceeded)
+			if parent.Err() != nil {
+				// The client or the server gave up first, so nobody is
+				// waiting for an answer
+				return
+			}
+			// The handler may have run the OnHeaders functions through its
+			// writer already, or be running them now
+			w.DropOnHeaders()
+			writeTimeout(w, body)
+		}
+	}
+}
+
+// timeoutContext is the context of a handler behind Timeout. Timeout cancels
+// it with context.DeadlineExceeded as the cause, which Err reports as a
+// context with a deadline would.
+type timeoutContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	if parent, ok := c.Context.Deadline(); ok && parent.Before(c.deadline) {
+		return parent, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && errors.Is(context.Cause(c.Context), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// writeTimeout answers a request whose handler ran out of time
+func writeTimeout(w *response.Writer, body string) {
+	if body == "" {
+		w.WriteError(response.StatusServiceUnavailable, nil)
+		return
+	}
+	w.WriteResponse(response.StatusServiceUnavailable, nil, []byte(body))
+}
+
+// timeoutBuffer holds a handler's output until it finishes or time is up,
+// after which writes are refused
+type timeoutBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	discarded bool
+}
+
+func (b *timeoutBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discarded {
+		return 0, ErrHandlerTimeout
+	}
+	return b.buf.Write(p)
+}
+
+func (b *timeoutBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// discard drops what was written and refuses further writes
+func (b *timeoutBuffer) discard() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discarded = true
+	b.buf = bytes.Buffer{}
+}
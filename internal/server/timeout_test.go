@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeout(t *testing.T) {
+	newRequest := func() *request.Request {
+		return &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+			Headers:     headers.NewHeaders(),
+		}
+	}
+
+	// Test: A handler that finishes in time has its response sent as written
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	w.Header().Override("X-Outer", "1")
+	Timeout(time.Second, "")(func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusTooManyRequests, nil, []byte("made"))
+	})(w, newRequest())
+	assert.Equal(t, response.StatusTooManyRequests, w.Status())
+	assert.Equal(t, int64(4), w.BytesWritten())
+	assert.Contains(t, out.String(), "HTTP/1.1 429 Too Many Requests\r\n")
+	assert.Contains(t, out.String(), "x-outer: 1\r\n")
+	assert.Contains(t, out.String(), "\r\n\r\nmade")
+
+	// Test: A slow handler gets its context canceled and the client a 503
+	// with the configured body, while its late writes are discarded
+	out.Reset()
+	w = response.NewWriter(&out)
+	lateWrite := make(chan error, 1)
+	Timeout(20*time.Millisecond, "too slow")(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		assert.ErrorIs(t, req.Context().Err(), context.DeadlineExceeded)
+		lateWrite <- w.WriteResponse(response.StatusOK, nil, []byte("late"))
+	})(w, newRequest())
+	assert.Equal(t, response.StatusServiceUnavailable, w.Status())
+	assert.ErrorIs(t, <-lateWrite, ErrHandlerTimeout)
+	assert.True(t, bytes.HasSuffix(out.Bytes(), []byte("\r\n\r\ntoo slow")), "got %q", out.String())
+	assert.NotContains(t, out.String(), "late")
+
+	// Test: OnHeaders functions the handler already ran aren't run again for the 503
+	out.Reset()
+	w = response.NewWriter(&out)
+	var hookCalls atomic.Int32
+	w.OnHeaders(func(headers.Headers) { hookCalls.Add(1) })
+	handlerDone := make(chan struct{})
+	Timeout(20*time.Millisecond, "")(func(w *response.Writer, req *request.Request) {
+		defer close(handlerDone)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		<-req.Context().Done()
+	})(w, newRequest())
+	<-handlerDone
+	assert.Equal(t, response.StatusServiceUnavailable, w.Status())
+	assert.Equal(t, int32(1), hookCalls.Load())
+
+	// Test: Without a body the status reason phrase is sent
+	out.Reset()
+	Timeout(time.Millisecond, "")(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})(response.NewWriter(&out), newRequest())
+	assert.Contains(t, out.String(), "Service Unavailable\n")
+
+	// Test: Nothing is sent when the request was canceled rather than timed out
+	out.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	Timeout(time.Second, "")(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})(response.NewWriter(&out), newRequest().WithContext(ctx))
+	require.Empty(t, out.String())
+}
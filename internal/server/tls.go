@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often certificate files are checked for changes
+const DefaultCertReloadInterval = 30 * time.Second
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// CertFiles names a PEM certificate chain and its private key
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSConfig configures TLS termination
+type TLSConfig struct {
+	// Certificates are served by SNI: a client gets the first certificate
+	// valid for the name it asked for, or the first one if none is. The files
+	// are reloaded when they change on disk.
+	Certificates []CertFiles
+	// MinVersion is the lowest TLS version accepted, TLS 1.2 when zero
+	MinVersion uint16
+	// ClientAuth selects client certificate authentication. Verified chains
+	// are available to handlers through request.Request.TLS.
+	ClientAuth tls.ClientAuthType
+	// ClientCAFile holds the PEM CAs client certificates are verified against
+	ClientCAFile string
+	// ReloadInterval is how often certificate files are checked for changes,
+	// DefaultCertReloadInterval when zero and never when negative
+	ReloadInterval time.Duration
+	// Base, if set, is cloned as the starting point for the tls.Config, for
+	// settings such as cipher suites or curve preferences
+	Base *tls.Config
+}
+
+// ServeTLS creates a new server that terminates TLS and starts listening on the given port
+func ServeTLS(port int, handler Handler, config *TLSConfig) (*Server, error) {
+	server := &Server{Addr: fmt.Sprintf(":%d", port), Handler: handler, TLS: config}
+	listener, err := Listen(server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	listener, err = server.track(listener)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start listening in a background goroutine
+	go server.listen(listener)
+
+	return server, nil
+}
+
+// reloadInterval resolves ReloadInterval's defaults; zero or less means never
+func (c *TLSConfig) reloadInterval() time.Duration {
+	if c.ReloadInterval == 0 {
+		return DefaultCertReloadInterval
+	}
+	return max(c.ReloadInterval, 0)
+}
+
+// build turns the options into a tls.Config
+func (c *TLSConfig) build() (*tls.Config, *certStore, error) {
+	if len(c.Certificates) == 0 {
+		return nil, nil, errors.New("tls: at least one certificate is required")
+	}
+	certs, err := loadCertStore(c.Certificates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.Base != nil {
+		tlsConfig = c.Base.Clone()
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = certs.getCertificate
+	tlsConfig.MinVersion = c.MinVersion
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	tlsConfig.ClientAuth = c.ClientAuth
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls: reading client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("tls: no certificates in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig, certs, nil
+}
+
+// certStore holds the loaded certificates and swaps them when their files change
+type certStore struct {
+	files []CertFiles
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	contents [][]byte
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func loadCertStore(files []CertFiles) (*certStore, error) {
+	s := &certStore{files: files, stop: make(chan struct{})}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload loads every certificate again if any of the files changed. On
+// failure the certificates already loaded stay in use.
+func (s *certStore) reload() error {
+	contents := make([][]byte, 0, 2*len(s.files))
+	for _, files := range s.files {
+		for _, name := range []string{files.CertFile, files.KeyFile} {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return fmt.Errorf("tls: %w", err)
+			}
+			contents = append(contents, data)
+		}
+	}
+
+	s.mu.RLock()
+	unchanged := s.certs != nil && equalContents(contents, s.contents)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for i, files := range s.files {
+		cert, err := tls.X509KeyPair(contents[2*i], contents[2*i+1])
+		if err != nil {
+			return fmt.Errorf("tls: loading %s: %w", files.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.contents = contents
+	s.mu.Unlock()
+	return nil
+}
+
+// getCertificate picks a certificate by SNI for tls.Config.GetCertificate
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// watch reloads the certificates every interval until close is called
+func (s *certStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A half-written or broken file leaves the old certificates serving
+			s.reload()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *certStore) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func equalContents(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	handler := func(w *response.Writer, req *request.Request) {
+		body := "plain"
+		if req.TLS != nil {
+			body = "tls " + req.TLS.ServerName
+		}
+		w.WriteResponse(response.StatusOK, nil, []byte(body))
+	}
+
+	// Test: HTTPS requests are served and handlers see the TLS state
+	server, err := ServeTLS(0, handler, &TLSConfig{
+		Certificates: []CertFiles{ca.writeCert(t, dir, "a", "a.test"), ca.writeCert(t, dir, "b", "b.test")},
+	})
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addrs()[0].String()
+	c := client.New()
+	c.TLSConfig = &tls.Config{RootCAs: ca.pool}
+	c.Dial = dialAs(addr)
+	resp, err := c.Get("https://a.test/")
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "tls a.test", string(body))
+
+	// Test: The certificate is chosen by SNI
+	assert.Equal(t, "a.test", peerName(t, addr, "a.test", &tls.Config{RootCAs: ca.pool}))
+	assert.Equal(t, "b.test", peerName(t, addr, "b.test", &tls.Config{RootCAs: ca.pool}))
+
+	// Test: Clients below MinVersion are refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "a.test", RootCAs: ca.pool, MaxVersion: tls.VersionTLS11})
+	require.Error(t, err)
+}
+
+func TestServeTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	files := ca.writeCert(t, dir, "site", "old.test")
+
+	server, err := ServeTLS(0, nopHandler, &TLSConfig{Certificates: []CertFiles{files}, ReloadInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addrs()[0].String()
+	assert.Equal(t, "old.test", peerName(t, addr, "old.test", &tls.Config{RootCAs: ca.pool}))
+
+	// Test: A broken certificate file leaves the old certificate serving
+	require.NoError(t, os.WriteFile(files.CertFile, []byte("not a certificate"), 0o600))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "old.test", peerName(t, addr, "old.test", &tls.Config{RootCAs: ca.pool}))
+
+	// Test: Replaced certificate files are picked up without a restart
+	ca.writeCert(t, dir, "site", "new.test")
+	assert.Eventually(t, func() bool {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "new.test", RootCAs: ca.pool})
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServeTLSClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteResponse(response.StatusOK, nil, []byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}
+
+	server, err := ServeTLS(0, handler, &TLSConfig{
+		Certificates: []CertFiles{ca.writeCert(t, dir, "server", "server.test")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAFile: caFile,
+	})
+	require.NoError(t, err)
+	defer server.Close()
+	addr := server.Addrs()[0].String()
+
+	// Test: Clients without a certificate are refused
+	c := client.New()
+	c.TLSConfig = &tls.Config{RootCAs: ca.pool}
+	c.Dial = dialAs(addr)
+	_, err = c.Get("https://server.test/")
+	require.Error(t, err)
+
+	// Test: The verified client chain reaches the handler
+	clientFiles := ca.writeCert(t, dir, "client", "alice")
+	clientCert, err := tls.LoadX509KeyPair(clientFiles.CertFile, clientFiles.KeyFile)
+	require.NoError(t, err)
+	c.TLSConfig = &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientCert}}
+	resp, err := c.Get("https://server.test/")
+	require.NoError(t, err)
+	body, err := resp.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "alice", string(body))
+}
+
+func nopHandler(w *response.Writer, req *request.Request) {
+	w.WriteResponse(response.StatusOK, nil, nil)
+}
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpfromtcp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// writeCert issues a certificate for name, usable by servers and clients,
+// and writes it and its key to dir
+func (ca *testCA) writeCert(t *testing.T, dir, file, name string) CertFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertFiles{CertFile: filepath.Join(dir, file+".crt"), KeyFile: filepath.Join(dir, file+".key")}
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return files
+}
+
+// dialAs connects to addr whatever host the URL names, so tests can use made up names
+func dialAs(addr string) client.DialFunc {
+	return func(_ string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+}
+
+// peerName does a TLS handshake asking for serverName and returns the name in the certificate served
+func peerName(t *testing.T, addr, serverName string, config *tls.Config) string {
+	t.Helper()
+	config.ServerName = serverName
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,138 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinSecretLength is the shortest secret NewCodec accepts
+const MinSecretLength = 32
+
+// maxCookieLength bounds encoded sessions, as browsers only keep cookies up
+// to about 4096 bytes including the name and attributes
+const maxCookieLength = 3800
+
+var (
+	// ErrInvalidCookie is returned by Decode for values that weren't made by
+	// Encode with one of the codec's secrets or that were tampered with
+	ErrInvalidCookie = errors.New("invalid session cookie")
+	// ErrCookieTooLarge is returned by Encode for sessions too big to fit
+	// in a cookie
+	ErrCookieTooLarge = errors.New("session too large for a cookie")
+)
+
+// codecKey holds the keys derived from one secret
+type codecKey struct {
+	aead    cipher.AEAD
+	signing []byte
+}
+
+// Codec encrypts sessions with AES-256-GCM and signs them with HMAC-SHA256
+// so they can be kept in cookies. Both keys are derived from secrets; the
+// first secret is used for new cookies and the others are still accepted,
+// so secrets can be rotated without logging everyone out.
+type Codec struct {
+	keys []codecKey
+}
+
+// NewCodec returns a codec using secrets, newest first. Each must be at
+// least MinSecretLength random bytes.
+func NewCodec(secrets ...[]byte) (*Codec, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("session: codec needs a secret")
+	}
+	c := &Codec{}
+	for i, secret := range secrets {
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("session: secret %d is shorter than %d bytes", i, MinSecretLength)
+		}
+		block, err := aes.NewCipher(derive(secret, "session encryption"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, codecKey{aead: aead, signing: derive(secret, "session signing")})
+	}
+	return c, nil
+}
+
+// derive makes a 256-bit key for purpose from secret, so the encryption and
+// signing keys are independent
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Encode encrypts and signs rec for the cookie called name. The name is
+// bound in, so the value can't be moved to another cookie.
+func (c *Codec) Encode(name string, rec *Record) (string, error) {
+	plaintext, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := key.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	payload := base64.RawURLEncoding.EncodeToString(sealed)
+	value := payload + "." + base64.RawURLEncoding.EncodeToString(sign(key.signing, name, payload))
+	if len(value) > maxCookieLength {
+		return "", fmt.Errorf("%w: %d bytes", ErrCookieTooLarge, len(value))
+	}
+	return value, nil
+}
+
+// Decode checks the signature of a value Encode made for the cookie called
+// name and decrypts it, trying each secret in turn
+func (c *Codec) Decode(name, value string) (*Record, error) {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidCookie
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	for _, key := range c.keys {
+		if !hmac.Equal(mac, sign(key.signing, name, payload)) {
+			continue
+		}
+		sealed, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return nil, ErrInvalidCookie
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plaintext, err := key.aead.Open(nil, nonce, ciphertext, []byte(name))
+		if err != nil {
+			return nil, ErrInvalidCookie
+		}
+		var rec Record
+		if err := json.Unmarshal(plaintext, &rec); err != nil {
+			return nil, ErrInvalidCookie
+		}
+		return &rec, nil
+	}
+	return nil, ErrInvalidCookie
+}
+
+// sign returns the HMAC of payload for the cookie called name
+func sign(key []byte, name, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,338 @@
+// Package session keeps per-client state across requests, such as who is
+// logged in. Sessions live either in a store on the server, with the client
+// holding only a random ID in a cookie, or entirely in the cookie, encrypted
+// and signed by a Codec.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"httpfromtcp/internal/cookies"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Defaults for Manager's expiry settings
+const (
+	DefaultCookieName      = "session"
+	DefaultIdleTimeout     = 30 * time.Minute
+	DefaultAbsoluteTimeout = 24 * time.Hour
+)
+
+// idLength is the length of a session ID: 32 random bytes in unpadded
+// base64url
+const idLength = 43
+
+// Record is what is kept of a session between requests
+type Record struct {
+	ID       string            `json:"id"`
+	Values   map[string]string `json:"values,omitempty"`
+	Created  time.Time         `json:"created"`
+	LastSeen time.Time         `json:"last_seen"`
+}
+
+// Session is the state of one client, available to handlers through
+// FromRequest. Changes are saved when the response headers are written.
+type Session struct {
+	mu        sync.Mutex
+	record    Record
+	isNew     bool
+	changed   bool
+	destroyed bool
+	// oldID is the ID Regenerate replaced or that of an expired session,
+	// to be deleted from the store
+	oldID string
+}
+
+// ID returns the session's ID, which changes when Regenerate is called
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.record.ID
+}
+
+// IsNew reports whether the session was started by this request
+func (s *Session) IsNew() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isNew
+}
+
+// Get returns the value stored under key, or "" if there is none
+func (s *Session) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.record.Values[key]
+}
+
+// Set stores value under key
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.record.Values == nil {
+		s.record.Values = make(map[string]string)
+	}
+	s.record.Values[key] = value
+	s.changed = true
+}
+
+// Delete removes the value stored under key
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.record.Values, key)
+	s.changed = true
+}
+
+// Regenerate gives the session a new ID, keeping its values. Call it
+// whenever the client's privileges change, such as on login, so an ID an
+// attacker planted in the client beforehand is worthless afterwards
+// (session fixation).
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isNew && s.oldID == "" {
+		s.oldID = s.record.ID
+	}
+	s.record.ID = newID()
+	s.changed = true
+}
+
+// Destroy ends the session, as on logout: its values are dropped, its
+// record deleted and the client told to forget the cookie
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroyed = true
+	s.record.Values = nil
+}
+
+// Manager loads the session of each request and saves it afterwards
+type Manager struct {
+	// Store keeps sessions on the server. When nil, sessions are kept in
+	// the cookie itself using Codec.
+	Store Store
+	// Codec encrypts and signs sessions kept in cookies
+	Codec *Codec
+	// Cookie is the template of the session cookie. Its Name defaults to
+	// DefaultCookieName and its Path to /; Value, Expires and MaxAge are set
+	// by the Manager. HttpOnly is always set.
+	Cookie cookies.Cookie
+	// IdleTimeout ends sessions unused for this long, DefaultIdleTimeout
+	// when zero
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends sessions this long after they started however
+	// much they are used, DefaultAbsoluteTimeout when zero
+	AbsoluteTimeout time.Duration
+	// ErrorLog receives failures to load and save sessions; slog.Default()
+	// when nil
+	ErrorLog *slog.Logger
+
+	// now is time.Now, replaceable by tests
+	now func() time.Time
+}
+
+// sessionKey is the context key a request's session is stored under
+type sessionKey struct{}
+
+// FromRequest returns the session of req, or nil if it didn't pass through
+// a Manager's middleware
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// Middleware loads the session named by the request's cookie, or starts a
+// new one if there is none or it has expired, and makes it available to
+// FromRequest. The session is saved and its cookie set when the response
+// headers are written; new sessions nothing was stored in aren't saved.
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	if m.Store == nil && m.Codec == nil {
+		panic("session: Manager needs a Store or a Codec")
+	}
+	return func(w *response.Writer, req *request.Request) {
+		s := m.load(req)
+		w.OnHeaders(func(h headers.Headers) {
+			m.save(s, h)
+		})
+		next(w, req.WithValue(sessionKey{}, s))
+	}
+}
+
+// load returns the session named by the request's cookie, or a new one
+func (m *Manager) load(req *request.Request) *Session {
+	now := m.clock()
+	c, err := cookies.Get(req, m.cookieName())
+	if err != nil {
+		return m.newSession(now)
+	}
+
+	var rec *Record
+	if m.Store != nil {
+		if validID(c.Value) {
+			rec, err = m.Store.Load(c.Value)
+		} else {
+			err = ErrNotFound
+		}
+	} else {
+		rec, err = m.Codec.Decode(m.cookieName(), c.Value)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrInvalidCookie):
+		return m.newSession(now)
+	case err != nil:
+		m.logger().Warn("loading session failed", "error", err)
+		return m.newSession(now)
+	}
+
+	if now.After(m.expiry(rec)) {
+		// The expired record is deleted and the client's cookie replaced or
+		// removed when the new session is saved
+		s := m.newSession(now)
+		s.oldID = rec.ID
+		return s
+	}
+	return &Session{record: *rec}
+}
+
+func (m *Manager) newSession(now time.Time) *Session {
+	return &Session{
+		record: Record{ID: newID(), Created: now, LastSeen: now},
+		isNew:  true,
+	}
+}
+
+// save stores the session and adds the cookie that refers to it to h
+func (m *Manager) save(s *Session, h headers.Headers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m.Store != nil && s.oldID != "" {
+		if err := m.Store.Delete(s.oldID); err != nil {
+			m.logger().Warn("deleting replaced or expired session failed", "error", err)
+		}
+	}
+	if s.destroyed || (s.isNew && !s.changed) {
+		if (s.destroyed && !s.isNew) || s.oldID != "" {
+			m.setCookie(h, "", time.Time{}, true)
+		}
+		if s.destroyed && m.Store != nil {
+			if err := m.Store.Delete(s.record.ID); err != nil {
+				m.logger().Warn("deleting session failed", "error", err)
+			}
+		}
+		return
+	}
+
+	// Every request moves the idle deadline, so the session is saved even
+	// if nothing in it changed
+	s.record.LastSeen = m.clock()
+	expires := m.expiry(&s.record)
+	rec := s.record
+	rec.Values = maps.Clone(s.record.Values)
+
+	value := rec.ID
+	if m.Store != nil {
+		if err := m.Store.Save(&rec, expires); err != nil {
+			m.logger().Warn("saving session failed", "error", err)
+			return
+		}
+	} else {
+		var err error
+		if value, err = m.Codec.Encode(m.cookieName(), &rec); err != nil {
+			m.logger().Warn("saving session failed", "error", err)
+			return
+		}
+	}
+	m.setCookie(h, value, expires, false)
+}
+
+// setCookie adds the session cookie to h, or one that deletes it
+func (m *Manager) setCookie(h headers.Headers, value string, expires time.Time, remove bool) {
+	c := m.Cookie
+	c.Name = m.cookieName()
+	c.Value = value
+	c.Expires = expires
+	c.MaxAge = 0
+	c.HttpOnly = true
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if remove {
+		c.Expires = time.Time{}
+		c.MaxAge = -1
+	}
+	if err := cookies.Set(h, &c); err != nil {
+		m.logger().Warn("setting session cookie failed", "error", err)
+	}
+}
+
+// expiry returns when rec ends, whichever of its timeouts comes first
+func (m *Manager) expiry(rec *Record) time.Time {
+	idle := m.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	absolute := m.AbsoluteTimeout
+	if absolute <= 0 {
+		absolute = DefaultAbsoluteTimeout
+	}
+	expires := rec.LastSeen.Add(idle)
+	if end := rec.Created.Add(absolute); end.Before(expires) {
+		expires = end
+	}
+	return expires
+}
+
+func (m *Manager) cookieName() string {
+	if m.Cookie.Name != "" {
+		return m.Cookie.Name
+	}
+	return DefaultCookieName
+}
+
+func (m *Manager) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+func (m *Manager) logger() *slog.Logger {
+	if m.ErrorLog != nil {
+		return m.ErrorLog
+	}
+	return slog.Default()
+}
+
+// newID generates a session ID of 256 random bits
+func newID() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// validID reports whether id looks like one newID made, which keeps forged
+// IDs out of stores, including out of file names
+func validID(id string) bool {
+	if len(id) != idLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
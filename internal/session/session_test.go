@@ -0,0 +1,317 @@
+package session
+
+import (
+	"bytes"
+	"httpfromtcp/internal/cookies"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs handler behind m for a request sending cookie, returning the
+// Set-Cookie headers of the response
+func serve(t *testing.T, m *Manager, cookie string, handler server.Handler) []*cookies.Cookie {
+	t.Helper()
+	req := &request.Request{Headers: headers.NewHeaders()}
+	if cookie != "" {
+		req.Headers.Set("Cookie", cookie)
+	}
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	m.Middleware(handler)(w, req)
+
+	var set []*cookies.Cookie
+	for _, line := range strings.Split(out.String(), "\r\n") {
+		value, ok := strings.CutPrefix(line, "set-cookie: ")
+		if !ok {
+			continue
+		}
+		// Only the name and value matter here, plus Max-Age for deletions
+		c := cookies.Parse(strings.SplitN(value, ";", 2)[0])[0]
+		if strings.Contains(value, "Max-Age=0") {
+			c.MaxAge = -1
+		}
+		set = append(set, c)
+	}
+	return set
+}
+
+func ok(w *response.Writer, req *request.Request) {
+	w.WriteResponse(response.StatusOK, nil, []byte("ok"))
+}
+
+func setValue(key, value string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		FromRequest(req).Set(key, value)
+		ok(w, req)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	oldSecret := bytes.Repeat([]byte("o"), 32)
+	newSecret := bytes.Repeat([]byte("n"), 32)
+	rec := &Record{ID: newID(), Values: map[string]string{"user": "alice"}, Created: time.Unix(1000, 0).UTC(), LastSeen: time.Unix(2000, 0).UTC()}
+
+	// Test: Values round-trip and don't show the data in clear
+	c, err := NewCodec(oldSecret)
+	require.NoError(t, err)
+	value, err := c.Encode("session", rec)
+	require.NoError(t, err)
+	assert.NotContains(t, value, "alice")
+	got, err := c.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, rec, got)
+
+	// Test: Tampered values, other cookie names and unknown secrets are rejected
+	_, err = c.Decode("other", value)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+	tampered := []byte(value)
+	tampered[5] ^= 1
+	_, err = c.Decode("session", string(tampered))
+	require.ErrorIs(t, err, ErrInvalidCookie)
+	_, err = c.Decode("session", "garbage")
+	require.ErrorIs(t, err, ErrInvalidCookie)
+	stranger, err := NewCodec(newSecret)
+	require.NoError(t, err)
+	_, err = stranger.Decode("session", value)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+
+	// Test: After rotation, cookies made with the old secret are still read
+	// and new ones use the new secret
+	rotated, err := NewCodec(newSecret, oldSecret)
+	require.NoError(t, err)
+	got, err = rotated.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, rec, got)
+	value, err = rotated.Encode("session", rec)
+	require.NoError(t, err)
+	_, err = c.Decode("session", value)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+
+	// Test: Sessions too big for a cookie aren't encoded
+	rec.Values["big"] = strings.Repeat("x", 4000)
+	_, err = c.Encode("session", rec)
+	require.ErrorIs(t, err, ErrCookieTooLarge)
+
+	// Test: Short secrets are refused
+	_, err = NewCodec([]byte("short"))
+	require.Error(t, err)
+	_, err = NewCodec()
+	require.Error(t, err)
+}
+
+func TestStores(t *testing.T) {
+	memory := NewMemoryStore(time.Hour)
+	defer memory.Close()
+	files, err := NewFileStore(filepath.Join(t.TempDir(), "sessions"))
+	require.NoError(t, err)
+
+	for name, store := range map[string]Store{"memory": memory, "file": files} {
+		rec := &Record{ID: newID(), Values: map[string]string{"k": "v"}, Created: time.Now().UTC(), LastSeen: time.Now().UTC()}
+
+		// Test: Saved records load back
+		require.NoError(t, store.Save(rec, time.Now().Add(time.Hour)), name)
+		got, err := store.Load(rec.ID)
+		require.NoError(t, err, name)
+		assert.Equal(t, rec.Values, got.Values, name)
+		assert.True(t, rec.Created.Equal(got.Created), name)
+
+		// Test: Changing what was loaded doesn't change the store
+		got.Values["k"] = "changed"
+		got, err = store.Load(rec.ID)
+		require.NoError(t, err, name)
+		assert.Equal(t, "v", got.Values["k"], name)
+
+		// Test: Deleted and expired records aren't found
+		require.NoError(t, store.Delete(rec.ID), name)
+		_, err = store.Load(rec.ID)
+		require.ErrorIs(t, err, ErrNotFound, name)
+		require.NoError(t, store.Delete(rec.ID), name)
+		require.NoError(t, store.Save(rec, time.Now().Add(-time.Second)), name)
+		_, err = store.Load(rec.ID)
+		require.ErrorIs(t, err, ErrNotFound, name)
+		_, err = store.Load("../../etc/passwd")
+		require.ErrorIs(t, err, ErrNotFound, name)
+	}
+
+	// Test: Prune evicts expired sessions only
+	live, expired := &Record{ID: newID()}, &Record{ID: newID()}
+	require.NoError(t, memory.Save(live, time.Now().Add(time.Hour)))
+	require.NoError(t, memory.Save(expired, time.Now().Add(-time.Second)))
+	assert.Equal(t, 2, memory.Len())
+	memory.Prune()
+	assert.Equal(t, 1, memory.Len())
+
+	require.NoError(t, files.Save(live, time.Now().Add(time.Hour)))
+	require.NoError(t, files.Save(expired, time.Now().Add(-time.Second)))
+	require.NoError(t, files.Prune())
+	entries, err := os.ReadDir(files.dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, live.ID+fileSuffix, entries[0].Name())
+
+	// Test: Past MaxSessions the sessions closest to expiring are evicted
+	bounded := NewMemoryStore(time.Hour)
+	defer bounded.Close()
+	bounded.MaxSessions = 2
+	soon, later, latest := &Record{ID: newID()}, &Record{ID: newID()}, &Record{ID: newID()}
+	require.NoError(t, bounded.Save(later, time.Now().Add(2*time.Hour)))
+	require.NoError(t, bounded.Save(soon, time.Now().Add(time.Hour)))
+	require.NoError(t, bounded.Save(soon, time.Now().Add(time.Hour)))
+	assert.Equal(t, 2, bounded.Len())
+	require.NoError(t, bounded.Save(latest, time.Now().Add(3*time.Hour)))
+	assert.Equal(t, 2, bounded.Len())
+	_, err = bounded.Load(soon.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = bounded.Load(later.ID)
+	require.NoError(t, err)
+
+	// Test: The memory store evicts in the background
+	background := NewMemoryStore(10 * time.Millisecond)
+	defer background.Close()
+	require.NoError(t, background.Save(expired, time.Now().Add(-time.Second)))
+	assert.Eventually(t, func() bool { return background.Len() == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestManagerServerSide(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+	m := &Manager{Store: store}
+
+	// Test: New sessions nothing was stored in aren't saved
+	assert.Empty(t, serve(t, m, "", ok))
+	assert.Equal(t, 0, store.Len())
+
+	// Test: Storing a value saves the session and sets its cookie
+	set := serve(t, m, "", setValue("user", "alice"))
+	require.Len(t, set, 1)
+	assert.Equal(t, DefaultCookieName, set[0].Name)
+	id := set[0].Value
+	assert.True(t, validID(id))
+	assert.Equal(t, 1, store.Len())
+
+	// Test: The next request sees the values
+	var seen string
+	serve(t, m, "session="+id, func(w *response.Writer, req *request.Request) {
+		s := FromRequest(req)
+		assert.False(t, s.IsNew())
+		assert.Equal(t, id, s.ID())
+		seen = s.Get("user")
+		ok(w, req)
+	})
+	assert.Equal(t, "alice", seen)
+
+	// Test: Regenerate moves the session to a new ID and deletes the old one
+	set = serve(t, m, "session="+id, func(w *response.Writer, req *request.Request) {
+		FromRequest(req).Regenerate()
+		ok(w, req)
+	})
+	require.Len(t, set, 1)
+	newID := set[0].Value
+	assert.NotEqual(t, id, newID)
+	_, err := store.Load(id)
+	require.ErrorIs(t, err, ErrNotFound)
+	rec, err := store.Load(newID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", rec.Values["user"])
+
+	// Test: An ID the store doesn't know starts a new session, so clients
+	// can't choose their own ID
+	forged := "session=" + strings.Repeat("A", idLength)
+	set = serve(t, m, forged, setValue("user", "mallory"))
+	require.Len(t, set, 1)
+	assert.NotEqual(t, strings.Repeat("A", idLength), set[0].Value)
+
+	// Test: Destroy deletes the session and the cookie
+	set = serve(t, m, "session="+newID, func(w *response.Writer, req *request.Request) {
+		FromRequest(req).Destroy()
+		ok(w, req)
+	})
+	require.Len(t, set, 1)
+	assert.Equal(t, -1, set[0].MaxAge)
+	_, err = store.Load(newID)
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManagerExpiry(t *testing.T) {
+	store := NewMemoryStore(time.Hour)
+	defer store.Close()
+	now := time.Now()
+	m := &Manager{
+		Store:           store,
+		IdleTimeout:     10 * time.Minute,
+		AbsoluteTimeout: time.Hour,
+		now:             func() time.Time { return now },
+	}
+	set := serve(t, m, "", setValue("user", "alice"))
+	require.Len(t, set, 1)
+	cookie := "session=" + set[0].Value
+
+	user := func() string {
+		var s *Session
+		serve(t, m, cookie, func(w *response.Writer, req *request.Request) {
+			s = FromRequest(req)
+			ok(w, req)
+		})
+		return s.Get("user")
+	}
+
+	// Test: Each request moves the idle deadline
+	for i := 0; i < 5; i++ {
+		now = now.Add(9 * time.Minute)
+		assert.Equal(t, "alice", user())
+	}
+
+	// Test: The absolute timeout ends the session however busy it is
+	now = now.Add(9 * time.Minute)
+	assert.Equal(t, "alice", user())
+	now = now.Add(9 * time.Minute)
+	assert.Empty(t, user())
+
+	// Test: The idle timeout ends unused sessions and the stale cookie is removed
+	now = time.Now()
+	m.now = func() time.Time { return now }
+	set = serve(t, m, "", setValue("user", "bob"))
+	cookie = "session=" + set[0].Value
+	now = now.Add(11 * time.Minute)
+	set = serve(t, m, cookie, ok)
+	require.Len(t, set, 1)
+	assert.Equal(t, -1, set[0].MaxAge)
+}
+
+func TestManagerCookieSide(t *testing.T) {
+	codec, err := NewCodec(bytes.Repeat([]byte("s"), 32))
+	require.NoError(t, err)
+	m := &Manager{Codec: codec, Cookie: cookies.Cookie{Name: "__Host-sess", Secure: true, SameSite: cookies.SameSiteLax}}
+
+	// Test: The session travels in the cookie
+	set := serve(t, m, "", setValue("user", "alice"))
+	require.Len(t, set, 1)
+	assert.Equal(t, "__Host-sess", set[0].Name)
+	cookie := "__Host-sess=" + set[0].Value
+
+	var seen string
+	serve(t, m, cookie, func(w *response.Writer, req *request.Request) {
+		seen = FromRequest(req).Get("user")
+		ok(w, req)
+	})
+	assert.Equal(t, "alice", seen)
+
+	// Test: Forged cookies start a new session
+	serve(t, m, "__Host-sess=forged.value", func(w *response.Writer, req *request.Request) {
+		assert.True(t, FromRequest(req).IsNew())
+		ok(w, req)
+	})
+
+	// Test: Managers need somewhere to keep sessions
+	assert.Panics(t, func() { (&Manager{}).Middleware(ok) })
+}
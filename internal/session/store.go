@@ -0,0 +1,300 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/expiry"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSessions bounds a MemoryStore when MaxSessions is zero
+const DefaultMaxSessions = 100_000
+
+// ErrNotFound is returned by Store.Load for sessions that don't exist or
+// have expired
+var ErrNotFound = errors.New("session not found")
+
+// Store keeps sessions on the server, keyed by ID. It must be safe for
+// concurrent use.
+type Store interface {
+	// Load returns the session with id, or ErrNotFound
+	Load(id string) (*Record, error)
+	// Save stores rec under rec.ID until expires, replacing what was there
+	Save(rec *Record, expires time.Time) error
+	// Delete removes the session with id; deleting one that doesn't exist
+	// isn't an error
+	Delete(id string) error
+}
+
+// memoryEntry is a record held by MemoryStore
+type memoryEntry struct {
+	record  Record
+	expires time.Time
+}
+
+// MemoryStore keeps sessions in memory, so they are lost when the process
+// exits. Expired sessions are evicted in the background, and past
+// MaxSessions the sessions closest to expiring are evicted to make room, so
+// clients that never send their cookie back can't fill memory. Sessions are
+// kept ordered by expiry, so neither needs a scan of the whole store.
+type MemoryStore struct {
+	// MaxSessions bounds how many sessions are held, DefaultMaxSessions
+	// when zero
+	MaxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+	// byExpiry orders the IDs of sessions by when they expire
+	byExpiry expiry.Queue[string]
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMemoryStore returns an empty store that evicts expired sessions every
+// interval until it is closed
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		sessions: make(map[string]memoryEntry),
+		stop:     make(chan struct{}),
+	}
+	go s.evict(interval)
+	return s
+}
+
+func (s *MemoryStore) evict(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Prune()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Load implements Store
+func (s *MemoryStore) Load(id string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(s.sessions, id)
+		s.byExpiry.Remove(id)
+		return nil, ErrNotFound
+	}
+	rec := entry.record
+	rec.Values = maps.Clone(rec.Values)
+	return &rec, nil
+}
+
+// Save implements Store
+func (s *MemoryStore) Save(rec *Record, expires time.Time) error {
+	entry := memoryEntry{record: *rec, expires: expires}
+	entry.record.Values = maps.Clone(rec.Values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[rec.ID]; !ok {
+		s.makeRoom()
+	}
+	s.sessions[rec.ID] = entry
+	s.byExpiry.Set(rec.ID, expires)
+	return nil
+}
+
+// makeRoom evicts sessions until there is room for one more: expired ones
+// first, then those closest to expiring. The caller must hold mu.
+func (s *MemoryStore) makeRoom() {
+	maxSessions := s.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxSessions
+	}
+	if len(s.sessions) < maxSessions {
+		return
+	}
+	s.pruneLocked(time.Now())
+	for len(s.sessions) >= maxSessions {
+		id, _ := s.byExpiry.Pop()
+		delete(s.sessions, id)
+	}
+}
+
+// Delete implements Store
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	s.byExpiry.Remove(id)
+	return nil
+}
+
+// Len returns how many sessions the store holds, including expired ones
+// not yet evicted
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Prune evicts expired sessions now
+func (s *MemoryStore) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+}
+
+func (s *MemoryStore) pruneLocked(now time.Time) {
+	for {
+		id, ok := s.byExpiry.PopExpired(now)
+		if !ok {
+			return
+		}
+		delete(s.sessions, id)
+	}
+}
+
+// Close stops evicting expired sessions
+func (s *MemoryStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+// fileSuffix ends the names of the files FileStore keeps sessions in
+const fileSuffix = ".session"
+
+// fileEntry is the JSON a FileStore writes for each session
+type fileEntry struct {
+	Record  Record    `json:"record"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileStore keeps each session in a file of its own in a directory, so
+// sessions survive restarts. Expired sessions are removed when they are
+// next loaded or by Prune.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store keeping sessions in dir, creating it if
+// needed. The directory and files are only readable by the owner.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file holding the session with id. IDs are checked so
+// they can't name files outside the directory.
+func (s *FileStore) path(id string) (string, error) {
+	if !validID(id) {
+		return "", fmt.Errorf("invalid session ID %q", id)
+	}
+	return filepath.Join(s.dir, id+fileSuffix), nil
+}
+
+// Load implements Store
+func (s *FileStore) Load(id string) (*Record, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	entry, err := readFileEntry(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(entry.Expires) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return &entry.Record, nil
+}
+
+func readFileEntry(path string) (*fileEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &entry, nil
+}
+
+// Save implements Store. The file is replaced in one step, so concurrent
+// loads never see it half written.
+func (s *FileStore) Save(rec *Record, expires time.Time) error {
+	path, err := s.path(rec.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(fileEntry{Record: *rec, Expires: expires})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete implements Store
+func (s *FileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Prune removes the files of expired sessions, and of ones that can't be
+// read
+func (s *FileStore) Prune() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileSuffix) {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		entry, err := readFileEntry(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil || !now.Before(entry.Expires) {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package sse
+
+import (
+	"strconv"
+	"sync"
+)
+
+// History keeps the most recent events so reconnecting clients can catch up
+// from their Last-Event-ID. It is safe for concurrent use.
+type History struct {
+	mu     sync.Mutex
+	events []Event
+	size   int
+	nextID uint64
+}
+
+// NewHistory creates a history holding up to size events
+func NewHistory(size int) *History {
+	return &History{size: size, nextID: 1}
+}
+
+// Add records an event, assigning it the next sequential ID if it has none,
+// and returns the event as recorded
+func (h *History) Add(e Event) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e.ID == "" {
+		e.ID = strconv.FormatUint(h.nextID, 10)
+		h.nextID++
+	}
+	h.events = append(h.events, e)
+	if len(h.events) > h.size {
+		// Drop the oldest events; copying keeps the backing array from growing forever
+		h.events = append([]Event(nil), h.events[len(h.events)-h.size:]...)
+	}
+	return e
+}
+
+// Since returns the events recorded after the event with the given ID. It
+// returns false if that event isn't in the history anymore.
+func (h *History) Since(id string) ([]Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].ID == id {
+			return append([]Event(nil), h.events[i+1:]...), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,222 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often Start sends a comment to keep an idle
+// stream open when no interval is given. Proxies commonly drop connections
+// that have been silent for 30 to 60 seconds.
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// ErrClosed is returned when sending on a stream that was closed or whose client went away
+var ErrClosed = errors.New("sse: stream closed")
+
+// Event is a single server-sent event. Only Data is required.
+type Event struct {
+	// ID is remembered by the client and sent back as Last-Event-ID when it reconnects
+	ID string
+	// Event names the event type; clients dispatch on it. Empty means "message".
+	Event string
+	// Retry, if set, tells the client how long to wait before reconnecting
+	Retry time.Duration
+	// Data is the payload. It may span several lines.
+	Data string
+}
+
+// encode formats the event in the text/event-stream format
+func (e Event) encode() ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return nil, fmt.Errorf("sse: event id must not contain newlines or NUL: %q", e.ID)
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return nil, fmt.Errorf("sse: event name must not contain newlines: %q", e.Event)
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	// Every line of the payload needs its own data field; the client joins them with "\n"
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	// A blank line dispatches the event
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
+
+// Stream writes server-sent events to a client over a chunked response. It is
+// safe for concurrent use.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// Start answers req with a 200 text/event-stream response and returns a stream
+// to send events on. A comment is sent every heartbeat (DefaultHeartbeatInterval
+// when zero, never when negative) so idle connections stay open and a client
+// that went away is noticed.
+func Start(w *response.Writer, req *request.Request, heartbeat time.Duration) (*Stream, error) {
+	responseHeaders := headers.NewHeaders()
+	responseHeaders.Override("Content-Type", "text/event-stream")
+	responseHeaders.Override("Cache-Control", "no-cache")
+	responseHeaders.Override("Transfer-Encoding", "chunked")
+	responseHeaders.Override("Connection", "close")
+	// Ask buffering proxies such as nginx to pass events through as they come
+	responseHeaders.Override("X-Accel-Buffering", "no")
+
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(responseHeaders); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: strings.TrimSpace(req.Headers.Get("Last-Event-ID")),
+		done:        make(chan struct{}),
+	}
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeatInterval
+	}
+	if heartbeat > 0 {
+		go s.heartbeat(heartbeat)
+	}
+	go s.watch(req.Context())
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event the client saw before
+// reconnecting, or "" on a first connection
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Send writes an event to the client
+func (s *Stream) Send(e Event) error {
+	data, err := e.encode()
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// Comment writes a comment line, which clients ignore
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("sse: comment must not contain newlines: %q", text)
+	}
+	return s.write([]byte(": " + text + "\n\n"))
+}
+
+// Replay sends the events from history the client missed since LastEventID.
+// It returns false when the client's last event is no longer in history, in
+// which case nothing is sent and the caller should resynchronise the client
+// some other way.
+func (s *Stream) Replay(history *History) (bool, error) {
+	if s.lastEventID == "" {
+		return true, nil
+	}
+	events, ok := history.Since(s.lastEventID)
+	if !ok {
+		return false, nil
+	}
+	for _, e := range events {
+		if err := s.Send(e); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Done is closed when the stream ends, either because Close was called, a
+// write failed since the client disconnected or the request's context ended
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends the response and stops the heartbeat
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.shutdown()
+	if _, err := s.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return s.w.WriteTrailers(headers.NewHeaders())
+}
+
+// write sends one chunk, marking the stream done if the client has gone away
+func (s *Stream) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := s.w.WriteChunkedBody(data); err != nil {
+		s.shutdown()
+		return fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	return nil
+}
+
+// shutdown marks the stream closed. The caller must hold mu.
+func (s *Stream) shutdown() {
+	s.closed = true
+	close(s.done)
+}
+
+// watch ends the stream once ctx ends
+func (s *Stream) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.closed {
+			s.shutdown()
+		}
+	case <-s.done:
+	}
+}
+
+// heartbeat sends a comment every interval until the stream ends
+func (s *Stream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.Comment("heartbeat") != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package sse
+
+import (
+	"bufio"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventEncode(t *testing.T) {
+	// Test: All fields are written in order with a blank line at the end
+	data, err := Event{ID: "7", Event: "update", Retry: 3 * time.Second, Data: "hello"}.encode()
+	require.NoError(t, err)
+	assert.Equal(t, "id: 7\nevent: update\nretry: 3000\ndata: hello\n\n", string(data))
+
+	// Test: Multi-line data gets one data field per line, whatever the line ending
+	data, err = Event{Data: "one\ntwo\r\nthree\rfour"}.encode()
+	require.NoError(t, err)
+	assert.Equal(t, "data: one\ndata: two\ndata: three\ndata: four\n\n", string(data))
+
+	// Test: Empty data still produces a data field
+	data, err = Event{Event: "ping"}.encode()
+	require.NoError(t, err)
+	assert.Equal(t, "event: ping\ndata: \n\n", string(data))
+
+	// Test: Newlines in the ID or event name are rejected
+	_, err = Event{ID: "1\n2", Data: "x"}.encode()
+	require.Error(t, err)
+	_, err = Event{Event: "a\rb", Data: "x"}.encode()
+	require.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	// Test: The response is a chunked text/event-stream carrying the events
+	pr, pw := io.Pipe()
+	req := newRequest("")
+	go func() {
+		s, err := Start(response.NewWriter(pw), req, -1)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		s.Send(Event{ID: "1", Data: "first"})
+		s.Comment("keep going")
+		s.Send(Event{ID: "2", Event: "done", Data: "a\nb"})
+		s.Close()
+		pw.Close()
+	}()
+	resp, err := response.ResponseFromReader(pr, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("Cache-Control"))
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\ndata: first\n\n: keep going\n\nid: 2\nevent: done\ndata: a\ndata: b\n\n", string(body))
+
+	// Test: Sending after Close fails
+	s, err := Start(response.NewWriter(io.Discard), req, -1)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	<-s.Done()
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	// Test: Idle streams get comment heartbeats
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	started := make(chan *Stream, 1)
+	go func() {
+		// net.Pipe is synchronous, so the head has to be written while we read it
+		s, _ := Start(response.NewWriter(serverSide), newRequest(""), 10*time.Millisecond)
+		started <- s
+	}()
+	reader := readHead(t, clientSide)
+	s := <-started
+	require.NotNil(t, s)
+	defer s.Close()
+	line, err := reader.ReadString('\n') // chunk size
+	require.NoError(t, err)
+	assert.Equal(t, "d\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": heartbeat\n", line)
+
+	// Test: A client that went away is noticed by the next heartbeat
+	clientSide.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream didn't notice the client disconnecting")
+	}
+	require.ErrorIs(t, s.Send(Event{Data: "gone"}), ErrClosed)
+}
+
+func TestHistoryReplay(t *testing.T) {
+	history := NewHistory(3)
+	for _, data := range []string{"a", "b", "c", "d"} {
+		history.Add(Event{Data: data})
+	}
+
+	// Test: IDs are assigned sequentially and only the newest events are kept
+	events, ok := history.Since("2")
+	require.True(t, ok)
+	require.Len(t, events, 2)
+	assert.Equal(t, Event{ID: "3", Data: "c"}, events[0])
+	assert.Equal(t, Event{ID: "4", Data: "d"}, events[1])
+	_, ok = history.Since("1")
+	assert.False(t, ok)
+
+	// Test: Replay resumes from Last-Event-ID
+	var out strings.Builder
+	s, err := Start(response.NewWriter(&out), newRequest("3"), -1)
+	require.NoError(t, err)
+	assert.Equal(t, "3", s.LastEventID())
+	ok, err = s.Replay(history)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Contains(t, out.String(), "id: 4\ndata: d\n\n")
+	assert.NotContains(t, out.String(), "data: c")
+
+	// Test: An unknown Last-Event-ID is reported so the caller can resynchronise
+	s, err = Start(response.NewWriter(io.Discard), newRequest("1"), -1)
+	require.NoError(t, err)
+	ok, err = s.Replay(history)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func newRequest(lastEventID string) *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/events", HttpVersion: "1.1"},
+		Headers:     map[string]string{},
+	}
+	if lastEventID != "" {
+		req.Headers.Set("Last-Event-ID", lastEventID)
+	}
+	return req
+}
+
+// readHead reads the status line and headers off the client side of a pipe
+func readHead(t *testing.T, conn net.Conn) *bufio.Reader {
+	t.Helper()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return reader
+		}
+	}
+}
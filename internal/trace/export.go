@@ -0,0 +1,107 @@
+package trace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere, such as a tracing backend. It is
+// called from the goroutine that finished the span and must be safe for
+// concurrent use. Spans aren't changed after they are exported.
+type Exporter interface {
+	ExportSpan(span *Span) error
+}
+
+// MemoryExporter keeps exported spans in memory, for tests and debugging
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// ExportSpan implements Exporter
+func (e *MemoryExporter) ExportSpan(span *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// Spans returns the spans exported so far, oldest first
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset forgets every span exported so far
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// FileExporter appends each span to a file as a line of JSON
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens path for appending, creating it if needed
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+// spanJSON is how a span is written by FileExporter
+type spanJSON struct {
+	Name         string         `json:"name"`
+	Kind         SpanKind       `json:"kind"`
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	TraceState   string         `json:"tracestate,omitempty"`
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+	DurationMS   float64        `json:"duration_ms"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+}
+
+// ExportSpan implements Exporter. Each line goes to the file in a single
+// write, so lines from concurrent processes don't interleave.
+func (e *FileExporter) ExportSpan(span *Span) error {
+	record := spanJSON{
+		Name:       span.Name,
+		Kind:       span.Kind,
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		TraceState: span.Context.TraceState,
+		Start:      span.Start,
+		End:        span.End,
+		DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Attributes: span.Attributes,
+	}
+	if span.Parent.IsValid() {
+		record.ParentSpanID = span.Parent.String()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
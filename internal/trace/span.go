@@ -0,0 +1,187 @@
+package trace
+
+import (
+	"context"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind says which side of a call a span records
+type SpanKind string
+
+const (
+	// KindServer spans record handling a request
+	KindServer SpanKind = "server"
+	// KindClient spans record a request sent to another service
+	KindClient SpanKind = "client"
+)
+
+// Span records one operation within a trace. Its methods may be called on a
+// nil *Span, doing nothing, so code can record spans whether or not the
+// request is traced.
+type Span struct {
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	// Parent is the span this one was started within, zero for the first
+	Parent     SpanID
+	Start, End time.Time
+	Attributes map[string]any
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute records a value such as a status code on the span. It has no
+// effect once the span ended.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.Attributes[key] = value
+	}
+}
+
+// Finish ends the span and exports it if it is sampled. Only the first call
+// has any effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Context.Sampled() {
+		s.tracer.export(s)
+	}
+}
+
+// SpanContext returns what is propagated for the span, or the zero value for
+// a nil span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// spanKey stores the current span in a context
+type spanKey struct{}
+
+// FromContext returns the span ctx carries, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a span within the one ctx carries and returns a context
+// carrying the new span. Without a span in ctx nothing is traced and it
+// returns ctx and nil.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.Context, parent.Context.SpanID)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Inject writes the trace context of the span ctx carries into h, so the
+// service a request is sent to continues the trace. Without a span h is left
+// alone.
+func Inject(ctx context.Context, h headers.Headers) {
+	if span := FromContext(ctx); span != nil {
+		InjectSpanContext(span.Context, h)
+	}
+}
+
+// Tracer starts a span for each request and exports the sampled ones
+type Tracer struct {
+	// Exporter receives spans as they end
+	Exporter Exporter
+	// ErrorLog receives export failures; slog.Default() when nil
+	ErrorLog *slog.Logger
+	// Route names the route a request's span is named after, which should
+	// come from a fixed set. If nil, the path of the request target without
+	// the query is used.
+	Route func(req *request.Request) string
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// the client sent in traceparent if any and starting a new sampled one
+// otherwise. The span is carried by the request's context for Start and
+// Inject, and records the method, route, status and body sizes once the
+// handler returns.
+func (t *Tracer) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		parent, ok := Extract(req.Headers)
+		if !ok {
+			parent = SpanContext{TraceID: newTraceID(), Flags: FlagSampled}
+		}
+		path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+		route := path
+		if t.Route != nil {
+			route = t.Route(req)
+		}
+		span := t.newSpan(req.RequestLine.Method+" "+route, KindServer, parent, parent.SpanID)
+		span.SetAttribute("http.method", req.RequestLine.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", path)
+		span.SetAttribute("http.flavor", req.RequestLine.HttpVersion)
+		span.SetAttribute("http.request_content_length", len(req.Body))
+		span.SetAttribute("net.peer.addr", req.RemoteAddr)
+		defer span.Finish()
+
+		next(w, req.WithValue(spanKey{}, span))
+
+		span.SetAttribute("http.status_code", int(w.Status()))
+		span.SetAttribute("http.response_content_length", w.BytesWritten())
+	}
+}
+
+// newSpan starts a span in the trace of parent, whose flags and tracestate
+// it inherits
+func (t *Tracer) newSpan(name string, kind SpanKind, parent SpanContext, parentID SpanID) *Span {
+	return &Span{
+		Name: name,
+		Kind: kind,
+		Context: SpanContext{
+			TraceID:    parent.TraceID,
+			SpanID:     newSpanID(),
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		},
+		Parent:     parentID,
+		Start:      time.Now(),
+		Attributes: make(map[string]any),
+		tracer:     t,
+	}
+}
+
+func (t *Tracer) export(span *Span) {
+	if t.Exporter == nil {
+		return
+	}
+	if err := t.Exporter.ExportSpan(span); err != nil {
+		logger := t.ErrorLog
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("exporting span failed", "trace_id", span.Context.TraceID.String(), "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	// Test: A valid version 00 value round-trips
+	value := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, err := ParseTraceparent(value)
+	require.NoError(t, err)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", sc.TraceID.String())
+	assert.Equal(t, "b7ad6b7169203331", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, value, sc.Traceparent())
+
+	// Test: Later versions are read as far as version 00 goes
+	sc, err = ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00-extra")
+	require.NoError(t, err)
+	assert.False(t, sc.Sampled())
+
+	// Test: Invalid values are rejected
+	for _, invalid := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333x-01",
+		"00_0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	} {
+		_, err := ParseTraceparent(invalid)
+		assert.ErrorIs(t, err, ErrInvalidTraceparent, invalid)
+	}
+}
+
+func TestParseTracestate(t *testing.T) {
+	// Test: Valid lists are kept, dropping empty members
+	assert.Equal(t, "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE", ParseTracestate("rojo=00f067aa0ba902b7, ,congo=t61rcWkgMzE"))
+	assert.Equal(t, "1tenant@vendor=x", ParseTracestate("1tenant@vendor=x"))
+
+	// Test: Invalid lists are dropped entirely
+	assert.Equal(t, "", ParseTracestate("rojo=1,Upper=2"))
+	assert.Equal(t, "", ParseTracestate("rojo=1,rojo=2"))
+	assert.Equal(t, "", ParseTracestate("rojo"))
+	assert.Equal(t, "", ParseTracestate("rojo=a=b"))
+}
+
+func TestTracerMiddleware(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := &Tracer{Exporter: exporter}
+	var child *Span
+	handler := tracer.Middleware(func(w *response.Writer, req *request.Request) {
+		var ctx context.Context
+		ctx, child = Start(req.Context(), "lookup", KindClient)
+		h := headers.NewHeaders()
+		Inject(ctx, h)
+		assert.Equal(t, child.Context.Traceparent(), h.Get("traceparent"))
+		child.Finish()
+		w.WriteResponse(response.StatusOK, nil, []byte("hello"))
+	})
+	serve := func(h headers.Headers) {
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: "POST", RequestTarget: "/items?x=1", HttpVersion: "1.1"},
+			Headers:     h,
+			Body:        []byte("abc"),
+		}
+		var out bytes.Buffer
+		handler(response.NewWriter(&out), req)
+	}
+
+	// Test: A request without trace context starts a new sampled trace
+	serve(headers.NewHeaders())
+	spans := exporter.Spans()
+	require.Len(t, spans, 2)
+	server := spans[1]
+	assert.Equal(t, "POST /items", server.Name)
+	assert.Equal(t, KindServer, server.Kind)
+	assert.False(t, server.Parent.IsValid())
+	assert.True(t, server.Context.Sampled())
+	assert.Equal(t, "POST", server.Attributes["http.method"])
+	assert.Equal(t, "/items", server.Attributes["http.route"])
+	assert.Equal(t, 200, server.Attributes["http.status_code"])
+	assert.Equal(t, 3, server.Attributes["http.request_content_length"])
+	assert.Equal(t, int64(5), server.Attributes["http.response_content_length"])
+	assert.Equal(t, server.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, server.Context.SpanID, child.Parent)
+	assert.False(t, server.End.Before(server.Start))
+
+	// Test: Spans are named after the route Route gives, keeping the path as the target
+	exporter.Reset()
+	tracer.Route = func(req *request.Request) string { return "/items/{id}" }
+	serve(headers.NewHeaders())
+	spans = exporter.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "POST /items/{id}", spans[1].Name)
+	assert.Equal(t, "/items/{id}", spans[1].Attributes["http.route"])
+	assert.Equal(t, "/items", spans[1].Attributes["http.target"])
+	tracer.Route = nil
+
+	// Test: An incoming trace is continued
+	exporter.Reset()
+	h := headers.NewHeaders()
+	h.Override("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	serve(h)
+	spans = exporter.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[1].Context.TraceID.String())
+	assert.Equal(t, "b7ad6b7169203331", spans[1].Parent.String())
+
+	// Test: Unsampled traces are propagated but not exported
+	exporter.Reset()
+	h.Override("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	serve(h)
+	assert.Empty(t, exporter.Spans())
+	assert.False(t, child.Context.Sampled())
+
+	// Test: Without a span in the context nothing is traced
+	ctx, span := Start(context.Background(), "untraced", KindClient)
+	assert.Nil(t, span)
+	span.SetAttribute("ignored", true)
+	span.Finish()
+	h = headers.NewHeaders()
+	Inject(ctx, h)
+	assert.Empty(t, h.Get("traceparent"))
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := NewFileExporter(path)
+	require.NoError(t, err)
+	tracer := &Tracer{Exporter: exporter}
+
+	// Test: Each span is written as a line of JSON
+	parent := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Flags: FlagSampled}
+	for range 2 {
+		span := tracer.newSpan("work", KindServer, parent, parent.SpanID)
+		span.SetAttribute("n", 1)
+		span.Finish()
+	}
+	require.NoError(t, exporter.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	require.Len(t, lines, 2)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &record))
+	assert.Equal(t, "work", record["name"])
+	assert.Equal(t, parent.TraceID.String(), record["trace_id"])
+	assert.Equal(t, parent.SpanID.String(), record["parent_span_id"])
+	assert.Equal(t, map[string]any{"n": float64(1)}, record["attributes"])
+}
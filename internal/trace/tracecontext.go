@@ -0,0 +1,218 @@
+// Package trace records a span for every request and propagates trace
+// context to other services through the traceparent and tracestate headers
+// of W3C Trace Context (https://www.w3.org/TR/trace-context/).
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"strings"
+)
+
+// Header names of W3C Trace Context
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// maxTracestateMembers is how many list members tracestate may have
+const maxTracestateMembers = 32
+
+// ErrInvalidTraceparent is returned for traceparent values that don't follow
+// the specification, which are then ignored as if missing
+var ErrInvalidTraceparent = errors.New("trace: invalid traceparent")
+
+// TraceID identifies a trace, shared by every span in it
+type TraceID [16]byte
+
+// String returns the ID as 32 lowercase hex digits
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID isn't all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the ID as 16 lowercase hex digits
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID isn't all zeros
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// FlagSampled is the trace flag saying the caller may have recorded its span
+const FlagSampled byte = 0x01
+
+// SpanContext is the part of a span that travels between services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// TraceState is the vendor-specific tracestate list, passed on as is
+	TraceState string
+}
+
+// Sampled reports whether the sampled flag is set
+func (sc SpanContext) Sampled() bool { return sc.Flags&FlagSampled != 0 }
+
+// IsValid reports whether both IDs are set
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formats the span context as a version 00 traceparent value
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Versions after 00 are
+// read as far as version 00 goes, as the specification asks.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	// version-traceid-parentid-flags is 2+1+32+1+16+1+2 characters
+	const length = 55
+	if len(value) < length || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, ErrInvalidTraceparent
+	}
+	version, ok := decodeHex(value[0:2])
+	if !ok || version[0] == 0xff {
+		return sc, ErrInvalidTraceparent
+	}
+	// Version 00 is exactly this long; later ones may add fields after a dash
+	if len(value) > length && (version[0] == 0 || value[length] != '-') {
+		return sc, ErrInvalidTraceparent
+	}
+
+	traceID, ok := decodeHex(value[3:35])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	spanID, ok := decodeHex(value[36:52])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	flags, ok := decodeHex(value[53:55])
+	if !ok {
+		return sc, ErrInvalidTraceparent
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	return sc, nil
+}
+
+// decodeHex decodes lowercase hex only, which is all traceparent allows
+func decodeHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// ParseTracestate validates a tracestate header value, returning it with
+// empty list members dropped. Invalid values give "", since the
+// specification says to discard the whole list then.
+func ParseTracestate(value string) string {
+	var members []string
+	seen := make(map[string]bool)
+	for _, member := range strings.Split(value, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(member, "=")
+		if !ok || !validTracestateKey(key) || !validTracestateValue(val) || seen[key] {
+			return ""
+		}
+		seen[key] = true
+		members = append(members, member)
+	}
+	if len(members) > maxTracestateMembers {
+		return ""
+	}
+	return strings.Join(members, ",")
+}
+
+// validTracestateKey checks a key is a simple key or tenant@system, made of
+// lowercase letters, digits and _-*/ and starting with a letter or digit
+func validTracestateKey(key string) bool {
+	tenant, system, multiTenant := strings.Cut(key, "@")
+	if !multiTenant {
+		return validKeyPart(key, 256, false)
+	}
+	return validKeyPart(tenant, 241, true) && validKeyPart(system, 14, false)
+}
+
+func validKeyPart(s string, maxLen int, digitFirst bool) bool {
+	if s == "" || len(s) > maxLen {
+		return false
+	}
+	first := s[0]
+	if !(first >= 'a' && first <= 'z') && !(digitFirst && first >= '0' && first <= '9') {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && !strings.ContainsRune("_-*/", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validTracestateValue checks a value is 1 to 256 printable ASCII characters
+// other than comma and equals, not ending in a space
+func validTracestateValue(value string) bool {
+	if value == "" || len(value) > 256 || value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// Extract reads the span context a caller sent in h. It reports false when
+// there is none or it is invalid.
+func Extract(h headers.Headers) (SpanContext, bool) {
+	sc, err := ParseTraceparent(strings.TrimSpace(h.Get(TraceparentHeader)))
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.TraceState = ParseTracestate(h.Get(TracestateHeader))
+	return sc, true
+}
+
+// InjectSpanContext writes sc into h for the next service
+func InjectSpanContext(sc SpanContext, h headers.Headers) {
+	h.Override(TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Override(TracestateHeader, sc.TraceState)
+	} else {
+		h.Delete(TracestateHeader)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
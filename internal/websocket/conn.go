@@ -0,0 +1,504 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Frame opcodes (RFC 6455 section 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes (RFC 6455 section 7.4.1)
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+const (
+	maxControlPayload = 125
+	// closeTimeout bounds waiting for the peer to answer our close frame
+	closeTimeout = 5 * time.Second
+)
+
+// deflateTail is stripped from compressed messages and put back before inflating (RFC 7692 section 7.2.1)
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// ErrClosed is returned when writing to a connection after the close handshake started
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage once the peer has closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. ReadMessage must only be called from one
+// goroutine at a time; the write methods are safe to call concurrently.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	isServer       bool
+	maxMessageSize int64
+	compress       bool
+	subprotocol    string
+
+	// PingHandler, if set, is called with the payload of every ping after the pong is sent
+	PingHandler func(data []byte)
+	// PongHandler, if set, is called with the payload of every pong
+	PongHandler func(data []byte)
+	// WriteFragmentSize, if positive, splits outgoing data messages into
+	// fragments of at most this many bytes
+	WriteFragmentSize int
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, isServer bool, maxMessageSize int64, compress bool) *Conn {
+	return &Conn{
+		conn:           conn,
+		reader:         reader,
+		isServer:       isServer,
+		maxMessageSize: maxMessageSize,
+		compress:       compress,
+	}
+}
+
+// Subprotocol returns the negotiated subprotocol, if any
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for reading the next message
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// frame is a single decoded frame
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// ReadMessage reads the next data message, reassembling fragments and
+// answering control frames along the way. Once the peer closes the
+// connection it returns a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var messageType MessageType
+	var message []byte
+	compressed := false
+	inMessage := false
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload, false); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			if c.PingHandler != nil {
+				c.PingHandler(f.payload)
+			}
+			continue
+		case opPong:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, c.fail(CloseProtocolError, "new message started before the previous one finished")
+			}
+			inMessage = true
+			messageType = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message")
+			}
+			if f.rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, "RSV1 set on a continuation frame")
+			}
+		}
+
+		if int64(len(message)+len(f.payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			message, err = c.inflate(message)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads and validates a single frame
+func (c *Conn) readFrame() (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		rsv1:   head[0]&0x40 != 0,
+		opcode: head[0] & 0x0f,
+	}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x30 != 0 || (f.rsv1 && !c.compress) {
+		return nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	isControl := f.opcode&0x8 != 0
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", f.opcode))
+	}
+	if isControl && (!f.fin || f.rsv1) {
+		return nil, c.fail(CloseProtocolError, "control frames must not be fragmented or compressed")
+	}
+	// Clients must mask every frame and servers must never mask (RFC 6455 section 5.1)
+	if masked != c.isServer {
+		return nil, c.fail(CloseProtocolError, "incorrect frame masking")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if isControl && length > maxControlPayload {
+		return nil, c.fail(CloseProtocolError, "control frame payload too long")
+	}
+	if length > uint64(c.maxMessageSize) {
+		return nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, maskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(maskKey, f.payload)
+	}
+	return f, nil
+}
+
+// WriteMessage sends a data message, compressing it if permessage-deflate was negotiated
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("websocket: unknown message type %d", messageType)
+	}
+
+	compressed := false
+	if c.compress {
+		deflated, err := deflate(data)
+		if err != nil {
+			return err
+		}
+		data, compressed = deflated, true
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+
+	opcode := byte(messageType)
+	for {
+		chunk := data
+		if c.WriteFragmentSize > 0 && len(chunk) > c.WriteFragmentSize {
+			chunk = data[:c.WriteFragmentSize]
+		}
+		data = data[len(chunk):]
+		fin := len(data) == 0
+		if err := c.writeFrameLocked(opcode, chunk, fin, compressed); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		// Only the first frame carries the opcode and the compression bit
+		opcode, compressed = opContinuation, false
+	}
+}
+
+// WritePing sends a ping with an optional payload of up to 125 bytes
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeFrame(opPing, data, false)
+}
+
+// Close starts the close handshake with a normal closure and closes the
+// connection once the peer answers or closeTimeout passes
+func (c *Conn) Close() error {
+	return c.CloseWithReason(CloseNormalClosure, "")
+}
+
+// CloseWithReason is Close with a specific status code and reason
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	sent, err := c.writeClose(code, reason)
+	if !sent || err != nil {
+		// Either the handshake already happened or the connection is broken
+		c.conn.Close()
+		return err
+	}
+
+	// Wait for the peer's close frame, discarding anything sent before it
+	c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+	for {
+		f, err := c.readFrame()
+		if err != nil || f.opcode == opClose {
+			break
+		}
+	}
+	return c.conn.Close()
+}
+
+// handleClose answers a close frame from the peer and closes the connection
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	if len(payload) == 1 {
+		c.fail(CloseProtocolError, "invalid close payload")
+		return closeErr
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			c.fail(CloseProtocolError, "invalid close payload")
+			return closeErr
+		}
+	}
+
+	// Echo the status code back (RFC 6455 section 5.5.1)
+	echoCode := closeErr.Code
+	if echoCode == CloseNoStatusReceived {
+		echoCode = CloseNormalClosure
+	}
+	c.writeClose(echoCode, "")
+	c.conn.Close()
+	return closeErr
+}
+
+// fail closes the connection after a protocol violation and returns the error to report
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// writeClose sends a close frame unless one was already sent, reporting whether it sent one
+func (c *Conn) writeClose(code int, reason string) (bool, error) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return false, nil
+	}
+	c.closeSent = true
+	return true, c.writeFrameLocked(opClose, payload, true, false)
+}
+
+// writeFrame sends a single unfragmented frame
+func (c *Conn) writeFrame(opcode byte, payload []byte, compressed bool) error {
+	if opcode&0x8 != 0 && len(payload) > maxControlPayload {
+		return fmt.Errorf("websocket: control frame payload longer than %d bytes", maxControlPayload)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload, true, compressed)
+}
+
+// writeFrameLocked encodes and writes a frame; writeMu must be held
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte, fin, compressed bool) error {
+	buf := make([]byte, 0, 14+len(payload))
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if compressed {
+		first |= 0x40
+	}
+	buf = append(buf, first)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		buf = append(buf, maskKey[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(maskKey, buf[start:])
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// inflate decompresses a permessage-deflate message, bounded by maxMessageSize
+func (c *Conn) inflate(message []byte) ([]byte, error) {
+	reader := flate.NewReader(io.MultiReader(bytes.NewReader(message), bytes.NewReader(deflateTail)))
+	defer reader.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(reader, c.maxMessageSize+1))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, c.fail(CloseInvalidPayload, "invalid compressed message")
+	}
+	if int64(len(inflated)) > c.maxMessageSize {
+		return nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+	return inflated, nil
+}
+
+// deflate compresses a message for permessage-deflate
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// validCloseCode reports whether a code may appear in a close frame (RFC 6455 section 7.4)
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func maskBytes(key [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= key[i%4]
+	}
+}
+
+// prefixReader replays bytes buffered during the handshake before reading from the connection
+type prefixReader struct {
+	prefix []byte
+	conn   net.Conn
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.conn.Read(b)
+}
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+// acceptGUID is appended to the client's key to build Sec-WebSocket-Accept (RFC 6455 section 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize bounds reassembled messages when an Upgrader doesn't set its own
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrBadHandshake is returned by Upgrade when the request isn't a valid WebSocket opening handshake
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Upgrader turns HTTP requests into WebSocket connections
+type Upgrader struct {
+	// MaxMessageSize bounds the size of a reassembled (and decompressed)
+	// message. Larger messages close the connection with 1009.
+	MaxMessageSize int64
+	// EnableCompression negotiates permessage-deflate when the client offers it
+	EnableCompression bool
+	// Subprotocols lists the subprotocols we speak, in order of preference
+	Subprotocols []string
+	// CheckOrigin, if set, must return true for the handshake to succeed
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Upgrade validates the opening handshake, replies with 101 Switching
+// Protocols and takes over the connection. On failure it writes an error
+// response and returns an error wrapping ErrBadHandshake.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, status, err := u.validate(req)
+	if err != nil {
+		extra := headers.NewHeaders()
+		if status == response.StatusUpgradeRequired {
+			// Tell the client which version we speak (RFC 6455 section 4.4)
+			extra.Override("Sec-WebSocket-Version", "13")
+		}
+		w.WriteError(status, extra)
+		return nil, err
+	}
+
+	responseHeaders := headers.NewHeaders()
+	responseHeaders.Override("Upgrade", "websocket")
+	responseHeaders.Override("Connection", "Upgrade")
+	responseHeaders.Override("Sec-WebSocket-Accept", AcceptKey(key))
+
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		responseHeaders.Override("Sec-WebSocket-Protocol", subprotocol)
+	}
+	compress := u.EnableCompression && offersDeflate(req.Headers.Get("Sec-WebSocket-Extensions"))
+	if compress {
+		// Without context takeover every message is compressed on its own,
+		// which keeps both sides stateless between messages (RFC 7692 section 7.1.1)
+		responseHeaders.Override("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(responseHeaders); err != nil {
+		return nil, err
+	}
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageSize := u.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	// Frames the client sent straight after the handshake are already buffered
+	reader := bufio.NewReader(&prefixReader{prefix: buffered, conn: netConn})
+	conn := newConn(netConn, reader, true, maxMessageSize, compress)
+	conn.subprotocol = subprotocol
+	return conn, nil
+}
+
+// validate checks the opening handshake (RFC 6455 section 4.2.1). It returns
+// the client's key, or the status to reject the request with.
+func (u *Upgrader) validate(req *request.Request) (string, response.StatusCode, error) {
+	if req.RequestLine.Method != "GET" {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: method must be GET, got %s", ErrBadHandshake, req.RequestLine.Method)
+	}
+	if !headers.HasToken(req.Headers.Get("Connection"), "upgrade") {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: missing Connection: upgrade", ErrBadHandshake)
+	}
+	if !headers.HasToken(req.Headers.Get("Upgrade"), "websocket") {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: missing Upgrade: websocket", ErrBadHandshake)
+	}
+	if version := req.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		return "", response.StatusUpgradeRequired, fmt.Errorf("%w: unsupported version %q", ErrBadHandshake, version)
+	}
+	key := strings.TrimSpace(req.Headers.Get("Sec-WebSocket-Key"))
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 16 {
+		return "", response.StatusBadRequest, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(req) {
+		return "", response.StatusForbidden, fmt.Errorf("%w: origin not allowed", ErrBadHandshake)
+	}
+	return key, response.StatusOK, nil
+}
+
+// selectSubprotocol picks our most preferred subprotocol that the client offered
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := req.Headers.Get("Sec-WebSocket-Protocol")
+	for _, protocol := range u.Subprotocols {
+		if headers.HasToken(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// IsUpgradeRequest reports whether a request asks to switch to WebSocket
+func IsUpgradeRequest(req *request.Request) bool {
+	return headers.HasToken(req.Headers.Get("Connection"), "upgrade") && headers.HasToken(req.Headers.Get("Upgrade"), "websocket")
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// offersDeflate reports whether the client offered permessage-deflate with
+// parameters we can honour. We can't shrink our compression window, so offers
+// asking for a smaller server window are skipped.
+func offersDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		acceptable := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name == "server_max_window_bits" && strings.Trim(value, `"`) != "15" {
+				acceptable = false
+			}
+		}
+		if acceptable {
+			return true
+		}
+	}
+	return false
+}
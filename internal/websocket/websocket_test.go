@@ -0,0 +1,232 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey(testKey))
+}
+
+func TestUpgradeHandshake(t *testing.T) {
+	// Test: Valid handshake is answered with 101
+	upgrader := &Upgrader{Subprotocols: []string{"chat"}}
+	client, _, resp := dialEcho(t, upgrader, "Sec-WebSocket-Protocol: superchat, chat\r\n")
+	assert.Contains(t, resp, "HTTP/1.1 101 Switching Protocols\r\n")
+	assert.Contains(t, resp, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, resp, "sec-websocket-protocol: chat\r\n")
+	client.Close()
+
+	// Test: Missing key is a 400
+	req := upgradeRequest()
+	req.Headers.Delete("Sec-WebSocket-Key")
+	status, _ := rejectedUpgrade(t, &Upgrader{}, req)
+	assert.Equal(t, response.StatusBadRequest, status)
+
+	// Test: Wrong version is a 426 advertising version 13
+	req = upgradeRequest()
+	req.Headers.Override("Sec-WebSocket-Version", "8")
+	status, out := rejectedUpgrade(t, &Upgrader{}, req)
+	assert.Equal(t, response.StatusUpgradeRequired, status)
+	assert.Contains(t, out, "sec-websocket-version: 13")
+
+	// Test: Rejected origin is a 403
+	req = upgradeRequest()
+	status, _ = rejectedUpgrade(t, &Upgrader{CheckOrigin: func(*request.Request) bool { return false }}, req)
+	assert.Equal(t, response.StatusForbidden, status)
+
+	// Test: Non-upgrade requests are recognised
+	assert.True(t, IsUpgradeRequest(upgradeRequest()))
+	assert.False(t, IsUpgradeRequest(&request.Request{Headers: map[string]string{}}))
+}
+
+func TestConnMessages(t *testing.T) {
+	// Test: Text and binary messages are echoed
+	client, _, _ := dialEcho(t, &Upgrader{}, "")
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+	messageType, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "hello", string(data))
+
+	require.NoError(t, client.WriteMessage(BinaryMessage, []byte{0, 1, 2}))
+	messageType, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, messageType)
+	assert.Equal(t, []byte{0, 1, 2}, data)
+
+	// Test: Fragmented messages are reassembled
+	client.WriteFragmentSize = 3
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("fragmented message")))
+	_, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented message", string(data))
+
+	// Test: Pings are answered with pongs carrying the same payload
+	pongs := make(chan string, 1)
+	client.PongHandler = func(data []byte) { pongs <- string(data) }
+	require.NoError(t, client.WritePing([]byte("are you there")))
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there", <-pongs)
+
+	// Test: Close handshake completes and the server sees the close code
+	require.NoError(t, client.CloseWithReason(CloseGoingAway, "bye"))
+
+	// Test: Oversized messages close the connection with 1009
+	client, serverErr, _ := dialEcho(t, &Upgrader{MaxMessageSize: 8}, "")
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("far too long for the limit")))
+	_, _, err = client.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+	require.ErrorAs(t, <-serverErr, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+
+	// Test: Invalid UTF-8 in a text message closes with 1007
+	client, _, _ = dialEcho(t, &Upgrader{}, "")
+	require.NoError(t, client.WriteMessage(BinaryMessage, []byte("ok")))
+	_, _, err = client.ReadMessage()
+	require.NoError(t, err)
+	client.writeMu.Lock()
+	require.NoError(t, client.writeFrameLocked(opText, []byte{0xff, 0xfe}, true, false))
+	client.writeMu.Unlock()
+	_, _, err = client.ReadMessage()
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseInvalidPayload, closeErr.Code)
+}
+
+func TestConnMasking(t *testing.T) {
+	// Test: Unmasked frames from a client are a protocol error
+	client, serverErr, _ := dialEcho(t, &Upgrader{}, "")
+	client.isServer = true // stop the client from masking
+	require.NoError(t, client.writeFrame(opText, []byte("unmasked"), false))
+	var closeErr *CloseError
+	require.ErrorAs(t, <-serverErr, &closeErr)
+	assert.Equal(t, CloseProtocolError, closeErr.Code)
+}
+
+func TestConnCompression(t *testing.T) {
+	// Test: permessage-deflate is negotiated and messages round-trip
+	client, _, resp := dialEcho(t, &Upgrader{EnableCompression: true}, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Contains(t, resp, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+	client.compress = true
+	message := strings.Repeat("compress me ", 100)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte(message)))
+	_, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+	client.Close()
+
+	// Test: Compression isn't used when the client doesn't offer it
+	_, _, resp = dialEcho(t, &Upgrader{EnableCompression: true}, "")
+	assert.NotContains(t, resp, "sec-websocket-extensions")
+
+	// Test: Offers for a smaller server window are declined
+	assert.False(t, offersDeflate("permessage-deflate; server_max_window_bits=10"))
+	assert.True(t, offersDeflate("x-webkit-deflate-frame, permessage-deflate"))
+}
+
+// dialEcho starts a server that upgrades one connection and echoes every
+// message back, then connects a client to it. It returns the client, a
+// channel with the error that ended the server's read loop, and the raw
+// handshake response.
+func dialEcho(t *testing.T, upgrader *Upgrader, extraHeaders string) (*Conn, <-chan error, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	serverErr := make(chan error, 1)
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		reader := request.NewReader(netConn)
+		req, err := reader.ReadRequest()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		w := response.NewHijackableWriter(netConn, func() (net.Conn, []byte, error) {
+			return netConn, reader.Buffered(), nil
+		})
+		conn, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				serverErr <- err
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}()
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(netConn, "GET /ws HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"%s\r\n", testKey, extraHeaders)
+
+	reader := bufio.NewReader(netConn)
+	var resp strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		resp.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	return newConn(netConn, reader, false, DefaultMaxMessageSize, false), serverErr, resp.String()
+}
+
+func upgradeRequest() *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/ws", HttpVersion: "1.1"},
+		Headers: map[string]string{
+			"connection":            "Upgrade",
+			"upgrade":               "websocket",
+			"sec-websocket-key":     testKey,
+			"sec-websocket-version": "13",
+		},
+	}
+}
+
+// rejectedUpgrade runs Upgrade on a request that should fail and returns the status written
+func rejectedUpgrade(t *testing.T, upgrader *Upgrader, req *request.Request) (response.StatusCode, string) {
+	t.Helper()
+	var out strings.Builder
+	_, err := upgrader.Upgrade(response.NewWriter(&out), req)
+	require.ErrorIs(t, err, ErrBadHandshake)
+	resp, err := response.ResponseFromReader(strings.NewReader(out.String()), "GET")
+	require.NoError(t, err)
+	return resp.StatusLine.StatusCode, out.String()
+}